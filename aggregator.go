@@ -0,0 +1,228 @@
+package fcm
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	// digest_key_prefix prefix of the collapse key and tag of a digest
+	digest_key_prefix = "digest-"
+)
+
+var (
+	// ErrAggregatorClosed the aggregator no longer accepts messages
+	ErrAggregatorClosed = errors.New("fcm: aggregator closed")
+)
+
+// Reducer merges the messages buffered for a recipient and category into
+// the message sent, e.g. "Alice and 4 others liked your post". msgs are in
+// the order they were added, there is at least one
+type Reducer func(recipient string, category string, msgs []*FcmMsg) *FcmMsg
+
+// DigestResult the send of a digest
+type DigestResult struct {
+	Recipient string
+	Category  string
+	// Count the number of messages merged
+	Count  int
+	Status *FcmResponseStatus
+	Err    error
+}
+
+// digestGroup the messages buffered for a recipient and category
+type digestGroup struct {
+	recipient string
+	category  string
+	msgs      []*FcmMsg
+	timer     *time.Timer
+}
+
+// Aggregator buffers the messages of a recipient and category for a window
+// opened by the first one, then sends a single message merged by the
+// reducer. The digest is sent with a stable collapse key and notification
+// tag ("digest-" + category) unless the reducer sets them, so a device
+// shows the latest digest only. State is in memory, Close sends the
+// pending digests
+type Aggregator struct {
+	sender  Sender
+	window  time.Duration
+	reducer Reducer
+
+	logger        Logger
+	resultHandler func(result DigestResult)
+
+	mu     sync.Mutex
+	groups map[string]*digestGroup
+	closed bool
+	// inflight the number of digests being sent, idle is signaled when it
+	// drops to zero
+	inflight int
+	idle     *sync.Cond
+}
+
+// NewAggregator init an aggregator sending its digests with sender
+func NewAggregator(sender Sender, window time.Duration, reducer Reducer) *Aggregator {
+	agg := &Aggregator{
+		sender:  sender,
+		window:  window,
+		reducer: reducer,
+		groups:  make(map[string]*digestGroup),
+	}
+	agg.idle = sync.NewCond(&agg.mu)
+	return agg
+}
+
+// SetLogger sets the logger of the aggregator, nil disables logging
+func (this *Aggregator) SetLogger(l Logger) *Aggregator {
+
+	this.logger = l
+
+	return this
+}
+
+// SetResultHandler sets the function receiving the result of every digest
+// sent, it may be called concurrently
+func (this *Aggregator) SetResultHandler(fn func(result DigestResult)) *Aggregator {
+
+	this.resultHandler = fn
+
+	return this
+}
+
+// getLogger returns the aggregator logger or a no-op one
+func (this *Aggregator) getLogger() Logger {
+	if this.logger == nil {
+		return nopLogger{}
+	}
+	return this.logger
+}
+
+// Add buffers msg (with its targets) for recipient and category, the first
+// message of a recipient and category opens the window
+func (this *Aggregator) Add(recipient string, category string, msg *FcmMsg) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.closed {
+		return ErrAggregatorClosed
+	}
+
+	key := recipient + "\x00" + category
+	group, ok := this.groups[key]
+	if !ok {
+		group = &digestGroup{recipient: recipient, category: category}
+		group.timer = time.AfterFunc(this.window, func() {
+			this.flushGroup(context.Background(), key, group)
+		})
+		this.groups[key] = group
+	}
+
+	copied := *msg
+	group.msgs = append(group.msgs, &copied)
+
+	return nil
+}
+
+// Pending returns the number of digests waiting for their window to close
+func (this *Aggregator) Pending() int {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return len(this.groups)
+}
+
+// Flush sends the pending digests now, without waiting for their windows,
+// and waits for the digests being sent
+func (this *Aggregator) Flush(ctx context.Context) {
+	this.mu.Lock()
+	groups := make(map[string]*digestGroup, len(this.groups))
+	for key, group := range this.groups {
+		groups[key] = group
+	}
+	this.mu.Unlock()
+
+	// a group whose timer already fired is sent once, by either call
+	for key, group := range groups {
+		group.timer.Stop()
+		this.flushGroup(ctx, key, group)
+	}
+
+	this.mu.Lock()
+	for this.inflight > 0 {
+		this.idle.Wait()
+	}
+	this.mu.Unlock()
+}
+
+// Close stops accepting messages, sends the pending digests and waits for
+// the digests being sent
+func (this *Aggregator) Close(ctx context.Context) error {
+	this.mu.Lock()
+	this.closed = true
+	this.mu.Unlock()
+
+	this.Flush(ctx)
+
+	return ctx.Err()
+}
+
+// flushGroup sends the digest of group, unless it was already sent
+func (this *Aggregator) flushGroup(ctx context.Context, key string, group *digestGroup) {
+	this.mu.Lock()
+	if this.groups[key] != group {
+		this.mu.Unlock()
+		return
+	}
+	delete(this.groups, key)
+	this.inflight++
+	this.mu.Unlock()
+
+	defer func() {
+		this.mu.Lock()
+		this.inflight--
+		if this.inflight == 0 {
+			this.idle.Broadcast()
+		}
+		this.mu.Unlock()
+	}()
+
+	result := DigestResult{Recipient: group.recipient, Category: group.category, Count: len(group.msgs)}
+	result.Status, result.Err = this.sender.SendMsg(ctx, this.digest(group))
+
+	if result.Err != nil {
+		this.getLogger().Error("fcm: sending digest",
+			"recipient", group.recipient, "category", group.category, "count", result.Count, "error", result.Err)
+	}
+	if this.resultHandler != nil {
+		this.resultHandler(result)
+	}
+}
+
+// digest merges the messages of group, the targets of the last message are
+// used if the reducer sets none
+func (this *Aggregator) digest(group *digestGroup) *FcmMsg {
+
+	merged := this.reducer(group.recipient, group.category, group.msgs)
+	if merged == nil {
+		merged = group.msgs[len(group.msgs)-1]
+	}
+
+	msg := *merged
+	last := group.msgs[len(group.msgs)-1]
+	if msg.To == "" && len(msg.RegistrationIds) == 0 && msg.Condition == "" {
+		msg.To, msg.RegistrationIds, msg.Condition = last.To, last.RegistrationIds, last.Condition
+	}
+
+	key := digest_key_prefix + group.category
+	if msg.CollapseKey == "" {
+		msg.CollapseKey = key
+	}
+	if msg.Notification.Tag == "" {
+		msg.Notification.Tag = key
+	}
+
+	return &msg
+}
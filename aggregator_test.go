@@ -0,0 +1,123 @@
+package fcm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingSender records the messages sent, safe for concurrent use
+type recordingSender struct {
+	sync.Mutex
+	msgs []*FcmMsg
+}
+
+func (s *recordingSender) SendMsg(ctx context.Context, msg *FcmMsg) (*FcmResponseStatus, error) {
+	s.Lock()
+	defer s.Unlock()
+	s.msgs = append(s.msgs, msg)
+	return &FcmResponseStatus{Ok: true, StatusCode: 200, Success: 1}, nil
+}
+
+func (s *recordingSender) sent() []*FcmMsg {
+	s.Lock()
+	defer s.Unlock()
+	return append([]*FcmMsg(nil), s.msgs...)
+}
+
+// likesReducer merges likes into "<first> and <n> others liked your post"
+func likesReducer(recipient string, category string, msgs []*FcmMsg) *FcmMsg {
+	first := msgs[0].Data.(map[string]string)["from"]
+	body := first + " liked your post"
+	if len(msgs) > 1 {
+		body = fmt.Sprintf("%s and %d others liked your post", first, len(msgs)-1)
+	}
+	return &FcmMsg{Notification: NotificationPayload{Title: "Likes", Body: body}}
+}
+
+func TestAggregatorWindow(t *testing.T) {
+	sender := &recordingSender{}
+	results := make(chan DigestResult, 2)
+	agg := NewAggregator(sender, 50*time.Millisecond, likesReducer).
+		SetResultHandler(func(result DigestResult) { results <- result })
+
+	for _, from := range []string{"Alice", "Bob", "Carol", "Dan", "Eve"} {
+		agg.Add("user-1", "likes", &FcmMsg{To: "token-1", Data: map[string]string{"from": from}})
+	}
+	agg.Add("user-2", "likes", &FcmMsg{To: "token-2", Data: map[string]string{"from": "Alice"}})
+
+	if len(sender.sent()) != 0 || agg.Pending() != 2 {
+		t.Fatalf("sent before the window closed => %d pending %d", len(sender.sent()), agg.Pending())
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case result := <-results:
+			if result.Err != nil || (result.Recipient == "user-1" && result.Count != 5) {
+				t.Fatalf("result => %+v", result)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("window never closed")
+		}
+	}
+
+	byTarget := make(map[string]*FcmMsg)
+	for _, msg := range sender.sent() {
+		byTarget[msg.To] = msg
+	}
+	msg := byTarget["token-1"]
+	if msg == nil || msg.Notification.Body != "Alice and 4 others liked your post" ||
+		msg.CollapseKey != "digest-likes" || msg.Notification.Tag != "digest-likes" {
+		t.Fatalf("digest => %+v", msg)
+	}
+	if msg := byTarget["token-2"]; msg == nil || msg.Notification.Body != "Alice liked your post" {
+		t.Fatalf("single digest => %+v", msg)
+	}
+}
+
+func TestAggregatorCloseFlushes(t *testing.T) {
+	sender := &recordingSender{}
+	agg := NewAggregator(sender, time.Hour, likesReducer)
+
+	agg.Add("user-1", "likes", &FcmMsg{To: "token-1", Data: map[string]string{"from": "Alice"}})
+	agg.Add("user-1", "comments", &FcmMsg{To: "token-1", Data: map[string]string{"from": "Bob"}})
+
+	if err := agg.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(sender.sent()) != 2 || agg.Pending() != 0 {
+		t.Fatalf("sent on close => %d", len(sender.sent()))
+	}
+	if err := agg.Add("user-1", "likes", &FcmMsg{To: "token-1"}); !errors.Is(err, ErrAggregatorClosed) {
+		t.Fatalf("Add after close => %v", err)
+	}
+}
+
+func TestAggregatorFlushWhileAdding(t *testing.T) {
+	sender := &recordingSender{}
+	agg := NewAggregator(sender, time.Millisecond, likesReducer)
+
+	// windows expire on timer goroutines while Flush is waiting
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			agg.Add(fmt.Sprintf("user-%d", i), "likes", &FcmMsg{To: "token", Data: map[string]string{"from": "Alice"}})
+			time.Sleep(50 * time.Microsecond)
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		agg.Flush(context.Background())
+	}
+	<-done
+
+	if err := agg.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(sender.sent()); n != 200 {
+		t.Fatalf("sent => %d, want 200", n)
+	}
+}
@@ -0,0 +1,367 @@
+package fcm
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// apns hosts
+	apns_production_host = "https://api.push.apple.com"
+	apns_sandbox_host    = "https://api.sandbox.push.apple.com"
+
+	// apns request headers
+	apns_topic_header      = "apns-topic"
+	apns_push_type_header  = "apns-push-type"
+	apns_expiration_header = "apns-expiration"
+	apns_id_header         = "apns-id"
+
+	// apns push types
+	apns_push_alert      = "alert"
+	apns_push_background = "background"
+
+	// apns_token_lifetime how long a provider token is used, apple refuses
+	// tokens older than one hour and refreshed more than every 20 minutes
+	apns_token_lifetime = 50 * time.Minute
+
+	// apns_reason_key the apns reason of a failed result
+	apns_reason_key = "apns_reason"
+
+	// apns reasons of an invalid device token
+	apns_unregistered     = "Unregistered"
+	apns_bad_device_token = "BadDeviceToken"
+
+	// apns reasons of a rejected provider token
+	apns_expired_provider = "ExpiredProviderToken"
+	apns_invalid_provider = "InvalidProviderToken"
+
+	// fcm errors the apns results are reported with
+	fcm_not_registered = "NotRegistered"
+	fcm_unavailable    = "Unavailable"
+
+	// default_apns_timeout timeout of an apns request
+	default_apns_timeout = 30 * time.Second
+
+	// apns_max_payload_bytes max size of an apns payload
+	apns_max_payload_bytes = 4096
+)
+
+// ApnsSender sends the messages straight to apns over http/2, with a
+// token based (.p8 key) authentication. The notification, data and
+// options of the message are mapped as by ConvertToV1, topics and
+// conditions are not supported
+type ApnsSender struct {
+	keyId  string
+	teamId string
+	topic  string
+	key    *ecdsa.PrivateKey
+
+	host        string
+	httpClient  *http.Client
+	logger      Logger
+	concurrency int
+
+	mu     sync.Mutex
+	token  string
+	issued time.Time
+}
+
+// apnsError the body of a failed apns request
+type apnsError struct {
+	Reason string `json:"reason"`
+}
+
+// NewApnsSender init a sender with the .p8 key of keyFile, its key id,
+// the team id of the developer account and the topic (bundle id) of the app
+func NewApnsSender(keyFile string, keyId string, teamId string, topic string) (*ApnsSender, error) {
+
+	b, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("fcm: invalid apns key file")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("fcm: parsing apns key: %w", err)
+	}
+	key, ok := parsed.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("fcm: apns key is not an ecdsa key")
+	}
+
+	return &ApnsSender{
+		keyId:      keyId,
+		teamId:     teamId,
+		topic:      topic,
+		key:        key,
+		host:       apns_production_host,
+		httpClient: &http.Client{Timeout: default_apns_timeout},
+	}, nil
+}
+
+// SetSandbox sends to the apns development environment
+func (this *ApnsSender) SetSandbox(sandbox bool) *ApnsSender {
+
+	this.host = apns_production_host
+	if sandbox {
+		this.host = apns_sandbox_host
+	}
+
+	return this
+}
+
+// SetHost sets the apns host, e.g. https://api.push.apple.com:2197
+func (this *ApnsSender) SetHost(host string) *ApnsSender {
+
+	this.host = host
+
+	return this
+}
+
+// SetHttpClient sets the http client, its transport must support http/2
+func (this *ApnsSender) SetHttpClient(c *http.Client) *ApnsSender {
+
+	this.httpClient = c
+
+	return this
+}
+
+// SetLogger sets the logger of the sender, nil disables logging
+func (this *ApnsSender) SetLogger(l Logger) *ApnsSender {
+
+	this.logger = l
+
+	return this
+}
+
+// SetConcurrency sets the max number of devices sent at the same time
+func (this *ApnsSender) SetConcurrency(n int) *ApnsSender {
+
+	this.concurrency = n
+
+	return this
+}
+
+// getLogger returns the sender logger or a no-op one
+func (this *ApnsSender) getLogger() Logger {
+	if this.logger == nil {
+		return nopLogger{}
+	}
+	return this.logger
+}
+
+// SendMsg sends msg to every device token, one apns request per token.
+// The results are aligned with the tokens: the apns-id as message_id, or
+// the error with the apns reason, Unregistered and BadDeviceToken being
+// reported as NotRegistered
+func (this *ApnsSender) SendMsg(ctx context.Context, msg *FcmMsg) (*FcmResponseStatus, error) {
+
+	if msg.DryRun {
+		return new(FcmResponseStatus), errors.New("fcm: dry_run is not supported by apns")
+	}
+
+	conv, err := ConvertToV1(msg)
+	if err != nil {
+		return new(FcmResponseStatus), err
+	}
+	if conv.Messages[0].Token == "" {
+		return new(FcmResponseStatus), errors.New("fcm: apns sender only supports device tokens")
+	}
+
+	headers, payload, err := this.request(msg, conv.Messages[0])
+	if err != nil {
+		return new(FcmResponseStatus), err
+	}
+
+	status := &FcmResponseStatus{Ok: true, StatusCode: http.StatusOK}
+	status.Results = make([]map[string]string, len(conv.Messages))
+
+	concurrency := this.concurrency
+	if concurrency <= 0 {
+		concurrency = default_batch_concurrency
+	}
+	runConcurrently(len(conv.Messages), concurrency, func(i int) {
+		status.Results[i] = this.sendDevice(ctx, conv.Messages[i].Token, headers, payload)
+	})
+
+	for _, val := range status.Results {
+		if val[error_key] == "" {
+			status.Success++
+		} else {
+			status.Fail++
+		}
+	}
+
+	return status, ctx.Err()
+}
+
+// request builds the headers and payload sent to every device of msg
+func (this *ApnsSender) request(msg *FcmMsg, m *V1Message) (http.Header, []byte, error) {
+
+	headers := make(http.Header)
+	headers.Set(apns_topic_header, this.topic)
+
+	aps := new(Aps)
+	if m.Apns != nil {
+		for k, v := range m.Apns.Headers {
+			headers.Set(k, v)
+		}
+		if m.Apns.Payload != nil {
+			aps = m.Apns.Payload.Aps
+		}
+	}
+	if aps.Alert == nil && m.Notification != nil {
+		aps.Alert = &ApsAlert{Title: m.Notification.Title, Body: m.Notification.Body}
+	}
+
+	if aps.Alert != nil || aps.Badge != nil || aps.Sound != "" {
+		headers.Set(apns_push_type_header, apns_push_alert)
+	} else {
+		// background pushes must have a low priority
+		headers.Set(apns_push_type_header, apns_push_background)
+		headers.Set(apns_priority_header, apns_priority_normal)
+	}
+
+	if msg.TimeToLive > 0 {
+		expiration := time.Now().Add(time.Duration(msg.TimeToLive) * time.Second).Unix()
+		headers.Set(apns_expiration_header, strconv.FormatInt(expiration, 10))
+	}
+
+	body := make(map[string]interface{}, len(m.Data)+1)
+	for k, v := range m.Data {
+		body[k] = v
+	}
+	body["aps"] = aps
+
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("fcm: encoding apns payload: %w", err)
+	}
+	if len(payload) > apns_max_payload_bytes {
+		return nil, nil, fmt.Errorf("fcm: apns payload of %d bytes, max %d", len(payload), apns_max_payload_bytes)
+	}
+
+	return headers, payload, nil
+}
+
+// sendDevice sends the payload to a device, a rejected provider token is
+// renewed and the request sent once more
+func (this *ApnsSender) sendDevice(ctx context.Context, device string, headers http.Header, payload []byte) map[string]string {
+
+	token, err := this.providerToken("")
+	if err != nil {
+		return map[string]string{error_key: err.Error()}
+	}
+
+	result, reason := this.post(ctx, device, headers, payload, token)
+	if reason == apns_expired_provider || reason == apns_invalid_provider {
+		this.getLogger().Warn("fcm: retrying with a new apns provider token", "reason", reason)
+		if token, err = this.providerToken(token); err != nil {
+			return map[string]string{error_key: err.Error()}
+		}
+		result, _ = this.post(ctx, device, headers, payload, token)
+	}
+
+	if result[error_key] != "" {
+		this.getLogger().Info("fcm: apns device failed",
+			"token", redactToken(device), "error", result[error_key])
+	}
+
+	return result
+}
+
+// post sends a single apns request and returns its result and reason
+func (this *ApnsSender) post(ctx context.Context, device string, headers http.Header, payload []byte, token string) (map[string]string, string) {
+
+	request, err := http.NewRequestWithContext(ctx, "POST", this.host+"/3/device/"+device, bytes.NewReader(payload))
+	if err != nil {
+		return map[string]string{error_key: err.Error()}, ""
+	}
+	for k, v := range headers {
+		request.Header[k] = v
+	}
+	request.Header.Set("Authorization", "bearer "+token)
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := this.httpClient.Do(request)
+	if err != nil {
+		this.getLogger().Error("fcm: apns request failed", "error", redactUrlError(err))
+		return map[string]string{error_key: fcm_unavailable}, ""
+	}
+	defer response.Body.Close()
+
+	body, _ := ioutil.ReadAll(response.Body)
+
+	if response.StatusCode == http.StatusOK {
+		return map[string]string{message_id_key: response.Header.Get(apns_id_header)}, ""
+	}
+
+	apnsErr := new(apnsError)
+	json.Unmarshal(body, apnsErr)
+	if apnsErr.Reason == "" {
+		apnsErr.Reason = response.Status
+	}
+
+	code := apnsErr.Reason
+	switch {
+	case response.StatusCode == http.StatusGone, code == apns_unregistered, code == apns_bad_device_token:
+		code = fcm_not_registered
+	case response.StatusCode >= 500, response.StatusCode == http.StatusTooManyRequests:
+		code = fcm_unavailable
+	}
+
+	return map[string]string{error_key: code, apns_reason_key: apnsErr.Reason}, apnsErr.Reason
+}
+
+// providerToken returns the signed (ES256) provider token, a new one is
+// signed when it is too old or is the rejected one. Apple refuses tokens
+// renewed too often, the concurrent rejections renew it only once
+func (this *ApnsSender) providerToken(rejected string) (string, error) {
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	now := time.Now()
+	if this.token != "" && this.token != rejected && now.Sub(this.issued) < apns_token_lifetime {
+		return this.token, nil
+	}
+
+	header, _ := json.Marshal(map[string]string{"alg": "ES256", "kid": this.keyId})
+	claims, _ := json.Marshal(map[string]interface{}{"iss": this.teamId, "iat": now.Unix()})
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signed))
+
+	r, s, err := ecdsa.Sign(rand.Reader, this.key, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	// the jws signature is r and s, 32 bytes each
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+
+	this.token = signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+	this.issued = now
+
+	return this.token, nil
+}
@@ -0,0 +1,200 @@
+package fcm
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// apnsStub an http/2 apns server checking the provider token, devices
+// prefixed with "gone" are unregistered, "bad" are invalid, and the first
+// token signed is refused as expired if expireFirst is set
+type apnsStub struct {
+	sync.Mutex
+	key         *ecdsa.PublicKey
+	expireFirst bool
+	expired     string
+	requests    []*http.Request
+	payloads    []map[string]interface{}
+}
+
+func (s *apnsStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	payload := make(map[string]interface{})
+	json.NewDecoder(r.Body).Decode(&payload)
+
+	s.Lock()
+	defer s.Unlock()
+	s.requests = append(s.requests, r)
+	s.payloads = append(s.payloads, payload)
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "bearer ")
+	device := strings.TrimPrefix(r.URL.Path, "/3/device/")
+
+	switch {
+	case r.ProtoMajor != 2:
+		w.WriteHeader(http.StatusHTTPVersionNotSupported)
+	case !verifyES256(s.key, token):
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"reason":"InvalidProviderToken"}`))
+	case s.expireFirst && (s.expired == "" || s.expired == token):
+		s.expired = token
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"reason":"ExpiredProviderToken"}`))
+	case strings.HasPrefix(device, "gone"):
+		w.WriteHeader(http.StatusGone)
+		w.Write([]byte(`{"reason":"Unregistered","timestamp":1700000000000}`))
+	case strings.HasPrefix(device, "bad"):
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"reason":"BadDeviceToken"}`))
+	default:
+		w.Header().Set(apns_id_header, "id-"+device)
+	}
+}
+
+// verifyES256 checks the signature of a jwt
+func verifyES256(key *ecdsa.PublicKey, token string) bool {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return false
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(signature) != 64 {
+		return false
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+	return ecdsa.Verify(key, digest[:], r, s)
+}
+
+func newApnsStub(t *testing.T) (*apnsStub, *ApnsSender) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+	keyFile := filepath.Join(t.TempDir(), "AuthKey_KEY123.p8")
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+
+	stub := &apnsStub{key: &key.PublicKey}
+	ts := httptest.NewUnstartedServer(stub)
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+
+	sender, err := NewApnsSender(keyFile, "KEY123", "TEAM456", "com.example.app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender.SetHost(ts.URL).SetHttpClient(ts.Client())
+
+	return stub, sender
+}
+
+func TestApnsSender(t *testing.T) {
+	stub, sender := newApnsStub(t)
+
+	msg := &FcmMsg{
+		RegistrationIds: []string{"device1", "gone2", "bad3"},
+		Notification:    NotificationPayload{Title: "Hi", Body: "there", Badge: "3"},
+		Data:            map[string]string{"order": "42"},
+		Priority:        Priority_HIGH,
+		CollapseKey:     "orders",
+		TimeToLive:      60,
+	}
+
+	var s Sender = sender
+	status, err := s.SendMsg(context.Background(), msg)
+	if err != nil {
+		t.Fatalf("SendMsg => %v", err)
+	}
+	if !status.Ok || status.Success != 1 || status.Fail != 2 {
+		t.Fatalf("status => %+v", status)
+	}
+	if status.Results[0][message_id_key] != "id-device1" ||
+		status.Results[1][error_key] != fcm_not_registered || status.Results[1][apns_reason_key] != "Unregistered" ||
+		status.Results[2][error_key] != fcm_not_registered {
+		t.Fatalf("results => %v", status.Results)
+	}
+
+	r := stub.requests[0]
+	if r.Header.Get(apns_topic_header) != "com.example.app" || r.Header.Get(apns_push_type_header) != apns_push_alert ||
+		r.Header.Get(apns_priority_header) != apns_priority_high || r.Header.Get(apns_collapse_id_header) != "orders" ||
+		r.Header.Get(apns_expiration_header) == "" {
+		t.Fatalf("headers => %v", r.Header)
+	}
+
+	payload := stub.payloads[0]
+	aps, _ := payload["aps"].(map[string]interface{})
+	alert, _ := aps["alert"].(map[string]interface{})
+	if payload["order"] != "42" || alert["title"] != "Hi" || aps["badge"] != float64(3) {
+		t.Fatalf("payload => %v", payload)
+	}
+
+	// jwt header and claims
+	parts := strings.Split(strings.TrimPrefix(r.Header.Get("Authorization"), "bearer "), ".")
+	header, _ := base64.RawURLEncoding.DecodeString(parts[0])
+	claims, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	if !strings.Contains(string(header), `"kid":"KEY123"`) || !strings.Contains(string(claims), `"iss":"TEAM456"`) {
+		t.Fatalf("jwt => %s %s", header, claims)
+	}
+}
+
+func TestApnsSenderRenewsProviderToken(t *testing.T) {
+	stub, sender := newApnsStub(t)
+	stub.expireFirst = true
+
+	status, err := sender.SendMsg(context.Background(), &FcmMsg{To: "device1", ContentAvailable: true})
+	if err != nil || status.Success != 1 {
+		t.Fatalf("SendMsg => %+v %v", status, err)
+	}
+	if len(stub.requests) != 2 {
+		t.Fatalf("requests => %d", len(stub.requests))
+	}
+	r := stub.requests[1]
+	if r.Header.Get(apns_push_type_header) != apns_push_background || r.Header.Get(apns_priority_header) != apns_priority_normal {
+		t.Fatalf("background headers => %v", r.Header)
+	}
+}
+
+func TestApnsSenderRejectsTopics(t *testing.T) {
+	_, sender := newApnsStub(t)
+
+	if _, err := sender.SendMsg(context.Background(), &FcmMsg{To: "/topics/news"}); err == nil {
+		t.Fatal("topic accepted")
+	}
+	if _, err := sender.SendMsg(context.Background(), &FcmMsg{To: "device1", DryRun: true}); err == nil {
+		t.Fatal("dry run accepted")
+	}
+}
+
+func TestFcmClientSender(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(regIdHandle))
+	chgUrl(ts)
+	defer ts.Close()
+
+	c := NewFcmClient("key")
+	c.NewFcmMsgTo("unchanged", nil)
+
+	var s Sender = c
+	status, err := s.SendMsg(context.Background(), &FcmMsg{RegistrationIds: []string{"a", "b", "c"}})
+	if err != nil || status.Success != 2 || status.Fail != 1 {
+		t.Fatalf("SendMsg => %+v %v", status, err)
+	}
+	if c.Message.To != "unchanged" {
+		t.Fatalf("client message changed => %+v", c.Message)
+	}
+}
@@ -0,0 +1,488 @@
+package fcm
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// max_apns_import_tokens max number of apns tokens per batchImport request
+	max_apns_import_tokens = 100
+
+	// apns_invalid_line error of an input line that can't be parsed
+	apns_invalid_line = "INVALID_LINE"
+)
+
+// ApnsImportResult the outcome of a single apns token
+type ApnsImportResult struct {
+	App               string
+	Sandbox           bool
+	ApnsToken         string
+	RegistrationToken string
+	// Error the import error, empty if RegistrationToken was created
+	Error string
+}
+
+// ApnsImportSummary the counts of an import
+type ApnsImportSummary struct {
+	// Skipped tokens before the checkpoint
+	Skipped  int
+	Imported int
+	Failed   int
+}
+
+// Checkpoint persists how far an import went, Load returns 0 if nothing
+// was saved, see FileCheckpoint
+type Checkpoint interface {
+	Load() (int, error)
+	Save(offset int) error
+}
+
+// FileCheckpoint a Checkpoint saved in a file
+type FileCheckpoint string
+
+// Load reads the offset of the file, 0 if the file does not exist
+func (this FileCheckpoint) Load() (int, error) {
+	b, err := ioutil.ReadFile(string(this))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(b)))
+}
+
+// Save writes the offset to a temporary file renamed over the checkpoint
+func (this FileCheckpoint) Save(offset int) error {
+	tmp := string(this) + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strconv.Itoa(offset)+"\n"), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, string(this))
+}
+
+// ApnsImporter creates the registration tokens of a stream of apns tokens,
+// one token per line:
+//
+//	application token [sandbox]
+//
+// or just the token if a default application is set. The tokens are
+// grouped by application and sandbox flag, imported in chunks of 100 with
+// the batch concurrency of the client, the INTERNAL errors are retried
+type ApnsImporter struct {
+	client     *FcmClient
+	app        string
+	sandbox    bool
+	store      TokenStore
+	checkpoint Checkpoint
+	onResults  func(results []ApnsImportResult)
+}
+
+// apnsChunk the tokens of an application imported in a single request,
+// indexes are the input positions of the tokens
+type apnsChunk struct {
+	app     string
+	sandbox bool
+	tokens  []string
+	indexes []int
+}
+
+// importTracker computes the checkpoint: every token before it is done
+type importTracker struct {
+	mu         sync.Mutex
+	checkpoint Checkpoint
+	pending    map[*apnsChunk]int
+	next       int
+	saved      int
+}
+
+// NewApnsImporter init an importer sending with client
+func NewApnsImporter(client *FcmClient) *ApnsImporter {
+	return &ApnsImporter{client: client}
+}
+
+// SetDefaultApp sets the application of the lines with only a token
+func (this *ApnsImporter) SetDefaultApp(app string, sandbox bool) *ApnsImporter {
+
+	this.app = app
+	this.sandbox = sandbox
+
+	return this
+}
+
+// SetTokenStore sets the store the created registration tokens are put in
+func (this *ApnsImporter) SetTokenStore(store TokenStore) *ApnsImporter {
+
+	this.store = store
+
+	return this
+}
+
+// SetCheckpoint sets the checkpoint an import resumes from, it is saved
+// after every chunk
+func (this *ApnsImporter) SetCheckpoint(checkpoint Checkpoint) *ApnsImporter {
+
+	this.checkpoint = checkpoint
+
+	return this
+}
+
+// SetResultHandler sets the function receiving the results of every
+// chunk, it is called concurrently
+func (this *ApnsImporter) SetResultHandler(fn func(results []ApnsImportResult)) *ApnsImporter {
+
+	this.onResults = fn
+
+	return this
+}
+
+// Import reads the apns tokens of r and imports them, skipping the tokens
+// before the checkpoint. It stops at the first token store or checkpoint
+// error, or when ctx is done
+func (this *ApnsImporter) Import(ctx context.Context, r io.Reader) (*ApnsImportSummary, error) {
+
+	start := 0
+	if this.checkpoint != nil {
+		var err error
+		if start, err = this.checkpoint.Load(); err != nil {
+			return nil, fmt.Errorf("fcm: loading checkpoint: %w", err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	summary := &ApnsImportSummary{Skipped: start}
+	tracker := &importTracker{checkpoint: this.checkpoint, pending: make(map[*apnsChunk]int), next: start, saved: start}
+
+	var mu sync.Mutex
+	var importErr error
+	fail := func(err error) {
+		mu.Lock()
+		if importErr == nil {
+			importErr = err
+		}
+		mu.Unlock()
+		cancel()
+	}
+
+	chunks := make(chan *apnsChunk)
+	var wg sync.WaitGroup
+	for i := 0; i < this.client.getBatchConcurrency(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for chunk := range chunks {
+				results, err := this.importChunk(ctx, chunk)
+				if err == nil {
+					err = this.emit(results, summary, &mu)
+				}
+				if err == nil {
+					err = tracker.done(chunk)
+				}
+				if err != nil {
+					fail(err)
+				}
+			}
+		}()
+	}
+
+	readErr := this.dispatch(ctx, r, start, tracker, chunks, summary, &mu)
+	close(chunks)
+	wg.Wait()
+
+	if importErr == nil && readErr != nil {
+		importErr = readErr
+	}
+	if importErr == nil {
+		importErr = tracker.finish()
+	}
+
+	return summary, importErr
+}
+
+// dispatch reads the input, groups the tokens and sends the full chunks
+// to the workers, the partial chunks are sent at the end of the input
+func (this *ApnsImporter) dispatch(ctx context.Context, r io.Reader, start int, tracker *importTracker,
+	chunks chan<- *apnsChunk, summary *ApnsImportSummary, mu *sync.Mutex) error {
+
+	groups := make(map[string]*apnsChunk)
+
+	send := func(chunk *apnsChunk) error {
+		select {
+		case chunks <- chunk:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	scanner := bufio.NewScanner(r)
+	index := 0
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := index
+		index++
+		if i < start {
+			continue
+		}
+
+		app, sandbox, token, ok := this.parseLine(line)
+		if !ok {
+			if err := this.emit([]ApnsImportResult{{ApnsToken: line, Error: apns_invalid_line}}, summary, mu); err != nil {
+				return err
+			}
+			tracker.read(i)
+			continue
+		}
+
+		key := app + "\x00" + strconv.FormatBool(sandbox)
+		chunk, ok := groups[key]
+		if !ok {
+			chunk = &apnsChunk{app: app, sandbox: sandbox}
+			groups[key] = chunk
+			tracker.open(chunk, i)
+		}
+		chunk.tokens = append(chunk.tokens, token)
+		chunk.indexes = append(chunk.indexes, i)
+		tracker.read(i)
+
+		if len(chunk.tokens) == max_apns_import_tokens {
+			delete(groups, key)
+			if err := send(chunk); err != nil {
+				return err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("fcm: reading apns tokens: %w", err)
+	}
+
+	keys := make([]string, 0, len(groups))
+	for key := range groups {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := send(groups[key]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// parseLine returns the application, sandbox flag and token of a line
+func (this *ApnsImporter) parseLine(line string) (string, bool, string, bool) {
+	fields := strings.Fields(line)
+
+	switch {
+	case len(fields) == 1 && this.app != "":
+		return this.app, this.sandbox, fields[0], true
+	case len(fields) == 2:
+		return fields[0], false, fields[1], true
+	case len(fields) == 3 && fields[2] == "sandbox":
+		return fields[0], true, fields[1], true
+	}
+	return "", false, "", false
+}
+
+// importChunk imports a chunk, the tokens with an INTERNAL error and the
+// failed requests (no response, 429, 5xx, INTERNAL) are retried with a
+// backoff, the other failed requests are not
+func (this *ApnsImporter) importChunk(ctx context.Context, chunk *apnsChunk) ([]ApnsImportResult, error) {
+
+	results := make([]ApnsImportResult, len(chunk.tokens))
+	for i, token := range chunk.tokens {
+		results[i] = ApnsImportResult{App: chunk.app, Sandbox: chunk.sandbox, ApnsToken: token}
+	}
+
+	remaining := make([]int, len(chunk.tokens))
+	for i := range remaining {
+		remaining[i] = i
+	}
+
+	backoff := batchRetryBackoff
+
+	for attempt := 0; ; attempt++ {
+
+		req := &ApnsBatchRequest{App: chunk.app, Sandbox: chunk.sandbox}
+		for _, i := range remaining {
+			req.ApnsTokens = append(req.ApnsTokens, chunk.tokens[i])
+		}
+
+		resp, err := this.client.apnsBatchImport(ctx, req)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		var retry []int
+		iidErr := new(IidError)
+		switch {
+		case errors.As(err, &iidErr):
+			setApnsErrors(results, remaining, apnsIidErrorCode(iidErr))
+			if iidErr.StatusCode == 429 || iidErr.StatusCode >= 500 || iidErr.Code == batch_internal_error {
+				retry = remaining
+			}
+		case err != nil:
+			// no response
+			retry = remaining
+			setApnsErrors(results, remaining, fcm_unavailable)
+		default:
+			byToken := make(map[string]map[string]string, len(resp.Results))
+			for _, val := range resp.Results {
+				byToken[val[apns_token_key]] = val
+			}
+			for _, i := range remaining {
+				val, ok := byToken[chunk.tokens[i]]
+				switch {
+				case !ok:
+					results[i].Error = batch_internal_error
+					retry = append(retry, i)
+				case val[status_key] == apns_import_ok:
+					results[i].RegistrationToken = val[reg_token_key]
+					results[i].Error = ""
+				default:
+					results[i].Error = val[status_key]
+					if val[status_key] == batch_internal_error {
+						retry = append(retry, i)
+					}
+				}
+			}
+		}
+
+		if len(retry) == 0 || attempt >= batch_max_retries {
+			return results, nil
+		}
+
+		this.client.getLogger().Warn("fcm: retrying apns import tokens",
+			"app", chunk.app, "attempt", attempt+1, "tokens", len(retry), "backoff", backoff)
+		this.client.getMetrics().ObserveRetry(endpoint_batch_import)
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		remaining = retry
+	}
+}
+
+// emit puts the imported tokens in the store, counts and hands the results
+func (this *ApnsImporter) emit(results []ApnsImportResult, summary *ApnsImportSummary, mu *sync.Mutex) error {
+
+	var records []TokenRecord
+	failed := 0
+	for _, result := range results {
+		if result.Error != "" {
+			failed++
+			continue
+		}
+		records = append(records, TokenRecord{
+			Token:    result.RegistrationToken,
+			Platform: platform_apns,
+			App:      result.App,
+			Sandbox:  result.Sandbox,
+			Source:   result.ApnsToken,
+		})
+	}
+
+	if this.store != nil && len(records) > 0 {
+		if err := this.store.Put(records); err != nil {
+			return fmt.Errorf("fcm: saving tokens: %w", err)
+		}
+	}
+
+	mu.Lock()
+	summary.Imported += len(results) - failed
+	summary.Failed += failed
+	mu.Unlock()
+
+	if this.onResults != nil {
+		this.onResults(results)
+	}
+
+	return nil
+}
+
+// setApnsErrors sets the error of the results at indexes
+func setApnsErrors(results []ApnsImportResult, indexes []int, e string) {
+	for _, i := range indexes {
+		results[i].Error = e
+	}
+}
+
+// apnsIidErrorCode the error code of a failed apns import request, its
+// status if the response has no error code
+func apnsIidErrorCode(iidErr *IidError) string {
+	if iidErr.Code != "" {
+		return iidErr.Code
+	}
+	return iidErr.Status
+}
+
+// open registers a chunk starting at input index first
+func (this *importTracker) open(chunk *apnsChunk, first int) {
+	this.mu.Lock()
+	this.pending[chunk] = first
+	this.mu.Unlock()
+}
+
+// read records that the input was read up to index
+func (this *importTracker) read(index int) {
+	this.mu.Lock()
+	this.next = index + 1
+	this.mu.Unlock()
+}
+
+// done records a finished chunk and saves the checkpoint if it moved
+func (this *importTracker) done(chunk *apnsChunk) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	delete(this.pending, chunk)
+	return this.saveLocked()
+}
+
+// finish saves the final checkpoint
+func (this *importTracker) finish() error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return this.saveLocked()
+}
+
+// saveLocked saves the first index not done yet, the lock must be held
+func (this *importTracker) saveLocked() error {
+	offset := this.next
+	for _, first := range this.pending {
+		if first < offset {
+			offset = first
+		}
+	}
+
+	if this.checkpoint == nil || offset <= this.saved {
+		return nil
+	}
+	if err := this.checkpoint.Save(offset); err != nil {
+		return fmt.Errorf("fcm: saving checkpoint: %w", err)
+	}
+	this.saved = offset
+
+	return nil
+}
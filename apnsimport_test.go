@@ -0,0 +1,231 @@
+package fcm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// apnsImportHandle creates "reg-<token>" registration tokens, replies
+// INVALID_ARGUMENT for the tokens prefixed with "bad", INTERNAL for the
+// first request of the tokens prefixed with "flaky", and fails the
+// requests containing a token prefixed with "down" (503) or "denied" (403)
+type apnsImportHandle struct {
+	sync.Mutex
+	seen     map[string]bool
+	requests []ApnsBatchRequest
+}
+
+func (h *apnsImportHandle) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	req := ApnsBatchRequest{}
+	json.NewDecoder(r.Body).Decode(&req)
+
+	h.Lock()
+	defer h.Unlock()
+	h.requests = append(h.requests, req)
+
+	results := make([]map[string]string, len(req.ApnsTokens))
+	for i, token := range req.ApnsTokens {
+		results[i] = map[string]string{apns_token_key: token, status_key: apns_import_ok}
+		switch {
+		case strings.HasPrefix(token, "down"):
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		case strings.HasPrefix(token, "denied"):
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"error":"PERMISSION_DENIED"}`)
+			return
+		case strings.HasPrefix(token, "bad"):
+			results[i][status_key] = "INVALID_ARGUMENT"
+		case strings.HasPrefix(token, "flaky") && !h.seen[token]:
+			h.seen[token] = true
+			results[i][status_key] = batch_internal_error
+		default:
+			results[i][reg_token_key] = "reg-" + token
+		}
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"results": results})
+}
+
+func newApnsImportServer(t *testing.T) *apnsImportHandle {
+	batchRetryBackoff = 0
+
+	h := &apnsImportHandle{seen: make(map[string]bool)}
+	srv := httptest.NewServer(h)
+	chgIidUrl(srv)
+	t.Cleanup(func() {
+		resetIidUrl()
+		srv.Close()
+	})
+	return h
+}
+
+func TestApnsImportChunksByApp(t *testing.T) {
+	h := newApnsImportServer(t)
+
+	var input strings.Builder
+	input.WriteString("# app token [sandbox]\n\n")
+	for i := 0; i < 250; i++ {
+		fmt.Fprintf(&input, "com.a token%d\n", i)
+	}
+	fmt.Fprintf(&input, "com.a sandboxed sandbox\n")
+	fmt.Fprintf(&input, "com.b bad1\n")
+	fmt.Fprintf(&input, "com.b flaky1\n")
+	fmt.Fprintf(&input, "not a valid line\n")
+
+	store := NewMemoryTokenStore()
+	var mu sync.Mutex
+	var results []ApnsImportResult
+
+	c := NewFcmClient("key").SetBatchConcurrency(3)
+	summary, err := NewApnsImporter(c).
+		SetTokenStore(store).
+		SetResultHandler(func(r []ApnsImportResult) {
+			mu.Lock()
+			results = append(results, r...)
+			mu.Unlock()
+		}).
+		Import(context.Background(), strings.NewReader(input.String()))
+
+	if err != nil {
+		t.Fatalf("Import => %v", err)
+	}
+	if summary.Imported != 252 || summary.Failed != 2 || summary.Skipped != 0 {
+		t.Fatalf("summary => %+v", summary)
+	}
+	if len(results) != 254 {
+		t.Fatalf("results => %d", len(results))
+	}
+
+	// 3 chunks for com.a, 1 for sandbox, 1 for com.b and the retry of flaky1
+	if len(h.requests) != 6 {
+		t.Fatalf("requests => %d", len(h.requests))
+	}
+	for _, req := range h.requests {
+		if len(req.ApnsTokens) > max_apns_import_tokens {
+			t.Fatalf("chunk of %d tokens", len(req.ApnsTokens))
+		}
+		if req.Sandbox != (req.ApnsTokens[0] == "sandboxed") {
+			t.Fatalf("sandbox of %v => %v", req.ApnsTokens, req.Sandbox)
+		}
+	}
+
+	record, ok := store.Get("reg-flaky1")
+	if !ok || record.App != "com.b" || record.Source != "flaky1" || record.Platform != platform_apns {
+		t.Fatalf("flaky1 record => %+v %v", record, ok)
+	}
+	if record, _ := store.Get("reg-sandboxed"); !record.Sandbox {
+		t.Fatalf("sandboxed record => %+v", record)
+	}
+	if _, ok := store.Get("reg-bad1"); ok {
+		t.Fatal("failed token saved")
+	}
+}
+
+func TestApnsImportDefaultApp(t *testing.T) {
+	h := newApnsImportServer(t)
+
+	summary, err := NewApnsImporter(NewFcmClient("key")).
+		SetDefaultApp("com.a", true).
+		Import(context.Background(), strings.NewReader("t1\nt2\ncom.b t3\n"))
+
+	if err != nil || summary.Imported != 3 {
+		t.Fatalf("Import => %+v %v", summary, err)
+	}
+	if len(h.requests) != 2 {
+		t.Fatalf("requests => %+v", h.requests)
+	}
+}
+
+func TestApnsImportResume(t *testing.T) {
+	h := newApnsImportServer(t)
+	checkpoint := FileCheckpoint(filepath.Join(t.TempDir(), "checkpoint"))
+
+	// the request of the second chunk fails, the checkpoint stays after
+	// the first chunk
+	var input strings.Builder
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(&input, "com.a token%d\n", i)
+	}
+	fmt.Fprintf(&input, "com.a down1\n")
+
+	c := NewFcmClient("key").SetBatchConcurrency(1)
+	summary, err := NewApnsImporter(c).SetCheckpoint(checkpoint).
+		Import(context.Background(), strings.NewReader(input.String()))
+	if err != nil || summary.Imported != 100 || summary.Failed != 1 {
+		t.Fatalf("Import => %+v %v", summary, err)
+	}
+	if offset, _ := checkpoint.Load(); offset != 101 {
+		t.Fatalf("checkpoint => %d", offset)
+	}
+
+	// resume after appending tokens
+	h.requests = nil
+	fmt.Fprintf(&input, "com.a token100\n")
+
+	summary, err = NewApnsImporter(c).SetCheckpoint(checkpoint).
+		Import(context.Background(), strings.NewReader(input.String()))
+	if err != nil || summary.Skipped != 101 || summary.Imported != 1 {
+		t.Fatalf("resume => %+v %v", summary, err)
+	}
+	if len(h.requests) != 1 || h.requests[0].ApnsTokens[0] != "token100" {
+		t.Fatalf("resume requests => %+v", h.requests)
+	}
+	if offset, _ := checkpoint.Load(); offset != 102 {
+		t.Fatalf("checkpoint => %d", offset)
+	}
+}
+
+func TestApnsImportFailedRequests(t *testing.T) {
+	h := newApnsImportServer(t)
+
+	var results []ApnsImportResult
+	c := NewFcmClient("key").SetBatchConcurrency(1)
+	summary, err := NewApnsImporter(c).
+		SetResultHandler(func(r []ApnsImportResult) { results = append(results, r...) }).
+		Import(context.Background(), strings.NewReader("com.a down1\ncom.b denied1\n"))
+
+	if err != nil || summary.Failed != 2 {
+		t.Fatalf("Import => %+v %v", summary, err)
+	}
+	codes := map[string]string{}
+	for _, result := range results {
+		codes[result.ApnsToken] = result.Error
+	}
+	if codes["down1"] != "503 Service Unavailable" || codes["denied1"] != "PERMISSION_DENIED" {
+		t.Fatalf("codes => %v", codes)
+	}
+
+	// the 503 is retried, the 403 is not
+	if len(h.requests) != 1+batch_max_retries+1 {
+		t.Fatalf("requests => %d", len(h.requests))
+	}
+}
+
+func TestApnsImportStoreError(t *testing.T) {
+	newApnsImportServer(t)
+
+	_, err := NewApnsImporter(NewFcmClient("key")).
+		SetTokenStore(failingTokenStore{}).
+		Import(context.Background(), strings.NewReader("com.a t1\n"))
+	if err == nil || !strings.Contains(err.Error(), "saving tokens") {
+		t.Fatalf("Import => %v", err)
+	}
+}
+
+type failingTokenStore struct{}
+
+func (failingTokenStore) Put(records []TokenRecord) error {
+	return fmt.Errorf("disk full")
+}
+
+func (failingTokenStore) Delete(tokens []string) error {
+	return fmt.Errorf("disk full")
+}
@@ -0,0 +1,269 @@
+package fcm
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	// max_batch_tokens max number of tokens per batchAdd/batchRemove request
+	max_batch_tokens = 1000
+
+	// default_batch_concurrency default max number of concurrent batch requests
+	default_batch_concurrency = 4
+
+	// batch_max_retries max number of retries for INTERNAL token errors
+	batch_max_retries = 3
+
+	// batch_internal_error retryable batch token error
+	batch_internal_error = "INTERNAL"
+)
+
+var (
+	// batchRetryBackoff the initial backoff before retrying INTERNAL errors,
+	// doubled on every retry, for testing purposes
+	batchRetryBackoff = 500 * time.Millisecond
+)
+
+// SetBatchConcurrency sets the max number of requests sent at the same time
+// when a token or message list is split into chunks, and by SendEach
+func (this *FcmClient) SetBatchConcurrency(n int) *FcmClient {
+
+	this.batchConcurrency = n
+
+	return this
+}
+
+// getBatchConcurrency returns the batch concurrency or the default one
+func (this *FcmClient) getBatchConcurrency() int {
+	if this.batchConcurrency > 0 {
+		return this.batchConcurrency
+	}
+	return default_batch_concurrency
+}
+
+// batchTopic splits the tokens into chunks, sends them concurrently and
+// merges the responses in the same order of the tokens
+func (this *FcmClient) batchTopic(name string, endpoint string, srv string, tokens []string, topic string) (*BatchResponse, error) {
+
+	ctx, span := this.startSpan(name,
+		Attr(attr_endpoint, endpoint),
+		Attr(attr_target_type, "topic"),
+		Attr(attr_token_count, len(tokens)))
+
+	result, err := this.batchChunks(ctx, endpoint, srv, tokens, topic)
+	if result != nil {
+		this.reportBatchResults(ctx, endpoint, tokens, result)
+	}
+	endSpan(span, err)
+
+	return result, err
+}
+
+// batchChunks sends the chunks of tokens concurrently and merges the
+// responses. If a chunk request fails, its error is returned with the
+// merged response, the tokens of the chunk having the error code of the
+// request, so that the other chunks are still reported
+func (this *FcmClient) batchChunks(ctx context.Context, endpoint string, srv string, tokens []string, topic string) (*BatchResponse, error) {
+
+	if len(tokens) <= max_batch_tokens {
+		return this.batchChunk(ctx, endpoint, srv, tokens, topic)
+	}
+
+	chunks := chunkTokens(tokens, max_batch_tokens)
+	responses := make([]*BatchResponse, len(chunks))
+	errs := make([]error, len(chunks))
+
+	runConcurrently(len(chunks), this.getBatchConcurrency(), func(i int) {
+		responses[i], errs[i] = this.batchChunk(ctx, endpoint, srv, chunks[i], topic)
+	})
+
+	var firstErr error
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		responses[i] = failedBatchResponse(err)
+	}
+
+	return mergeBatchResponses(chunks, responses), firstErr
+}
+
+// failedBatchResponse the response of a chunk whose request failed, the
+// code of the instance id error or Unavailable
+func failedBatchResponse(err error) *BatchResponse {
+	resp := &BatchResponse{Error: fcm_unavailable}
+
+	iidErr := new(IidError)
+	if errors.As(err, &iidErr) {
+		resp.Status, resp.StatusCode = iidErr.Status, iidErr.StatusCode
+		if iidErr.Code != "" {
+			resp.Error = iidErr.Code
+		}
+	}
+	return resp
+}
+
+// batchChunk sends a single chunk, the tokens failing with an INTERNAL
+// error are sent again with an exponential backoff
+func (this *FcmClient) batchChunk(ctx context.Context, endpoint string, srv string, tokens []string, topic string) (*BatchResponse, error) {
+
+	result, err := this.batchRequestOnce(ctx, endpoint, srv, tokens, topic)
+	if err != nil {
+		return nil, err
+	}
+
+	backoff := batchRetryBackoff
+
+	for attempt := 0; attempt < batch_max_retries; attempt++ {
+
+		retry := internalErrorIndexes(result, len(tokens))
+		if len(retry) == 0 {
+			break
+		}
+
+		this.getLogger().Warn("fcm: retrying batch tokens",
+			"endpoint", endpoint, "attempt", attempt+1, "tokens", len(retry), "backoff", backoff)
+
+		this.getMetrics().ObserveRetry(endpoint)
+		spanFromContext(ctx).AddEvent(event_retry,
+			Attr(attr_retry_attempt, attempt+1), Attr(attr_token_count, len(retry)))
+
+		select {
+		case <-ctx.Done():
+			return result, nil
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+
+		retryTokens := make([]string, len(retry))
+		for i, idx := range retry {
+			retryTokens[i] = tokens[idx]
+		}
+
+		again, err := this.batchRequestOnce(ctx, endpoint, srv, retryTokens, topic)
+		if err != nil {
+			// keep the INTERNAL errors of the previous attempt
+			break
+		}
+
+		for i, idx := range retry {
+			if i < len(again.Results) {
+				result.Results[idx] = again.Results[i]
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// reportBatchResults logs the tokens of a batch response with an error
+// and records the outcome of every token
+func (this *FcmClient) reportBatchResults(ctx context.Context, endpoint string, tokens []string, resp *BatchResponse) {
+	logger := this.getLogger()
+	metrics := this.getMetrics()
+	span := spanFromContext(ctx)
+
+	failed := 0
+	for i, val := range resp.Results {
+		if val[error_key] == "" {
+			metrics.ObserveTokenOutcome(endpoint, outcome_ok)
+			continue
+		}
+		failed++
+		metrics.ObserveTokenOutcome(endpoint, val[error_key])
+		if i < len(tokens) {
+			logger.Info("fcm: token failed",
+				"endpoint", endpoint, "token", redactToken(tokens[i]), "error", val[error_key])
+			span.AddEvent(event_token_error,
+				Attr(attr_token, redactToken(tokens[i])), Attr(attr_token_index, i), Attr(attr_error, val[error_key]))
+		}
+	}
+
+	span.SetAttributes(Attr(attr_success_count, len(resp.Results)-failed), Attr(attr_failure_count, failed))
+}
+
+// internalErrorIndexes returns the indexes of the tokens with an INTERNAL error
+func internalErrorIndexes(resp *BatchResponse, n int) []int {
+	var indexes []int
+	for i, val := range resp.Results {
+		if i >= n {
+			break
+		}
+		if val[error_key] == batch_internal_error {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes
+}
+
+// mergeBatchResponses merges the responses of the chunks into one
+// response, Results are aligned with the tokens, a token missing from its
+// chunk results gets the chunk error, or status if there is no error
+func mergeBatchResponses(chunks [][]string, responses []*BatchResponse) *BatchResponse {
+
+	merged := new(BatchResponse)
+	merged.Status = responses[0].Status
+	merged.StatusCode = responses[0].StatusCode
+
+	for i, resp := range responses {
+
+		if merged.Error == "" {
+			merged.Error = resp.Error
+		}
+
+		merged.Tokens = append(merged.Tokens, chunks[i]...)
+
+		for j := range chunks[i] {
+			if j < len(resp.Results) {
+				merged.Results = append(merged.Results, resp.Results[j])
+				continue
+			}
+
+			chunkErr := resp.Error
+			if chunkErr == "" {
+				chunkErr = resp.Status
+			}
+			merged.Results = append(merged.Results, map[string]string{error_key: chunkErr})
+		}
+	}
+
+	return merged
+}
+
+// runConcurrently calls fn(0) to fn(n-1), at most limit calls at the same
+// time, and waits for all of them
+func runConcurrently(n int, limit int, fn func(i int)) {
+	sem := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			fn(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// chunkTokens splits tokens into chunks of at most size tokens
+func chunkTokens(tokens []string, size int) [][]string {
+	var chunks [][]string
+	for len(tokens) > size {
+		chunks = append(chunks, tokens[:size])
+		tokens = tokens[size:]
+	}
+	if len(tokens) > 0 {
+		chunks = append(chunks, tokens)
+	}
+	return chunks
+}
@@ -0,0 +1,199 @@
+package fcm
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// batchHandle replies NOT_FOUND for the tokens prefixed with "bad" and
+// INTERNAL for the first request of the tokens prefixed with "flaky"
+type batchHandle struct {
+	sync.Mutex
+	seen     map[string]bool
+	inFlight int
+	maxIn    int
+	calls    int
+}
+
+func (h *batchHandle) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.Lock()
+	h.calls++
+	h.inFlight++
+	if h.inFlight > h.maxIn {
+		h.maxIn = h.inFlight
+	}
+	h.Unlock()
+
+	defer func() {
+		h.Lock()
+		h.inFlight--
+		h.Unlock()
+	}()
+
+	req := new(BatchRequest)
+	json.NewDecoder(r.Body).Decode(req)
+
+	results := make([]map[string]string, len(req.RegTokens))
+
+	h.Lock()
+	for i, token := range req.RegTokens {
+		results[i] = map[string]string{}
+		switch {
+		case strings.HasPrefix(token, "bad"):
+			results[i]["error"] = "NOT_FOUND"
+		case strings.HasPrefix(token, "flaky") && !h.seen[token]:
+			h.seen[token] = true
+			results[i]["error"] = "INTERNAL"
+		}
+	}
+	h.Unlock()
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"results": results})
+}
+
+func TestBatchSubscribeChunks(t *testing.T) {
+	batchRetryBackoff = 0
+
+	h := &batchHandle{seen: make(map[string]bool)}
+	srv := httptest.NewServer(h)
+	chgIidUrl(srv)
+	defer resetIidUrl()
+	defer srv.Close()
+
+	tokens := make([]string, 4500)
+	for i := range tokens {
+		switch i % 3 {
+		case 0:
+			tokens[i] = fmt.Sprintf("token%d", i)
+		case 1:
+			tokens[i] = fmt.Sprintf("bad%d", i)
+		case 2:
+			tokens[i] = fmt.Sprintf("flaky%d", i)
+		}
+	}
+
+	c := NewFcmClient("key").SetBatchConcurrency(2)
+
+	res, err := c.BatchSubscribeToTopic(tokens, "/topics/news")
+	if err != nil {
+		t.Fatal("Batch Error: ", err)
+	}
+
+	if res.StatusCode != 200 {
+		t.Error("Expected status code 200, got ", res.StatusCode)
+	}
+	if len(res.Results) != len(tokens) {
+		t.Fatal("Expected one result per token, got ", len(res.Results))
+	}
+
+	for i, token := range tokens {
+		e := res.Results[i]["error"]
+		if strings.HasPrefix(token, "bad") && e != "NOT_FOUND" {
+			t.Fatal("Result not aligned with token ", token, " : ", e)
+		}
+		if !strings.HasPrefix(token, "bad") && e != "" {
+			t.Fatal("Unexpected error for token ", token, " : ", e)
+		}
+	}
+
+	// 5 chunks and 5 retries of the INTERNAL errors
+	if h.calls != 10 {
+		t.Error("Expected 10 requests, got ", h.calls)
+	}
+	if h.maxIn > 2 {
+		t.Error("Concurrency limit exceeded: ", h.maxIn)
+	}
+}
+
+func TestBatchUnsubscribeSingleChunk(t *testing.T) {
+	h := &batchHandle{seen: make(map[string]bool)}
+	srv := httptest.NewServer(h)
+	chgIidUrl(srv)
+	defer resetIidUrl()
+	defer srv.Close()
+
+	c := NewFcmClient("key")
+
+	res, err := c.BatchUnsubscribeFromTopic([]string{"token0", "bad1"}, "news")
+	if err != nil {
+		t.Fatal("Batch Error: ", err)
+	}
+	if len(res.Results) != 2 || res.Results[1]["error"] != "NOT_FOUND" {
+		t.Error("Wrong results: ", res.Results)
+	}
+	if h.calls != 1 {
+		t.Error("Expected a single request, got ", h.calls)
+	}
+}
+
+func TestBatchSubscribeChunkFailure(t *testing.T) {
+	h := &batchHandle{seen: make(map[string]bool)}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		// the second chunk fails
+		if strings.Contains(string(body), `"token1000"`) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		h.ServeHTTP(w, r)
+	}))
+	chgIidUrl(srv)
+	defer resetIidUrl()
+	defer srv.Close()
+
+	tokens := make([]string, 2000)
+	for i := range tokens {
+		tokens[i] = fmt.Sprintf("token%d", i)
+	}
+
+	res, err := NewFcmClient("key").BatchSubscribeToTopic(tokens, "news")
+	iidErr := new(IidError)
+	if !errors.As(err, &iidErr) || iidErr.StatusCode != 503 {
+		t.Fatal("Expected the chunk error, got ", err)
+	}
+	if res == nil || len(res.Results) != len(tokens) {
+		t.Fatal("Expected the merged results, got ", res)
+	}
+	if res.Results[999]["error"] != "" || res.Results[1000]["error"] != fcm_unavailable {
+		t.Error("Wrong results: ", res.Results[999], res.Results[1000])
+	}
+}
+
+func TestMergeBatchResponsesMissingResults(t *testing.T) {
+	chunks := [][]string{{"a", "b"}, {"c"}}
+	responses := []*BatchResponse{
+		{Results: []map[string]string{{}, {"error": "NOT_FOUND"}}, Status: "200 OK", StatusCode: 200},
+		{Error: "InvalidTokenVersion", Status: "200 OK", StatusCode: 200},
+	}
+
+	merged := mergeBatchResponses(chunks, responses)
+
+	if merged.StatusCode != 200 || merged.Error != "InvalidTokenVersion" {
+		t.Error("Expected the chunk error, got ", merged.StatusCode, merged.Error)
+	}
+	if len(merged.Results) != 3 || merged.Results[2]["error"] != "InvalidTokenVersion" {
+		t.Error("Expected the chunk error on its tokens, got ", merged.Results)
+	}
+}
+
+func TestChunkTokens(t *testing.T) {
+	tokens := []string{"a", "b", "c", "d", "e"}
+
+	chunks := chunkTokens(tokens, 2)
+	if len(chunks) != 3 || len(chunks[2]) != 1 {
+		t.Error("Wrong chunks: ", chunks)
+	}
+
+	if len(chunkTokens(nil, 2)) != 0 {
+		t.Error("Expected no chunks for no tokens")
+	}
+}
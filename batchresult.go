@@ -0,0 +1,116 @@
+package fcm
+
+import "errors"
+
+const (
+	// ErrNotFound the token is not a valid instance id token
+	ErrNotFound BatchError = "NOT_FOUND"
+	// ErrInvalidArgument the token or the request is invalid
+	ErrInvalidArgument BatchError = "INVALID_ARGUMENT"
+	// ErrInternal the instance id server failed, the token can be retried
+	ErrInternal BatchError = "INTERNAL"
+	// ErrTooManyTopics the token is subscribed to too many topics
+	ErrTooManyTopics BatchError = "TOO_MANY_TOPICS"
+)
+
+// BatchError the error code of a token in a batch response, compare it
+// with errors.Is, e.g. errors.Is(result.Err, ErrNotFound). An *IidError
+// with the same code matches too
+type BatchError string
+
+// Error returns the batch error message
+func (this BatchError) Error() string {
+	return "fcm: batch token error: " + string(this)
+}
+
+// Is reports whether an *IidError has the same code
+func (this *IidError) Is(target error) bool {
+	var code BatchError
+	return errors.As(target, &code) && this.Code == string(code)
+}
+
+// BatchTokenResult the outcome of a token of a batchAdd/batchRemove request
+type BatchTokenResult struct {
+	Token string
+	// Err a BatchError, nil if the token succeeded
+	Err error
+}
+
+// ApnsTokenResult the outcome of an apns token of a batchImport request
+type ApnsTokenResult struct {
+	ApnsToken         string
+	RegistrationToken string
+	// Err a BatchError, nil if the registration token was created
+	Err error
+}
+
+// TokenResults pairs every token of the request with its result, the
+// tokens are only known for the responses of the client (Tokens is set)
+func (this *BatchResponse) TokenResults() []BatchTokenResult {
+	results := make([]BatchTokenResult, len(this.Results))
+	for i, val := range this.Results {
+		if i < len(this.Tokens) {
+			results[i].Token = this.Tokens[i]
+		}
+		if val[error_key] != "" {
+			results[i].Err = BatchError(val[error_key])
+		}
+	}
+	return results
+}
+
+// Succeeded returns the results of the tokens without an error
+func (this *BatchResponse) Succeeded() []BatchTokenResult {
+	return partitionBatch(this.TokenResults(), true)
+}
+
+// Failed returns the results of the tokens with an error
+func (this *BatchResponse) Failed() []BatchTokenResult {
+	return partitionBatch(this.TokenResults(), false)
+}
+
+// TokenResults returns the typed result of every apns token
+func (this *ApnsBatchResponse) TokenResults() []ApnsTokenResult {
+	results := make([]ApnsTokenResult, len(this.Results))
+	for i, val := range this.Results {
+		results[i].ApnsToken = val[apns_token_key]
+		if val[status_key] == apns_import_ok {
+			results[i].RegistrationToken = val[reg_token_key]
+		} else {
+			results[i].Err = BatchError(val[status_key])
+		}
+	}
+	return results
+}
+
+// Succeeded returns the results of the apns tokens imported
+func (this *ApnsBatchResponse) Succeeded() []ApnsTokenResult {
+	return partitionApns(this.TokenResults(), true)
+}
+
+// Failed returns the results of the apns tokens not imported
+func (this *ApnsBatchResponse) Failed() []ApnsTokenResult {
+	return partitionApns(this.TokenResults(), false)
+}
+
+// partitionBatch returns the results succeeded (or failed)
+func partitionBatch(results []BatchTokenResult, succeeded bool) []BatchTokenResult {
+	var part []BatchTokenResult
+	for _, result := range results {
+		if (result.Err == nil) == succeeded {
+			part = append(part, result)
+		}
+	}
+	return part
+}
+
+// partitionApns returns the apns results succeeded (or failed)
+func partitionApns(results []ApnsTokenResult, succeeded bool) []ApnsTokenResult {
+	var part []ApnsTokenResult
+	for _, result := range results {
+		if (result.Err == nil) == succeeded {
+			part = append(part, result)
+		}
+	}
+	return part
+}
@@ -0,0 +1,101 @@
+package fcm
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBatchResponseTokenResults(t *testing.T) {
+	batchRetryBackoff = 0
+
+	srv := httptest.NewServer(&batchHandle{seen: make(map[string]bool)})
+	chgIidUrl(srv)
+	defer resetIidUrl()
+	defer srv.Close()
+
+	tokens := []string{"token1", "bad2", "flaky3", "bad4"}
+	resp, err := NewFcmClient("key").BatchSubscribeToTopic(tokens, "news")
+	if err != nil {
+		t.Fatalf("BatchSubscribeToTopic => %v", err)
+	}
+
+	results := resp.TokenResults()
+	if len(results) != 4 || results[1].Token != "bad2" || !errors.Is(results[1].Err, ErrNotFound) {
+		t.Fatalf("results => %+v", results)
+	}
+
+	succeeded, failed := resp.Succeeded(), resp.Failed()
+	if len(succeeded) != 2 || succeeded[0].Token != "token1" || succeeded[1].Token != "flaky3" {
+		t.Fatalf("succeeded => %+v", succeeded)
+	}
+	if len(failed) != 2 || failed[1].Token != "bad4" {
+		t.Fatalf("failed => %+v", failed)
+	}
+
+	// the raw results are kept
+	if resp.Results[3][error_key] != "NOT_FOUND" {
+		t.Fatalf("raw results => %v", resp.Results)
+	}
+}
+
+func TestBatchResponseTokenResultsChunks(t *testing.T) {
+	batchRetryBackoff = 0
+
+	srv := httptest.NewServer(&batchHandle{seen: make(map[string]bool)})
+	chgIidUrl(srv)
+	defer resetIidUrl()
+	defer srv.Close()
+
+	tokens := make([]string, max_batch_tokens+1)
+	for i := range tokens {
+		tokens[i] = "token"
+	}
+	tokens[max_batch_tokens] = "bad"
+
+	resp, err := NewFcmClient("key").BatchUnsubscribeFromTopic(tokens, "news")
+	if err != nil {
+		t.Fatalf("BatchUnsubscribeFromTopic => %v", err)
+	}
+	failed := resp.Failed()
+	if len(failed) != 1 || failed[0].Token != "bad" || len(resp.Succeeded()) != max_batch_tokens {
+		t.Fatalf("failed => %+v", failed)
+	}
+}
+
+func TestApnsBatchResponseTokenResults(t *testing.T) {
+	resp := &ApnsBatchResponse{Results: []map[string]string{
+		{apns_token_key: "a1", status_key: apns_import_ok, reg_token_key: "r1"},
+		{apns_token_key: "a2", status_key: "INVALID_ARGUMENT"},
+		{apns_token_key: "a3", status_key: "INTERNAL"},
+	}}
+
+	succeeded := resp.Succeeded()
+	if len(succeeded) != 1 || succeeded[0].ApnsToken != "a1" || succeeded[0].RegistrationToken != "r1" {
+		t.Fatalf("succeeded => %+v", succeeded)
+	}
+
+	failed := resp.Failed()
+	if len(failed) != 2 || !errors.Is(failed[0].Err, ErrInvalidArgument) || !errors.Is(failed[1].Err, ErrInternal) {
+		t.Fatalf("failed => %+v", failed)
+	}
+	if errors.Is(failed[1].Err, ErrTooManyTopics) {
+		t.Fatal("INTERNAL matches TOO_MANY_TOPICS")
+	}
+}
+
+func TestIidErrorIs(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"TOO_MANY_TOPICS"}`))
+	}))
+	chgIidUrl(srv)
+	defer resetIidUrl()
+	defer srv.Close()
+
+	_, err := NewFcmClient("key").BatchSubscribeToTopic([]string{"t1"}, "news")
+	if !errors.Is(err, ErrTooManyTopics) || errors.Is(err, ErrNotFound) {
+		t.Fatalf("BatchSubscribeToTopic => %v", err)
+	}
+}
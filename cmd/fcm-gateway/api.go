@@ -0,0 +1,488 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/NaySoftware/go-fcm"
+)
+
+const (
+	// max_body_size max size of a request body
+	max_body_size = 1 << 20
+
+	// max_tokens max number of tokens of a send or topic request
+	max_tokens = 1000
+
+	// default_backoff first wait before retrying an unavailable response
+	default_backoff = 500 * time.Millisecond
+
+	// dedup_capacity max number of idempotency keys remembered
+	dedup_capacity = 100000
+	// dedup_ttl how long an idempotency key is remembered
+	dedup_ttl = 24 * time.Hour
+
+	// idempotency_key_header header of the idempotency key of a send
+	idempotency_key_header = "Idempotency-Key"
+)
+
+var (
+	//go:embed openapi.json
+	openapiDocument []byte
+
+	// topicPattern the valid topic names
+	topicPattern = regexp.MustCompile(`^[a-zA-Z0-9-_.~%]{1,900}$`)
+)
+
+// sendRequest the body of POST /v1/send, with exactly one target
+type sendRequest struct {
+	Token        string                   `json:"token,omitempty"`
+	Tokens       []string                 `json:"tokens,omitempty"`
+	Topic        string                   `json:"topic,omitempty"`
+	Condition    string                   `json:"condition,omitempty"`
+	Group        string                   `json:"group,omitempty"`
+	Notification *fcm.NotificationPayload `json:"notification,omitempty"`
+	Data         map[string]string        `json:"data,omitempty"`
+	Priority     string                   `json:"priority,omitempty"`
+	TimeToLive   *int                     `json:"time_to_live,omitempty"`
+	CollapseKey  string                   `json:"collapse_key,omitempty"`
+	DryRun       bool                     `json:"dry_run,omitempty"`
+}
+
+// tokenResult the result of a single token (or topic, condition, group)
+type tokenResult struct {
+	Token          string `json:"token,omitempty"`
+	MessageId      string `json:"message_id,omitempty"`
+	RegistrationId string `json:"registration_id,omitempty"`
+	Error          string `json:"error,omitempty"`
+}
+
+// sendResponse the body of a POST /v1/send response
+type sendResponse struct {
+	MulticastId int64         `json:"multicast_id,omitempty"`
+	Success     int           `json:"success"`
+	Failure     int           `json:"failure"`
+	Results     []tokenResult `json:"results"`
+}
+
+// topicRequest the body of the topic subscribe/unsubscribe requests
+type topicRequest struct {
+	Tokens []string `json:"tokens"`
+}
+
+// topicResponse the body of the topic subscribe/unsubscribe responses
+type topicResponse struct {
+	Topic   string        `json:"topic"`
+	Success int           `json:"success"`
+	Failure int           `json:"failure"`
+	Results []tokenResult `json:"results"`
+}
+
+// apiError the body of an error response
+type apiError struct {
+	Error struct {
+		Code          int    `json:"code"`
+		Message       string `json:"message"`
+		FcmStatusCode int    `json:"fcm_status_code,omitempty"`
+	} `json:"error"`
+}
+
+// clientKey the context key of the authenticated client name
+type clientKey struct{}
+
+// gateway the http handler of the api
+type gateway struct {
+	// clients token -> client name
+	clients     map[string]string
+	credentials fcm.CredentialProvider
+	httpClient  *http.Client
+	logger      fcm.Logger
+	rate        float64
+	burst       int
+	retries     int
+	backoff     time.Duration
+	// interceptors added to every fcm client, after the retry one
+	interceptors []fcm.Interceptor
+
+	// limiters the rate limiter of every client name
+	limiters map[string]*fcm.RateLimiter
+	// dedup the responses of the sends with an idempotency key
+	dedup fcm.DedupStore
+
+	mux *http.ServeMux
+}
+
+// newGateway init the api handler
+func newGateway(clients map[string]string, credentials fcm.CredentialProvider, rate float64, burst int, retries int) (*gateway, error) {
+	gw := &gateway{
+		clients:     clients,
+		credentials: credentials,
+		httpClient:  &http.Client{Timeout: 30 * time.Second},
+		rate:        rate,
+		burst:       burst,
+		retries:     retries,
+		backoff:     default_backoff,
+		limiters:    make(map[string]*fcm.RateLimiter),
+		dedup:       fcm.NewMemoryDedupStore(dedup_capacity),
+		mux:         http.NewServeMux(),
+	}
+
+	for _, name := range clients {
+		if _, ok := gw.limiters[name]; ok {
+			continue
+		}
+		l, err := fcm.NewRateLimiter(rate, burst)
+		if err != nil {
+			return nil, err
+		}
+		gw.limiters[name] = l
+	}
+
+	gw.mux.HandleFunc("POST /v1/send", gw.handleSend)
+	gw.mux.HandleFunc("POST /v1/topics/{topic}/subscribe", gw.handleTopic(true))
+	gw.mux.HandleFunc("POST /v1/topics/{topic}/unsubscribe", gw.handleTopic(false))
+	gw.mux.HandleFunc("GET /v1/tokens/{token}", gw.handleInfo)
+
+	return gw, nil
+}
+
+// ServeHTTP authenticates and rate limits the requests, the OpenAPI
+// document is public
+func (this *gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	if r.URL.Path == "/openapi.json" && r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(openapiDocument)
+		return
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	name, ok := this.clients[token]
+	if token == "" || !ok {
+		writeError(w, http.StatusUnauthorized, "missing or invalid bearer token")
+		return
+	}
+
+	if !this.limiters[name].Allow() {
+		w.Header().Set("Retry-After", "1")
+		writeError(w, http.StatusTooManyRequests, "rate limit exceeded")
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, max_body_size)
+	this.mux.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientKey{}, name)))
+}
+
+// client returns a new fcm client for a request
+func (this *gateway) client(ctx context.Context) *fcm.FcmClient {
+	c := fcm.NewFcmClient("").
+		SetCredentialProvider(this.credentials).
+		SetHttpClient(this.httpClient).
+		SetLogger(this.logger).
+		SetDedupStore(this.dedup, dedup_ttl).
+		AddInterceptor(fcm.RetryInterceptor(this.retries, this.backoff)).
+		AddInterceptor(this.interceptors...)
+
+	return c.WithContext(ctx)
+}
+
+// handleSend sends a message and returns the result of every token
+func (this *gateway) handleSend(w http.ResponseWriter, r *http.Request) {
+
+	req := new(sendRequest)
+	if err := decodeBody(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	msg, targets, err := req.message()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	c := this.client(r.Context())
+	c.Message = *msg
+	if key := r.Header.Get(idempotency_key_header); key != "" {
+		// a retried request gets the recorded response, the keys of the
+		// clients are kept apart
+		name, _ := r.Context().Value(clientKey{}).(string)
+		c.SetIdempotencyKey(name + "\x00" + key)
+	}
+
+	status, err := c.Send()
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	if !status.Ok {
+		writeFcmError(w, status.StatusCode)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newSendResponse(status, targets))
+}
+
+// handleTopic subscribes or unsubscribes tokens
+func (this *gateway) handleTopic(subscribe bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		topic := strings.TrimPrefix(r.PathValue("topic"), "/topics/")
+		if !topicPattern.MatchString(topic) {
+			writeError(w, http.StatusBadRequest, "invalid topic name")
+			return
+		}
+
+		req := new(topicRequest)
+		if err := decodeBody(r, req); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := validateTokens(req.Tokens); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		c := this.client(r.Context())
+
+		var resp *fcm.BatchResponse
+		var err error
+		if subscribe {
+			resp, err = c.BatchSubscribeToTopic(req.Tokens, topic)
+		} else {
+			resp, err = c.BatchUnsubscribeFromTopic(req.Tokens, topic)
+		}
+
+		iidErr := new(fcm.IidError)
+		if errors.As(err, &iidErr) {
+			writeFcmError(w, iidErr.StatusCode)
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusBadGateway, err.Error())
+			return
+		}
+
+		out := &topicResponse{Topic: topic, Results: make([]tokenResult, len(req.Tokens))}
+		for i, token := range req.Tokens {
+			out.Results[i].Token = token
+			if i < len(resp.Results) {
+				out.Results[i].Error = resp.Results[i]["error"]
+			}
+			if out.Results[i].Error == "" {
+				out.Success++
+			} else {
+				out.Failure++
+			}
+		}
+
+		writeJSON(w, http.StatusOK, out)
+	}
+}
+
+// handleInfo returns the instance id info of a token
+func (this *gateway) handleInfo(w http.ResponseWriter, r *http.Request) {
+
+	token := r.PathValue("token")
+	if err := validateTokens([]string{token}); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	details, _ := strconv.ParseBool(r.URL.Query().Get("details"))
+
+	info, err := this.client(r.Context()).GetInfo(details, token)
+	iidErr := new(fcm.IidError)
+	if errors.As(err, &iidErr) && iidErr.IsTokenError() {
+		// the token is unknown to the instance id server
+		writeError(w, http.StatusNotFound, iidErr.Code)
+		return
+	}
+	if errors.As(err, &iidErr) {
+		writeFcmError(w, iidErr.StatusCode)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	if info.Error != "" {
+		writeError(w, http.StatusNotFound, info.Error)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, info)
+}
+
+// message validates the request and builds the fcm message, targets are
+// the tokens (or the topic, condition, group) of the results
+func (this *sendRequest) message() (*fcm.FcmMsg, []string, error) {
+
+	msg := new(fcm.FcmMsg)
+	var targets []string
+
+	set := 0
+	if this.Token != "" {
+		set++
+		msg.To = this.Token
+		targets = []string{this.Token}
+	}
+	if len(this.Tokens) > 0 {
+		set++
+		if err := validateTokens(this.Tokens); err != nil {
+			return nil, nil, err
+		}
+		msg.RegistrationIds = this.Tokens
+		targets = this.Tokens
+	}
+	if this.Topic != "" {
+		set++
+		topic := strings.TrimPrefix(this.Topic, "/topics/")
+		if !topicPattern.MatchString(topic) {
+			return nil, nil, errors.New("invalid topic name")
+		}
+		msg.To = "/topics/" + topic
+		targets = []string{msg.To}
+	}
+	if this.Condition != "" {
+		set++
+		msg.Condition = this.Condition
+		targets = []string{this.Condition}
+	}
+	if this.Group != "" {
+		set++
+		msg.To = this.Group
+		targets = []string{this.Group}
+	}
+	if set != 1 {
+		return nil, nil, errors.New("exactly one of token, tokens, topic, condition and group is required")
+	}
+
+	if this.Notification == nil && len(this.Data) == 0 {
+		return nil, nil, errors.New("notification or data is required")
+	}
+	if this.Notification != nil {
+		msg.Notification = *this.Notification
+	}
+	for k := range this.Data {
+		if fcm.IsReservedDataKey(k) {
+			return nil, nil, fmt.Errorf("reserved data key %q", k)
+		}
+	}
+	if len(this.Data) > 0 {
+		msg.Data = this.Data
+	}
+
+	switch this.Priority {
+	case "", fcm.Priority_HIGH, fcm.Priority_NORMAL:
+		msg.Priority = this.Priority
+	default:
+		return nil, nil, fmt.Errorf("invalid priority %q, expected high or normal", this.Priority)
+	}
+
+	if this.TimeToLive != nil {
+		if *this.TimeToLive < 0 || *this.TimeToLive > fcm.MAX_TTL {
+			return nil, nil, fmt.Errorf("time_to_live must be between 0 and %d", fcm.MAX_TTL)
+		}
+		msg.TimeToLive = *this.TimeToLive
+	}
+
+	msg.CollapseKey = this.CollapseKey
+	msg.DryRun = this.DryRun
+
+	return msg, targets, nil
+}
+
+// newSendResponse maps the fcm results to the targets
+func newSendResponse(status *fcm.FcmResponseStatus, targets []string) *sendResponse {
+
+	out := &sendResponse{MulticastId: status.MulticastId, Results: make([]tokenResult, len(targets))}
+
+	for i, target := range targets {
+		result := &out.Results[i]
+		result.Token = target
+
+		switch {
+		case i < len(status.Results):
+			result.MessageId = status.Results[i]["message_id"]
+			result.RegistrationId = status.Results[i]["registration_id"]
+			result.Error = status.Results[i]["error"]
+		case status.Err != "":
+			result.Error = status.Err
+		case status.MsgId != 0:
+			result.MessageId = strconv.FormatInt(status.MsgId, 10)
+		}
+
+		if result.Error == "" {
+			out.Success++
+		} else {
+			out.Failure++
+		}
+	}
+
+	return out
+}
+
+// validateTokens checks the number and the format of tokens
+func validateTokens(tokens []string) error {
+	if len(tokens) == 0 {
+		return errors.New("tokens is required")
+	}
+	if len(tokens) > max_tokens {
+		return fmt.Errorf("at most %d tokens per request", max_tokens)
+	}
+	for _, token := range tokens {
+		if token == "" || strings.ContainsAny(token, " /?#") {
+			return fmt.Errorf("invalid token %q", token)
+		}
+	}
+	return nil
+}
+
+// decodeBody decodes a json body, unknown fields are refused
+func decodeBody(r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("invalid json body: %w", err)
+	}
+	return nil
+}
+
+// writeJSON writes v as the json body of the response
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes an error response
+func writeError(w http.ResponseWriter, code int, message string) {
+	body := new(apiError)
+	body.Error.Code = code
+	body.Error.Message = message
+	writeJSON(w, code, body)
+}
+
+// writeFcmError writes the error response of a failed fcm request, a 5xx
+// from fcm is a 503 of the gateway, the other codes are a 502
+func writeFcmError(w http.ResponseWriter, fcmStatusCode int) {
+	code := http.StatusBadGateway
+	if fcmStatusCode >= 500 {
+		code = http.StatusServiceUnavailable
+	}
+
+	body := new(apiError)
+	body.Error.Code = code
+	body.Error.Message = fmt.Sprintf("fcm request failed with status %d", fcmStatusCode)
+	body.Error.FcmStatusCode = fcmStatusCode
+	writeJSON(w, code, body)
+}
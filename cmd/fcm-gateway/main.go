@@ -0,0 +1,134 @@
+// Command fcm-gateway is an http service sending pushes on behalf of
+// services that do not hold the fcm credentials.
+//
+//	fcm-gateway -clients clients.txt [-addr :8080] [-key-file server.key]
+//
+// Every request is authenticated with a bearer token of the clients file,
+// one "name token" pair per line, and rate limited per client. The server
+// key is read from -key-file (reloaded when it changes) or the
+// FCM_SERVER_KEY environment variable.
+//
+// Endpoints:
+//
+//	POST /v1/send                       send to a token, tokens, topic, condition or group
+//	POST /v1/topics/{topic}/subscribe   subscribe tokens to a topic
+//	POST /v1/topics/{topic}/unsubscribe unsubscribe tokens from a topic
+//	GET  /v1/tokens/{token}             instance id info of a token
+//	GET  /openapi.json                  the OpenAPI document of the api
+//
+// Requests are sent synchronously, with retries of the unavailable
+// responses, the result of every token is returned as json. A send with an
+// Idempotency-Key header repeated within 24h gets the recorded response
+// instead of being sent again.
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/NaySoftware/go-fcm"
+)
+
+const (
+	// server_key_env environment variable holding the server key
+	server_key_env = "FCM_SERVER_KEY"
+)
+
+func main() {
+	if err := run(os.Args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "fcm-gateway:", err)
+		os.Exit(1)
+	}
+}
+
+// run parses the flags and serves the api
+func run(args []string) error {
+	flags := flag.NewFlagSet("fcm-gateway", flag.ContinueOnError)
+	addr := flags.String("addr", ":8080", "listen address")
+	clientsFile := flags.String("clients", "", "file with one \"name token\" client per line")
+	keyFile := flags.String("key-file", "", "server key file, reloaded when it changes (default $"+server_key_env+")")
+	rate := flags.Float64("rate", 10, "requests per second per client")
+	burst := flags.Int("burst", 20, "request burst per client")
+	retries := flags.Int("retries", 3, "retries of unavailable responses")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *clientsFile == "" {
+		return errors.New("missing -clients")
+	}
+	f, err := os.Open(*clientsFile)
+	if err != nil {
+		return err
+	}
+	clients, err := readClients(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	var credentials fcm.CredentialProvider
+	if *keyFile != "" {
+		credentials = fcm.NewKeyFileCredentials(*keyFile, 10*time.Second)
+	} else {
+		if os.Getenv(server_key_env) == "" {
+			return fmt.Errorf("missing server key, use -key-file or $%s", server_key_env)
+		}
+		credentials = fcm.NewEnvCredentials(server_key_env, "")
+	}
+
+	logger := slog.Default()
+	gw, err := newGateway(clients, credentials, *rate, *burst, *retries)
+	if err != nil {
+		return err
+	}
+	gw.logger = fcm.NewSlogLogger(logger)
+
+	logger.Info("fcm-gateway: listening", "addr", *addr, "clients", len(clients))
+
+	server := &http.Server{
+		Addr:              *addr,
+		Handler:           gw,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return server.ListenAndServe()
+}
+
+// readClients reads the "name token" pairs, empty lines and lines starting
+// with # are skipped. It returns token -> name
+func readClients(r io.Reader) (map[string]string, error) {
+	clients := make(map[string]string)
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("clients line %d: expected \"name token\"", n)
+		}
+		if _, ok := clients[fields[1]]; ok {
+			return nil, fmt.Errorf("clients line %d: duplicate token", n)
+		}
+		clients[fields[1]] = fields[0]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(clients) == 0 {
+		return nil, errors.New("no clients")
+	}
+
+	return clients, nil
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/NaySoftware/go-fcm"
+)
+
+// fakeFcm answers the send, batchAdd and info requests, tokens prefixed
+// with "bad" are not registered, the first "flaky" send is unavailable,
+// the info of "revoked" is refused as if the key were revoked
+type fakeFcm struct {
+	sync.Mutex
+	sends int
+	flaky bool
+}
+
+func (f *fakeFcm) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "key=server-key" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/fcm/send"):
+		msg := new(fcm.FcmMsg)
+		json.NewDecoder(r.Body).Decode(msg)
+
+		f.Lock()
+		f.sends++
+		flaky := f.flaky
+		f.flaky = false
+		f.Unlock()
+
+		if flaky {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if strings.HasPrefix(msg.To, "/topics/") {
+			fmt.Fprint(w, `{"message_id":42}`)
+			return
+		}
+		var results []string
+		for _, token := range msg.RegistrationIds {
+			if strings.HasPrefix(token, "bad") {
+				results = append(results, `{"error":"NotRegistered"}`)
+			} else {
+				results = append(results, `{"message_id":"0:`+token+`"}`)
+			}
+		}
+		fmt.Fprintf(w, `{"multicast_id":7,"results":[%s]}`, strings.Join(results, ","))
+
+	case strings.HasSuffix(r.URL.Path, ":batchAdd"):
+		req := new(fcm.BatchRequest)
+		json.NewDecoder(r.Body).Decode(req)
+		var results []string
+		for _, token := range req.RegTokens {
+			if strings.HasPrefix(token, "bad") {
+				results = append(results, `{"error":"NOT_FOUND"}`)
+			} else {
+				results = append(results, `{}`)
+			}
+		}
+		fmt.Fprintf(w, `{"results":[%s]}`, strings.Join(results, ","))
+
+	case strings.HasSuffix(r.URL.Path, "/revoked"):
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `{"error":"PERMISSION_DENIED"}`)
+
+	case strings.Contains(r.URL.Path, "/info/bad"):
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"error":"InvalidToken"}`)
+
+	default:
+		fmt.Fprint(w, `{"application":"com.example","platform":"ANDROID"}`)
+	}
+}
+
+func newTestGateway(t *testing.T, backend *fakeFcm) (*gateway, *httptest.Server) {
+	ts := httptest.NewServer(backend)
+	t.Cleanup(ts.Close)
+	target, _ := url.Parse(ts.URL)
+
+	gw, err := newGateway(map[string]string{"secret": "billing"}, fcm.NewStaticCredentials("server-key", ""), 100, 100, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw.backoff = time.Millisecond
+	gw.interceptors = []fcm.Interceptor{
+		func(ctx context.Context, call *fcm.Call, next fcm.Invoker) (interface{}, error) {
+			u, _ := url.Parse(call.Url)
+			u.Scheme, u.Host = target.Scheme, target.Host
+			call.Url = u.String()
+			return next(ctx, call)
+		},
+	}
+	return gw, ts
+}
+
+func do(gw *gateway, method string, path string, token string, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	gw.ServeHTTP(w, r)
+	return w
+}
+
+func TestGatewaySend(t *testing.T) {
+	backend := &fakeFcm{flaky: true}
+	gw, _ := newTestGateway(t, backend)
+
+	w := do(gw, "POST", "/v1/send", "secret", `{"tokens":["t1","bad2"],"notification":{"title":"hi"}}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status => %d %s", w.Code, w.Body)
+	}
+
+	out := new(sendResponse)
+	json.Unmarshal(w.Body.Bytes(), out)
+	if out.Success != 1 || out.Failure != 1 || out.Results[0].MessageId != "0:t1" ||
+		out.Results[1].Token != "bad2" || out.Results[1].Error != "NotRegistered" {
+		t.Fatalf("response => %s", w.Body)
+	}
+	if backend.sends != 2 {
+		t.Fatalf("sends => %d, want a retry of the unavailable response", backend.sends)
+	}
+
+	w = do(gw, "POST", "/v1/send", "secret", `{"topic":"news","data":{"k":"v"}}`)
+	json.Unmarshal(w.Body.Bytes(), out)
+	if w.Code != http.StatusOK || out.Results[0].Token != "/topics/news" || out.Results[0].MessageId != "42" {
+		t.Fatalf("topic response => %d %s", w.Code, w.Body)
+	}
+}
+
+func TestGatewayIdempotencyKey(t *testing.T) {
+	backend := new(fakeFcm)
+	gw, _ := newTestGateway(t, backend)
+
+	send := func(key string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/v1/send", strings.NewReader(`{"tokens":["t1"],"data":{"k":"v"}}`))
+		r.Header.Set("Authorization", "Bearer secret")
+		r.Header.Set("Idempotency-Key", key)
+		w := httptest.NewRecorder()
+		gw.ServeHTTP(w, r)
+		return w
+	}
+
+	first, second := send("job-1"), send("job-1")
+	if first.Code != http.StatusOK || first.Body.String() != second.Body.String() {
+		t.Fatalf("responses => %s / %s", first.Body, second.Body)
+	}
+	send("job-2")
+	if backend.sends != 2 {
+		t.Fatalf("sends => %d, want the repeated key not sent", backend.sends)
+	}
+}
+
+func TestGatewayValidation(t *testing.T) {
+	gw, _ := newTestGateway(t, new(fakeFcm))
+
+	bodies := []string{
+		`{"notification":{"title":"no target"}}`,
+		`{"token":"t","topic":"news","data":{"k":"v"}}`,
+		`{"token":"t"}`,
+		`{"token":"t","data":{"google.x":"v"}}`,
+		`{"token":"t","data":{"k":"v"},"priority":"urgent"}`,
+		`{"token":"t","data":{"k":"v"},"time_to_live":-1}`,
+		`{"token":"t","data":{"k":"v"},"unknown":1}`,
+		`{"topic":"bad topic!","data":{"k":"v"}}`,
+	}
+	for _, body := range bodies {
+		if w := do(gw, "POST", "/v1/send", "secret", body); w.Code != http.StatusBadRequest {
+			t.Errorf("%s => %d, want 400", body, w.Code)
+		}
+	}
+}
+
+func TestGatewayAuthAndRateLimit(t *testing.T) {
+	gw, _ := newTestGateway(t, new(fakeFcm))
+
+	if w := do(gw, "GET", "/v1/tokens/t1", "", ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("no token => %d", w.Code)
+	}
+	if w := do(gw, "GET", "/v1/tokens/t1", "wrong", ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("wrong token => %d", w.Code)
+	}
+
+	// burst of 2
+	gw.limiters["billing"], _ = fcm.NewRateLimiter(100, 2)
+	codes := []int{}
+	for i := 0; i < 3; i++ {
+		codes = append(codes, do(gw, "GET", "/v1/tokens/t1", "secret", "").Code)
+	}
+	if fmt.Sprint(codes) != "[200 200 429]" {
+		t.Fatalf("codes => %v", codes)
+	}
+}
+
+func TestGatewayTopicAndInfo(t *testing.T) {
+	gw, _ := newTestGateway(t, new(fakeFcm))
+
+	w := do(gw, "POST", "/v1/topics/news/subscribe", "secret", `{"tokens":["t1","bad2"]}`)
+	out := new(topicResponse)
+	json.Unmarshal(w.Body.Bytes(), out)
+	if w.Code != http.StatusOK || out.Success != 1 || out.Results[1].Error != "NOT_FOUND" {
+		t.Fatalf("subscribe => %d %s", w.Code, w.Body)
+	}
+
+	w = do(gw, "GET", "/v1/tokens/t1?details=true", "secret", "")
+	info := new(fcm.InstanceIdInfoResponse)
+	json.Unmarshal(w.Body.Bytes(), info)
+	if w.Code != http.StatusOK || info.Platform != "ANDROID" {
+		t.Fatalf("info => %d %s", w.Code, w.Body)
+	}
+
+	if w := do(gw, "GET", "/v1/tokens/bad1", "secret", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("unknown token info => %d %s", w.Code, w.Body)
+	}
+	if w := do(gw, "GET", "/v1/tokens/revoked", "secret", ""); w.Code != http.StatusBadGateway {
+		t.Fatalf("refused info => %d %s", w.Code, w.Body)
+	}
+}
+
+func TestGatewayOpenapi(t *testing.T) {
+	gw, _ := newTestGateway(t, new(fakeFcm))
+
+	w := do(gw, "GET", "/openapi.json", "", "")
+	doc := make(map[string]interface{})
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil || doc["openapi"] != "3.0.3" {
+		t.Fatalf("openapi => %d %v", w.Code, err)
+	}
+}
+
+func TestReadClients(t *testing.T) {
+	clients, err := readClients(strings.NewReader("# name token\nbilling secret\n\nsearch s3cret\n"))
+	if err != nil || len(clients) != 2 || clients["s3cret"] != "search" {
+		t.Fatalf("clients => %v, %v", clients, err)
+	}
+	if _, err := readClients(strings.NewReader("billing secret\nsearch secret\n")); err == nil {
+		t.Fatal("duplicate tokens should be refused")
+	}
+}
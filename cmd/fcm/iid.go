@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"sort"
+	"strconv"
+
+	"github.com/NaySoftware/go-fcm"
+)
+
+// infoOutput the info of a single token
+type infoOutput struct {
+	Token string                      `json:"token"`
+	Info  *fcm.InstanceIdInfoResponse `json:"info"`
+}
+
+// runInfo gets the instance id info of the tokens
+func runInfo(a *app, args []string) error {
+	var tokens tokensFlag
+
+	flags := flag.NewFlagSet("info", flag.ContinueOnError)
+	flags.Var(&tokens, "token", "registration token (repeatable)")
+	tokensFile := flags.String("tokens-file", "", "file with one token per line, - for stdin")
+	details := flags.Bool("details", true, "include the topics subscriptions")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	list, err := collectTokens(tokens, *tokensFile, flags.Args())
+	if err != nil {
+		return err
+	}
+
+	var out []infoOutput
+	var rows [][]string
+
+	for _, token := range list {
+		info, err := a.client.GetInfo(*details, token)
+		if err != nil {
+			return err
+		}
+		out = append(out, infoOutput{Token: token, Info: info})
+
+		var topicNames []string
+		for topic := range info.Rel["topics"] {
+			topicNames = append(topicNames, topic)
+		}
+		sort.Strings(topicNames)
+
+		rows = append(rows, []string{
+			token, info.Application, info.Platform, info.ApplicationVersion,
+			strconv.Itoa(len(topicNames)), joinLimit(topicNames, 5), info.Error,
+		})
+	}
+
+	return a.print(out, []string{"TOKEN", "APPLICATION", "PLATFORM", "VERSION", "TOPICS", "TOPIC NAMES", "ERROR"}, rows)
+}
+
+// runSubscribe subscribes tokens to a topic
+func runSubscribe(a *app, args []string) error {
+	return runTopic(a, "subscribe", args)
+}
+
+// runUnsubscribe unsubscribes tokens from a topic
+func runUnsubscribe(a *app, args []string) error {
+	return runTopic(a, "unsubscribe", args)
+}
+
+// topicOutput the outcome of a single token
+type topicOutput struct {
+	Token string `json:"token"`
+	Error string `json:"error,omitempty"`
+}
+
+// runTopic subscribes/unsubscribes the tokens, a single token is
+// subscribed with SubscribeToTopic, many with the batch requests
+func runTopic(a *app, name string, args []string) error {
+	var tokens tokensFlag
+
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.Var(&tokens, "token", "registration token (repeatable)")
+	tokensFile := flags.String("tokens-file", "", "file with one token per line, - for stdin")
+	topic := flags.String("topic", "", "topic name")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *topic == "" {
+		return errors.New("missing -topic")
+	}
+
+	list, err := collectTokens(tokens, *tokensFile, flags.Args())
+	if err != nil {
+		return err
+	}
+
+	var out []topicOutput
+
+	if name == "subscribe" && len(list) == 1 {
+		resp, err := a.client.SubscribeToTopic(list[0], *topic)
+		if err != nil {
+			return err
+		}
+		out = append(out, topicOutput{Token: list[0], Error: resp.Error})
+	} else {
+		var resp *fcm.BatchResponse
+		if name == "subscribe" {
+			resp, err = a.client.BatchSubscribeToTopic(list, *topic)
+		} else {
+			resp, err = a.client.BatchUnsubscribeFromTopic(list, *topic)
+		}
+		if err != nil {
+			return err
+		}
+		for i, token := range list {
+			res := topicOutput{Token: token}
+			if i < len(resp.Results) {
+				res.Error = resp.Results[i]["error"]
+			}
+			out = append(out, res)
+		}
+	}
+
+	rows := make([][]string, 0, len(out))
+	for _, res := range out {
+		status := "OK"
+		if res.Error != "" {
+			status = res.Error
+		}
+		rows = append(rows, []string{res.Token, status})
+	}
+
+	return a.print(out, []string{"TOKEN", "STATUS"}, rows)
+}
+
+// runApnsImport creates registration tokens for apns tokens
+func runApnsImport(a *app, args []string) error {
+	var tokens tokensFlag
+
+	flags := flag.NewFlagSet("apns-import", flag.ContinueOnError)
+	flags.Var(&tokens, "token", "apns token (repeatable)")
+	tokensFile := flags.String("tokens-file", "", "file with one apns token per line, - for stdin")
+	application := flags.String("app", "", "bundle id of the app")
+	sandbox := flags.Bool("sandbox", false, "apns sandbox tokens")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *application == "" {
+		return errors.New("missing -app")
+	}
+
+	list, err := collectTokens(tokens, *tokensFile, flags.Args())
+	if err != nil {
+		return err
+	}
+
+	resp, err := a.client.ApnsBatchImportRequest(&fcm.ApnsBatchRequest{
+		App:        *application,
+		Sandbox:    *sandbox,
+		ApnsTokens: list,
+	})
+	if err != nil {
+		return err
+	}
+
+	rows := make([][]string, 0, len(resp.Results))
+	for _, val := range resp.Results {
+		rows = append(rows, []string{val["apns_token"], val["status"], val["registration_token"]})
+	}
+
+	return a.print(resp, []string{"APNS TOKEN", "STATUS", "REGISTRATION TOKEN"}, rows)
+}
+
+// joinLimit joins at most n names, with an ellipsis for the rest
+func joinLimit(names []string, n int) string {
+	s := ""
+	for i, name := range names {
+		if i == n {
+			return s + ",..."
+		}
+		if i > 0 {
+			s += ","
+		}
+		s += name
+	}
+	return s
+}
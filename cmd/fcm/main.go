@@ -0,0 +1,200 @@
+// Command fcm sends messages and manages instance ids from the shell.
+//
+//	fcm [-key KEY] [-output table|json] <command> [flags]
+//
+// Commands:
+//
+//	send         send a message to a token, a token file, a topic or a condition
+//	info         get the instance id info of tokens
+//	subscribe    subscribe tokens to a topic
+//	unsubscribe  unsubscribe tokens from a topic
+//	apns-import  create registration tokens for apns tokens
+//	validate     check tokens with a dry run send
+//
+// The server key is read from the -key flag or the FCM_SERVER_KEY
+// environment variable.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/NaySoftware/go-fcm"
+)
+
+const (
+	// server_key_env environment variable holding the server key
+	server_key_env = "FCM_SERVER_KEY"
+
+	output_table = "table"
+	output_json  = "json"
+)
+
+// command a sub command of the cli
+type command struct {
+	name  string
+	usage string
+	run   func(app *app, args []string) error
+}
+
+// app the global state of the cli
+type app struct {
+	client *fcm.FcmClient
+	output string
+	stdout io.Writer
+}
+
+var commands = []command{
+	{"send", "send a message to a token, a token file, a topic or a condition", runSend},
+	{"info", "get the instance id info of tokens", runInfo},
+	{"subscribe", "subscribe tokens to a topic", runSubscribe},
+	{"unsubscribe", "unsubscribe tokens from a topic", runUnsubscribe},
+	{"apns-import", "create registration tokens for apns tokens", runApnsImport},
+	{"validate", "check tokens with a dry run send", runValidate},
+}
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "fcm:", err)
+		os.Exit(1)
+	}
+}
+
+// run parses the global flags and runs the sub command
+func run(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("fcm", flag.ContinueOnError)
+	key := flags.String("key", "", "server key (default $"+server_key_env+")")
+	output := flags.String("output", output_table, "output format: table or json")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: fcm [-key KEY] [-output table|json] <command> [flags]")
+		flags.PrintDefaults()
+		fmt.Fprintln(flags.Output(), "\ncommands:")
+		for _, c := range commands {
+			fmt.Fprintf(flags.Output(), "  %-12s %s\n", c.name, c.usage)
+		}
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return errors.New("missing command")
+	}
+
+	if *output != output_table && *output != output_json {
+		return fmt.Errorf("unknown output format %q", *output)
+	}
+
+	if *key == "" {
+		*key = os.Getenv(server_key_env)
+	}
+	if *key == "" {
+		return fmt.Errorf("missing server key, use -key or $%s", server_key_env)
+	}
+
+	a := &app{
+		client: fcm.NewFcmClient(*key),
+		output: *output,
+		stdout: stdout,
+	}
+
+	name := flags.Arg(0)
+	for _, c := range commands {
+		if c.name == name {
+			return c.run(a, flags.Args()[1:])
+		}
+	}
+
+	return fmt.Errorf("unknown command %q", name)
+}
+
+// print writes v as json, or as a table of rows with the given header
+func (this *app) print(v interface{}, header []string, rows [][]string) error {
+	if this.output == output_json {
+		enc := json.NewEncoder(this.stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+
+	w := tabwriter.NewWriter(this.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	return w.Flush()
+}
+
+// tokensFlag a repeatable -token flag
+type tokensFlag []string
+
+func (this *tokensFlag) String() string {
+	return strings.Join(*this, ",")
+}
+
+func (this *tokensFlag) Set(v string) error {
+	*this = append(*this, v)
+	return nil
+}
+
+// collectTokens returns the tokens of the flags, the file and the args
+func collectTokens(flagTokens []string, file string, args []string) ([]string, error) {
+	tokens := append([]string{}, flagTokens...)
+
+	if file != "" {
+		fileTokens, err := readTokensFile(file)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, fileTokens...)
+	}
+
+	tokens = append(tokens, args...)
+
+	if len(tokens) == 0 {
+		return nil, errors.New("no tokens, use -token, -tokens-file or arguments")
+	}
+
+	return tokens, nil
+}
+
+// readTokensFile reads one token per line, empty lines and lines
+// starting with # are skipped, "-" reads from stdin
+func readTokensFile(name string) ([]string, error) {
+	var r io.Reader = os.Stdin
+
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	return readTokens(r)
+}
+
+// readTokens reads one token per line
+func readTokens(r io.Reader) ([]string, error) {
+	var tokens []string
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		tokens = append(tokens, line)
+	}
+
+	return tokens, scanner.Err()
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/NaySoftware/go-fcm"
+)
+
+func TestReadTokens(t *testing.T) {
+	tokens, err := readTokens(strings.NewReader("token0\n\n# comment\n  token1  \n"))
+	if err != nil {
+		t.Fatal("Read Error: ", err)
+	}
+	if len(tokens) != 2 || tokens[1] != "token1" {
+		t.Error("Wrong tokens: ", tokens)
+	}
+}
+
+func TestMessageFromFileAndFlags(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "msg.json")
+	ioutil.WriteFile(file, []byte(`{"notification":{"title":"From file","body":"Body"},"data":{"a":"1"},"priority":"normal"}`), 0600)
+
+	opts := &sendOptions{
+		messageFile: file,
+		title:       "From flag",
+		data:        dataFlag{"b": "2"},
+		priority:    "high",
+		ttl:         fcm.MAX_TTL + 1,
+		dryRun:      true,
+	}
+
+	msg, err := opts.message()
+	if err != nil {
+		t.Fatal("Message Error: ", err)
+	}
+
+	if msg.Notification.Title != "From flag" || msg.Notification.Body != "Body" {
+		t.Error("Wrong notification: ", msg.Notification)
+	}
+	data := msg.Data.(map[string]interface{})
+	if data["a"] != "1" || data["b"] != "2" {
+		t.Error("Wrong data: ", data)
+	}
+	if msg.Priority != fcm.Priority_HIGH || msg.TimeToLive != fcm.MAX_TTL || !msg.DryRun {
+		t.Error("Wrong options: ", msg.Priority, msg.TimeToLive, msg.DryRun)
+	}
+
+	opts = &sendOptions{priority: "urgent"}
+	if _, err := opts.message(); err == nil {
+		t.Error("Expected an invalid priority error")
+	}
+}
+
+func TestDataFlag(t *testing.T) {
+	d := make(dataFlag)
+	if err := d.Set("k=v=w"); err != nil || d["k"] != "v=w" {
+		t.Error("Wrong data flag: ", d, err)
+	}
+	if err := d.Set("novalue"); err == nil {
+		t.Error("Expected an invalid data error")
+	}
+}
+
+func TestSendOutputAdd(t *testing.T) {
+	out := new(sendOutput)
+	out.add(&fcm.FcmResponseStatus{
+		Ok:         true,
+		StatusCode: 200,
+		Success:    1,
+		Fail:       1,
+		Results: []map[string]string{
+			{"message_id": "0:1", "registration_id": "token9"},
+			{"error": "NotRegistered"},
+		},
+	}, []string{"token0", "token1"})
+
+	if out.Success != 1 || out.Failure != 1 || out.Results[1].Token != "token1" || out.Results[0].RegistrationId != "token9" {
+		t.Error("Wrong output: ", out)
+	}
+
+	buf := new(bytes.Buffer)
+	a := &app{output: output_table, stdout: buf}
+	a.printSendOutput(out)
+
+	if !strings.Contains(buf.String(), "token1") || !strings.Contains(buf.String(), "NotRegistered") {
+		t.Error("Wrong table: ", buf.String())
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	os.Unsetenv(server_key_env)
+
+	if err := run([]string{"send"}, ioutil.Discard); err == nil || !strings.Contains(err.Error(), "server key") {
+		t.Error("Expected a missing key error, got ", err)
+	}
+	if err := run([]string{"-key", "k", "nope"}, ioutil.Discard); err == nil {
+		t.Error("Expected an unknown command error")
+	}
+	if err := run([]string{"-key", "k", "-output", "xml", "info"}, ioutil.Discard); err == nil {
+		t.Error("Expected an unknown output error")
+	}
+	if err := run([]string{"-key", "k", "send", "-title", "t"}, ioutil.Discard); err == nil || !strings.Contains(err.Error(), "missing target") {
+		t.Error("Expected a missing target error, got ", err)
+	}
+	if err := run([]string{"-key", "k", "send", "-topic", "a", "-condition", "b"}, ioutil.Discard); err == nil {
+		t.Error("Expected a target conflict error")
+	}
+}
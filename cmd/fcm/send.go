@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/NaySoftware/go-fcm"
+)
+
+const (
+	// max_registration_ids max number of tokens of a multicast message
+	max_registration_ids = 1000
+)
+
+// dataFlag a repeatable key=value -data flag
+type dataFlag map[string]string
+
+func (this dataFlag) String() string {
+	pairs := make([]string, 0, len(this))
+	for k, v := range this {
+		pairs = append(pairs, k+"="+v)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (this dataFlag) Set(v string) error {
+	kv := strings.SplitN(v, "=", 2)
+	if len(kv) != 2 || kv[0] == "" {
+		return fmt.Errorf("invalid data %q, expected key=value", v)
+	}
+	this[kv[0]] = kv[1]
+	return nil
+}
+
+// sendOptions the flags of the send command
+type sendOptions struct {
+	tokens      tokensFlag
+	tokensFile  string
+	topic       string
+	condition   string
+	messageFile string
+	title       string
+	body        string
+	icon        string
+	sound       string
+	clickAction string
+	data        dataFlag
+	priority    string
+	ttl         int
+	collapseKey string
+	dryRun      bool
+}
+
+// tokenResult the outcome of a single token
+type tokenResult struct {
+	Token          string `json:"token,omitempty"`
+	MessageId      string `json:"message_id,omitempty"`
+	RegistrationId string `json:"registration_id,omitempty"`
+	Error          string `json:"error,omitempty"`
+}
+
+// sendOutput the output of the send and validate commands
+type sendOutput struct {
+	StatusCode int           `json:"status_code"`
+	Success    int           `json:"success"`
+	Failure    int           `json:"failure"`
+	Results    []tokenResult `json:"results"`
+}
+
+// runSend sends a message built from the flags and/or a json file
+func runSend(a *app, args []string) error {
+	opts := &sendOptions{data: make(dataFlag)}
+
+	flags := flag.NewFlagSet("send", flag.ContinueOnError)
+	flags.Var(&opts.tokens, "token", "registration token (repeatable)")
+	flags.StringVar(&opts.tokensFile, "tokens-file", "", "file with one token per line, - for stdin")
+	flags.StringVar(&opts.topic, "topic", "", "topic name")
+	flags.StringVar(&opts.condition, "condition", "", "topics condition, e.g. \"'a' in topics && 'b' in topics\"")
+	flags.StringVar(&opts.messageFile, "message", "", "json file with the message (legacy http format), flags override it")
+	flags.StringVar(&opts.title, "title", "", "notification title")
+	flags.StringVar(&opts.body, "body", "", "notification body")
+	flags.StringVar(&opts.icon, "icon", "", "notification icon")
+	flags.StringVar(&opts.sound, "sound", "", "notification sound")
+	flags.StringVar(&opts.clickAction, "click-action", "", "notification click action")
+	flags.Var(opts.data, "data", "data payload key=value (repeatable)")
+	flags.StringVar(&opts.priority, "priority", "", "high or normal")
+	flags.IntVar(&opts.ttl, "ttl", 0, "time to live in seconds")
+	flags.StringVar(&opts.collapseKey, "collapse-key", "", "collapse key")
+	flags.BoolVar(&opts.dryRun, "dry-run", false, "validate the request without sending")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	msg, err := opts.message()
+	if err != nil {
+		return err
+	}
+
+	var tokens []string
+	if len(opts.tokens) > 0 || opts.tokensFile != "" {
+		tokens, err = collectTokens(opts.tokens, opts.tokensFile, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	targets := 0
+	for _, set := range []bool{len(tokens) > 0, opts.topic != "", opts.condition != ""} {
+		if set {
+			targets++
+		}
+	}
+	if targets > 1 {
+		return errors.New("use only one of -token/-tokens-file, -topic and -condition")
+	}
+	if targets == 0 && msg.To == "" && msg.Condition == "" && len(msg.RegistrationIds) == 0 {
+		return errors.New("missing target, use -token, -tokens-file, -topic or -condition")
+	}
+
+	switch {
+	case opts.topic != "":
+		msg.To = "/topics/" + strings.TrimPrefix(opts.topic, "/topics/")
+		msg.RegistrationIds = nil
+	case opts.condition != "":
+		msg.Condition = opts.condition
+		msg.To = ""
+		msg.RegistrationIds = nil
+	case len(tokens) > 0:
+		msg.To = ""
+		msg.RegistrationIds = tokens
+	}
+
+	out, err := sendMessage(a.client, msg)
+	if err != nil {
+		return err
+	}
+
+	return a.printSendOutput(out)
+}
+
+// message builds the message from the json file and the flags
+func (this *sendOptions) message() (*fcm.FcmMsg, error) {
+	msg := new(fcm.FcmMsg)
+
+	if this.messageFile != "" {
+		data, err := ioutil.ReadFile(this.messageFile)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, msg); err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", this.messageFile, err)
+		}
+	}
+
+	setString := func(dst *string, v string) {
+		if v != "" {
+			*dst = v
+		}
+	}
+	setString(&msg.Notification.Title, this.title)
+	setString(&msg.Notification.Body, this.body)
+	setString(&msg.Notification.Icon, this.icon)
+	setString(&msg.Notification.Sound, this.sound)
+	setString(&msg.Notification.ClickAction, this.clickAction)
+	setString(&msg.CollapseKey, this.collapseKey)
+
+	if len(this.data) > 0 {
+		data := make(map[string]interface{})
+		if existing, ok := msg.Data.(map[string]interface{}); ok {
+			for k, v := range existing {
+				data[k] = v
+			}
+		}
+		for k, v := range this.data {
+			data[k] = v
+		}
+		msg.Data = data
+	}
+
+	switch this.priority {
+	case "":
+	case fcm.Priority_HIGH, fcm.Priority_NORMAL:
+		msg.Priority = this.priority
+	default:
+		return nil, fmt.Errorf("invalid priority %q, expected high or normal", this.priority)
+	}
+
+	if this.ttl > 0 {
+		msg.TimeToLive = this.ttl
+		if msg.TimeToLive > fcm.MAX_TTL {
+			msg.TimeToLive = fcm.MAX_TTL
+		}
+	}
+
+	if this.dryRun {
+		msg.DryRun = true
+	}
+
+	return msg, nil
+}
+
+// sendMessage sends the message, multicast messages are split into
+// requests of max_registration_ids tokens
+func sendMessage(client *fcm.FcmClient, msg *fcm.FcmMsg) (*sendOutput, error) {
+	out := new(sendOutput)
+
+	if len(msg.RegistrationIds) == 0 {
+		client.Message = *msg
+		status, err := client.Send()
+		if err != nil {
+			return nil, err
+		}
+		out.add(status, []string{msg.To})
+		return out, nil
+	}
+
+	tokens := msg.RegistrationIds
+	for start := 0; start < len(tokens); start += max_registration_ids {
+		end := start + max_registration_ids
+		if end > len(tokens) {
+			end = len(tokens)
+		}
+
+		client.Message = *msg
+		client.Message.RegistrationIds = tokens[start:end]
+
+		status, err := client.Send()
+		if err != nil {
+			return nil, err
+		}
+		out.add(status, tokens[start:end])
+	}
+
+	return out, nil
+}
+
+// add appends the results of a response, aligned with the tokens
+func (this *sendOutput) add(status *fcm.FcmResponseStatus, tokens []string) {
+	if this.StatusCode == 0 || status.StatusCode != 200 {
+		this.StatusCode = status.StatusCode
+	}
+
+	if !status.Ok {
+		for _, token := range tokens {
+			this.Results = append(this.Results, tokenResult{Token: token, Error: fmt.Sprintf("http %d", status.StatusCode)})
+			this.Failure++
+		}
+		return
+	}
+
+	if len(status.Results) == 0 {
+		// topic or condition
+		res := tokenResult{Token: tokens[0], Error: status.Err}
+		if status.MsgId != 0 {
+			res.MessageId = strconv.FormatInt(status.MsgId, 10)
+			this.Success++
+		} else {
+			this.Failure++
+		}
+		this.Results = append(this.Results, res)
+		return
+	}
+
+	this.Success += status.Success
+	this.Failure += status.Fail
+
+	for i, val := range status.Results {
+		res := tokenResult{
+			MessageId:      val["message_id"],
+			RegistrationId: val["registration_id"],
+			Error:          val["error"],
+		}
+		if i < len(tokens) {
+			res.Token = tokens[i]
+		}
+		this.Results = append(this.Results, res)
+	}
+}
+
+// printSendOutput prints the send/validate results
+func (this *app) printSendOutput(out *sendOutput) error {
+	rows := make([][]string, 0, len(out.Results))
+	for _, res := range out.Results {
+		rows = append(rows, []string{res.Token, res.MessageId, res.RegistrationId, res.Error})
+	}
+	return this.print(out, []string{"TARGET", "MESSAGE ID", "CANONICAL ID", "ERROR"}, rows)
+}
+
+// runValidate sends a dry run message to the tokens, invalid tokens
+// are reported with their error
+func runValidate(a *app, args []string) error {
+	var tokens tokensFlag
+
+	flags := flag.NewFlagSet("validate", flag.ContinueOnError)
+	flags.Var(&tokens, "token", "registration token (repeatable)")
+	tokensFile := flags.String("tokens-file", "", "file with one token per line, - for stdin")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	list, err := collectTokens(tokens, *tokensFile, flags.Args())
+	if err != nil {
+		return err
+	}
+
+	msg := &fcm.FcmMsg{
+		RegistrationIds: list,
+		DryRun:          true,
+	}
+
+	out, err := sendMessage(a.client, msg)
+	if err != nil {
+		return err
+	}
+
+	return a.printSendOutput(out)
+}
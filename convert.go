@@ -0,0 +1,332 @@
+package fcm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// max_apns_collapse_id max size of the apns-collapse-id header
+	max_apns_collapse_id = 64
+)
+
+var (
+	// reservedDataKeys data keys rejected by fcm
+	reservedDataKeys = []string{"from", "message_type", "collapse_key"}
+	// reservedDataPrefixes data key prefixes rejected by fcm
+	reservedDataPrefixes = []string{"google.", "gcm."}
+)
+
+// IsReservedDataKey reports whether fcm rejects key in the data of a
+// message: from, message_type, collapse_key and the google. and gcm.
+// prefixes
+func IsReservedDataKey(key string) bool {
+	for _, reserved := range reservedDataKeys {
+		if key == reserved {
+			return true
+		}
+	}
+	for _, prefix := range reservedDataPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// ConversionIssue a field of a legacy message that could not be
+// represented (or not exactly) in the v1 message
+type ConversionIssue struct {
+	Field  string
+	Reason string
+}
+
+// V1Conversion the v1 messages of a legacy message, a multicast message
+// is fanned out into one message per token, in the same order
+type V1Conversion struct {
+	Messages []*V1Message
+	// ValidateOnly the legacy dry_run, set on the v1 send request
+	ValidateOnly bool
+	Issues       []ConversionIssue
+}
+
+// ConvertToV1 converts a legacy FcmMsg to v1 messages. Fields without a v1
+// equivalent are reported in Issues, an error is returned only if the
+// message has no target. A To that is not a topic is taken as a token
+// (device group notification keys have no v1 equivalent)
+func ConvertToV1(msg *FcmMsg) (*V1Conversion, error) {
+
+	conv := &V1Conversion{ValidateOnly: msg.DryRun}
+
+	bodyLocArgs := conv.convertLocArgs("notification.body_loc_args", msg.Notification.BodyLocArgs)
+	titleLocArgs := conv.convertLocArgs("notification.title_loc_args", msg.Notification.TitleLocArgs)
+
+	base := new(V1Message)
+	base.Data = conv.convertData(msg.Data)
+	base.Notification = convertNotification(&msg.Notification)
+	base.Android = conv.convertAndroid(msg, bodyLocArgs, titleLocArgs)
+	base.Apns = conv.convertApns(msg, bodyLocArgs, titleLocArgs)
+	base.Webpush = conv.convertWebpush(msg)
+
+	if msg.DelayWhileIdle {
+		conv.issue("delay_while_idle", "deprecated, no v1 equivalent")
+	}
+
+	targets := 0
+	for _, set := range []bool{msg.To != "", len(msg.RegistrationIds) > 0, msg.Condition != ""} {
+		if set {
+			targets++
+		}
+	}
+	if targets == 0 {
+		return nil, errors.New("fcm: message has no target (to, registration_ids or condition)")
+	}
+	if targets > 1 {
+		conv.issue("to", "more than one target set, registration_ids is used before to, and to before condition")
+	}
+
+	switch {
+	case len(msg.RegistrationIds) > 0:
+		for _, token := range msg.RegistrationIds {
+			m := base.copy()
+			m.Token = token
+			conv.Messages = append(conv.Messages, m)
+		}
+	case strings.HasPrefix(strings.ToLower(msg.To), topics):
+		base.Topic = extractTopicName(msg.To)
+		conv.Messages = append(conv.Messages, base)
+	case msg.To != "":
+		base.Token = msg.To
+		conv.Messages = append(conv.Messages, base)
+	default:
+		base.Condition = msg.Condition
+		conv.Messages = append(conv.Messages, base)
+	}
+
+	return conv, nil
+}
+
+// issue records a conversion issue
+func (this *V1Conversion) issue(field string, reason string, args ...interface{}) {
+	this.Issues = append(this.Issues, ConversionIssue{Field: field, Reason: fmt.Sprintf(reason, args...)})
+}
+
+// convertData converts the legacy data payload to string values, non string
+// values are json encoded
+func (this *V1Conversion) convertData(data interface{}) map[string]string {
+	if data == nil {
+		return nil
+	}
+
+	raw, err := json.Marshal(data)
+	if err != nil {
+		this.issue("data", "cannot be encoded: %v", err)
+		return nil
+	}
+
+	var values map[string]interface{}
+	if err := json.Unmarshal(raw, &values); err != nil {
+		this.issue("data", "is not a json object, dropped")
+		return nil
+	}
+	if len(values) == 0 {
+		return nil
+	}
+
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	result := make(map[string]string, len(values))
+	for _, k := range keys {
+		if IsReservedDataKey(k) {
+			this.issue("data."+k, "reserved key, rejected by fcm")
+		}
+
+		switch v := values[k].(type) {
+		case string:
+			result[k] = v
+		default:
+			encoded, _ := json.Marshal(v)
+			result[k] = string(encoded)
+			this.issue("data."+k, "non string value encoded as a json string")
+		}
+	}
+
+	return result
+}
+
+// convertNotification keeps the cross platform notification fields
+func convertNotification(n *NotificationPayload) *V1Notification {
+	if n.Title == "" && n.Body == "" {
+		return nil
+	}
+	return &V1Notification{Title: n.Title, Body: n.Body}
+}
+
+// convertAndroid maps the options and notification fields of android
+func (this *V1Conversion) convertAndroid(msg *FcmMsg, bodyLocArgs []string, titleLocArgs []string) *AndroidConfig {
+	android := &AndroidConfig{
+		CollapseKey:           msg.CollapseKey,
+		RestrictedPackageName: msg.RestrictedPackageName,
+	}
+
+	switch msg.Priority {
+	case Priority_HIGH:
+		android.Priority = android_priority_high
+	case Priority_NORMAL:
+		android.Priority = android_priority_normal
+	case "":
+	default:
+		this.issue("priority", "unknown priority %q, dropped", msg.Priority)
+	}
+
+	if msg.TimeToLive > 0 {
+		android.Ttl = strconv.Itoa(msg.TimeToLive) + "s"
+	}
+
+	n := &msg.Notification
+	if n.Icon != "" || n.Color != "" || n.Sound != "" || n.Tag != "" || n.ClickAction != "" ||
+		n.BodyLocKey != "" || n.TitleLocKey != "" || n.AndroidChannelID != "" {
+		android.Notification = &AndroidNotification{
+			Icon:         n.Icon,
+			Color:        n.Color,
+			Sound:        n.Sound,
+			Tag:          n.Tag,
+			ClickAction:  n.ClickAction,
+			BodyLocKey:   n.BodyLocKey,
+			BodyLocArgs:  bodyLocArgs,
+			TitleLocKey:  n.TitleLocKey,
+			TitleLocArgs: titleLocArgs,
+			ChannelId:    n.AndroidChannelID,
+		}
+	}
+
+	if android.CollapseKey == "" && android.Priority == "" && android.Ttl == "" &&
+		android.RestrictedPackageName == "" && android.Notification == nil {
+		return nil
+	}
+
+	return android
+}
+
+// convertApns maps the options and notification fields of apns
+func (this *V1Conversion) convertApns(msg *FcmMsg, bodyLocArgs []string, titleLocArgs []string) *ApnsConfig {
+	headers := make(map[string]string)
+
+	switch msg.Priority {
+	case Priority_HIGH:
+		headers[apns_priority_header] = apns_priority_high
+	case Priority_NORMAL:
+		headers[apns_priority_header] = apns_priority_normal
+	}
+
+	if msg.CollapseKey != "" {
+		if len(msg.CollapseKey) > max_apns_collapse_id {
+			this.issue("collapse_key", "longer than %d bytes, not set as apns-collapse-id", max_apns_collapse_id)
+		} else {
+			headers[apns_collapse_id_header] = msg.CollapseKey
+		}
+	}
+
+	if msg.TimeToLive > 0 {
+		this.issue("time_to_live", "apns-expiration needs an absolute time, set it when sending")
+	}
+
+	n := &msg.Notification
+	aps := &Aps{
+		Sound:    n.Sound,
+		Category: n.ClickAction,
+	}
+	if msg.ContentAvailable {
+		aps.ContentAvailable = 1
+	}
+	if msg.MutableContent {
+		aps.MutableContent = 1
+	}
+
+	if n.Badge != "" {
+		badge, err := strconv.Atoi(n.Badge)
+		if err != nil {
+			this.issue("notification.badge", "not a number, dropped")
+		} else {
+			aps.Badge = &badge
+		}
+	}
+
+	if n.BodyLocKey != "" || n.TitleLocKey != "" {
+		aps.Alert = &ApsAlert{
+			Title:        n.Title,
+			Body:         n.Body,
+			LocKey:       n.BodyLocKey,
+			LocArgs:      bodyLocArgs,
+			TitleLocKey:  n.TitleLocKey,
+			TitleLocArgs: titleLocArgs,
+		}
+	}
+
+	config := new(ApnsConfig)
+	if len(headers) > 0 {
+		config.Headers = headers
+	}
+	if (*aps != Aps{}) {
+		config.Payload = &ApnsPayload{Aps: aps}
+	}
+
+	if config.Headers == nil && config.Payload == nil {
+		return nil
+	}
+
+	return config
+}
+
+// convertWebpush maps the ttl, icon and click action for web clients
+func (this *V1Conversion) convertWebpush(msg *FcmMsg) *WebpushConfig {
+	webpush := new(WebpushConfig)
+
+	if msg.TimeToLive > 0 {
+		webpush.Headers = map[string]string{webpush_ttl_header: strconv.Itoa(msg.TimeToLive)}
+	}
+
+	if msg.Notification.Icon != "" {
+		webpush.Notification = map[string]interface{}{"icon": msg.Notification.Icon}
+	}
+
+	if strings.HasPrefix(msg.Notification.ClickAction, "https://") {
+		webpush.FcmOptions = &WebpushFcmOptions{Link: msg.Notification.ClickAction}
+	}
+
+	if webpush.Headers == nil && webpush.Notification == nil && webpush.FcmOptions == nil {
+		return nil
+	}
+
+	return webpush
+}
+
+// convertLocArgs converts the legacy json array string to a list
+func (this *V1Conversion) convertLocArgs(field string, args string) []string {
+	if args == "" {
+		return nil
+	}
+
+	var list []string
+	if err := json.Unmarshal([]byte(args), &list); err != nil {
+		this.issue(field, "not a json array of strings, used as a single argument")
+		return []string{args}
+	}
+
+	return list
+}
+
+// copy returns a copy of the message, for fanning out, the nested
+// configs are shared and must not be changed
+func (this *V1Message) copy() *V1Message {
+	c := *this
+	return &c
+}
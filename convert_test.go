@@ -0,0 +1,165 @@
+package fcm
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestConvertToV1Multicast(t *testing.T) {
+	msg := &FcmMsg{
+		RegistrationIds: []string{"token0", "token1"},
+		Data: map[string]interface{}{
+			"msg":   "Hello World",
+			"count": 3,
+		},
+		CollapseKey:      "updates",
+		Priority:         Priority_HIGH,
+		TimeToLive:       3600,
+		ContentAvailable: true,
+		MutableContent:   true,
+		DelayWhileIdle:   true,
+		DryRun:           true,
+		Notification: NotificationPayload{
+			Title:            "Title",
+			Body:             "Body",
+			Sound:            "default",
+			Badge:            "2",
+			Color:            "#ff0000",
+			BodyLocKey:       "BODY_KEY",
+			BodyLocArgs:      `["a","b"]`,
+			AndroidChannelID: "news",
+		},
+	}
+
+	conv, err := ConvertToV1(msg)
+	if err != nil {
+		t.Fatal("Conversion Error: ", err)
+	}
+
+	if len(conv.Messages) != 2 || conv.Messages[0].Token != "token0" || conv.Messages[1].Token != "token1" {
+		t.Fatal("Expected a message per token")
+	}
+	if !conv.ValidateOnly {
+		t.Error("Expected dry_run to be converted to validate_only")
+	}
+
+	m := conv.Messages[1]
+	if m.Data["msg"] != "Hello World" || m.Data["count"] != "3" {
+		t.Error("Wrong data: ", m.Data)
+	}
+	if m.Notification.Title != "Title" || m.Notification.Body != "Body" {
+		t.Error("Wrong notification: ", m.Notification)
+	}
+	if m.Android.Priority != "HIGH" || m.Android.Ttl != "3600s" || m.Android.CollapseKey != "updates" {
+		t.Error("Wrong android config: ", m.Android)
+	}
+	if m.Android.Notification.ChannelId != "news" || len(m.Android.Notification.BodyLocArgs) != 2 {
+		t.Error("Wrong android notification: ", m.Android.Notification)
+	}
+	if m.Apns.Headers["apns-priority"] != "10" || m.Apns.Headers["apns-collapse-id"] != "updates" {
+		t.Error("Wrong apns headers: ", m.Apns.Headers)
+	}
+
+	aps := m.Apns.Payload.Aps
+	if aps.ContentAvailable != 1 || aps.MutableContent != 1 || *aps.Badge != 2 || aps.Alert.LocKey != "BODY_KEY" {
+		t.Error("Wrong aps: ", aps)
+	}
+	if m.Webpush.Headers["TTL"] != "3600" {
+		t.Error("Wrong webpush headers: ", m.Webpush.Headers)
+	}
+
+	fields := make(map[string]bool)
+	for _, issue := range conv.Issues {
+		fields[issue.Field] = true
+	}
+	for _, field := range []string{"data.count", "delay_while_idle", "time_to_live"} {
+		if !fields[field] {
+			t.Error("Missing issue for ", field)
+		}
+	}
+	if len(conv.Issues) != 3 {
+		t.Error("Unexpected issues: ", conv.Issues)
+	}
+
+	raw, _ := json.Marshal(&V1SendRequest{ValidateOnly: conv.ValidateOnly, Message: m})
+	if !strings.Contains(string(raw), `"content-available":1`) || !strings.Contains(string(raw), `"validate_only":true`) {
+		t.Error("Wrong json: ", string(raw))
+	}
+}
+
+func TestConvertToV1Targets(t *testing.T) {
+	conv, err := ConvertToV1(&FcmMsg{To: "/topics/news", Data: map[string]string{"a": "1"}})
+	if err != nil || conv.Messages[0].Topic != "news" || conv.Messages[0].Token != "" {
+		t.Error("Wrong topic conversion: ", conv, err)
+	}
+	if conv.Messages[0].Android != nil || conv.Messages[0].Apns != nil || conv.Messages[0].Webpush != nil {
+		t.Error("Expected no platform configs")
+	}
+
+	conv, err = ConvertToV1(&FcmMsg{To: "token0"})
+	if err != nil || conv.Messages[0].Token != "token0" {
+		t.Error("Wrong token conversion: ", conv, err)
+	}
+
+	conv, err = ConvertToV1(&FcmMsg{Condition: "'a' in topics && 'b' in topics"})
+	if err != nil || conv.Messages[0].Condition != "'a' in topics && 'b' in topics" {
+		t.Error("Wrong condition conversion: ", conv, err)
+	}
+
+	if _, err := ConvertToV1(&FcmMsg{}); err == nil {
+		t.Error("Expected a missing target error")
+	}
+}
+
+func TestConvertToV1Issues(t *testing.T) {
+	conv, err := ConvertToV1(&FcmMsg{
+		To:          "token0",
+		Condition:   "'a' in topics",
+		Data:        []string{"not", "an", "object"},
+		CollapseKey: strings.Repeat("k", 65),
+		Notification: NotificationPayload{
+			Badge:        "many",
+			TitleLocKey:  "TITLE_KEY",
+			TitleLocArgs: "single",
+		},
+	})
+	if err != nil {
+		t.Fatal("Conversion Error: ", err)
+	}
+
+	m := conv.Messages[0]
+	if m.Data != nil || m.Apns.Headers != nil || m.Apns.Payload.Aps.Badge != nil {
+		t.Error("Expected the invalid fields to be dropped")
+	}
+	if m.Apns.Payload.Aps.Alert.TitleLocArgs[0] != "single" {
+		t.Error("Expected the loc args to be used as a single argument")
+	}
+
+	fields := make(map[string]bool)
+	for _, issue := range conv.Issues {
+		fields[issue.Field] = true
+	}
+	for _, field := range []string{"to", "data", "collapse_key", "notification.badge", "notification.title_loc_args"} {
+		if !fields[field] {
+			t.Error("Missing issue for ", field)
+		}
+	}
+}
+
+func TestIsReservedDataKey(t *testing.T) {
+	for key, want := range map[string]bool{
+		"from":          true,
+		"message_type":  true,
+		"collapse_key":  true,
+		"google.c.a.e":  true,
+		"gcm.n.title":   true,
+		"googleMapsUrl": false,
+		"gcmVersion":    false,
+		"fromUser":      false,
+	} {
+		if got := IsReservedDataKey(key); got != want {
+			t.Errorf("IsReservedDataKey(%q) => %v, want %v", key, got, want)
+		}
+	}
+}
@@ -0,0 +1,431 @@
+package fcm
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// fcm_oauth_scope oauth2 scope of the v1 api
+	fcm_oauth_scope = "https://www.googleapis.com/auth/firebase.messaging"
+
+	// jwt_bearer_grant oauth2 grant type of a service account assertion
+	jwt_bearer_grant = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+
+	// token_lifetime lifetime of a service account assertion
+	token_lifetime = time.Hour
+
+	// token_refresh_margin an access token is refreshed this long before it expires
+	token_refresh_margin = time.Minute
+)
+
+// Credentials the server key of the legacy and instance id apis and the
+// oauth2 access token of the v1 api
+type Credentials struct {
+	ApiKey      string
+	AccessToken string
+	ProjectId   string
+}
+
+// CredentialProvider gives the credentials of every request, implementations
+// must be safe for concurrent use. Refresh is called once when the server
+// refuses credentials (401), it returns fresh credentials, or the previous
+// ones while a rotation is in progress, different from rejected
+type CredentialProvider interface {
+	Credentials(ctx context.Context) (*Credentials, error)
+	Refresh(ctx context.Context, rejected *Credentials) (*Credentials, error)
+}
+
+// SetCredentialProvider sets the provider of the credentials, it replaces
+// ApiKey and the access token of SetV1Credentials
+func (this *FcmClient) SetCredentialProvider(p CredentialProvider) *FcmClient {
+
+	this.credentials = p
+
+	return this
+}
+
+// getCredentials returns the credentials of a request
+func (this *FcmClient) getCredentials(ctx context.Context) (*Credentials, error) {
+	if this.credentials == nil {
+		return &Credentials{ApiKey: this.ApiKey, AccessToken: this.accessToken, ProjectId: this.projectId}, nil
+	}
+
+	creds, err := this.credentials.Credentials(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("fcm: loading credentials: %w", err)
+	}
+	return creds, nil
+}
+
+// refreshCredentials returns the credentials to retry a 401 with, or nil
+func (this *FcmClient) refreshCredentials(ctx context.Context, rejected *Credentials) *Credentials {
+	if this.credentials == nil {
+		return nil
+	}
+
+	fresh, err := this.credentials.Refresh(ctx, rejected)
+	if err != nil {
+		this.getLogger().Warn("fcm: refreshing credentials failed", "error", err)
+		return nil
+	}
+	if fresh == nil || *fresh == *rejected {
+		return nil
+	}
+	return fresh
+}
+
+// credentialCache the current and previous credentials of a provider
+type credentialCache struct {
+	mu       sync.Mutex
+	current  *Credentials
+	previous *Credentials
+}
+
+// update makes creds the current credentials, the replaced ones become
+// the previous credentials
+func (this *credentialCache) update(creds *Credentials) *Credentials {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.current == nil || *this.current != *creds {
+		this.previous = this.current
+		this.current = creds
+	}
+	return this.current
+}
+
+// alternative returns the current or previous credentials, the first
+// one different from rejected, nil if none
+func (this *credentialCache) alternative(rejected *Credentials) *Credentials {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	for _, c := range []*Credentials{this.current, this.previous} {
+		if c != nil && (rejected == nil || *c != *rejected) {
+			return c
+		}
+	}
+	return nil
+}
+
+// get returns the current credentials
+func (this *credentialCache) get() *Credentials {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.current
+}
+
+// staticCredentials credentials that never change
+type staticCredentials struct {
+	creds Credentials
+}
+
+// NewStaticCredentials a provider of fixed credentials, accessToken
+// can be empty if the v1 api is not used
+func NewStaticCredentials(apiKey string, accessToken string) CredentialProvider {
+	return &staticCredentials{creds: Credentials{ApiKey: apiKey, AccessToken: accessToken}}
+}
+
+// Credentials returns the fixed credentials
+func (this *staticCredentials) Credentials(ctx context.Context) (*Credentials, error) {
+	creds := this.creds
+	return &creds, nil
+}
+
+// Refresh returns the fixed credentials, a 401 is not retried
+func (this *staticCredentials) Refresh(ctx context.Context, rejected *Credentials) (*Credentials, error) {
+	return this.Credentials(ctx)
+}
+
+// EnvCredentials reads the credentials from environment variables on every request
+type EnvCredentials struct {
+	apiKeyVar      string
+	accessTokenVar string
+	cache          credentialCache
+}
+
+// NewEnvCredentials a provider reading the server key and the access
+// token from the apiKeyVar and accessTokenVar environment variables,
+// accessTokenVar can be empty
+func NewEnvCredentials(apiKeyVar string, accessTokenVar string) *EnvCredentials {
+	return &EnvCredentials{apiKeyVar: apiKeyVar, accessTokenVar: accessTokenVar}
+}
+
+// Credentials returns the credentials of the environment
+func (this *EnvCredentials) Credentials(ctx context.Context) (*Credentials, error) {
+	creds := &Credentials{ApiKey: os.Getenv(this.apiKeyVar)}
+	if this.accessTokenVar != "" {
+		creds.AccessToken = os.Getenv(this.accessTokenVar)
+	}
+	if creds.ApiKey == "" && creds.AccessToken == "" {
+		return nil, fmt.Errorf("fcm: %s is not set", this.apiKeyVar)
+	}
+	return this.cache.update(creds), nil
+}
+
+// Refresh reads the environment again, the previous credentials are
+// returned if they did not change
+func (this *EnvCredentials) Refresh(ctx context.Context, rejected *Credentials) (*Credentials, error) {
+	if _, err := this.Credentials(ctx); err != nil {
+		return nil, err
+	}
+	return this.cache.alternative(rejected), nil
+}
+
+// KeyFileCredentials reads the server key from a file, reloaded when its
+// modification time changes. The previous key is kept for the requests
+// refused while the new key propagates
+type KeyFileCredentials struct {
+	path     string
+	interval time.Duration
+	cache    credentialCache
+
+	mu        sync.Mutex
+	lastCheck time.Time
+	modTime   time.Time
+}
+
+// NewKeyFileCredentials a provider reading the server key from path, the
+// file is checked for changes at most once per interval
+func NewKeyFileCredentials(path string, interval time.Duration) *KeyFileCredentials {
+	return &KeyFileCredentials{path: path, interval: interval}
+}
+
+// Credentials returns the key of the file, reloaded if the file changed
+func (this *KeyFileCredentials) Credentials(ctx context.Context) (*Credentials, error) {
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	current := this.cache.get()
+	if current != nil && time.Since(this.lastCheck) < this.interval {
+		return current, nil
+	}
+	this.lastCheck = time.Now()
+
+	info, err := os.Stat(this.path)
+	if err != nil {
+		if current != nil {
+			// keep the loaded key while the file is being replaced
+			return current, nil
+		}
+		return nil, err
+	}
+	if current != nil && info.ModTime().Equal(this.modTime) {
+		return current, nil
+	}
+
+	return this.load(info.ModTime())
+}
+
+// Refresh reloads the file and returns the new key, or the previous one
+// if the rejected key is the new one
+func (this *KeyFileCredentials) Refresh(ctx context.Context, rejected *Credentials) (*Credentials, error) {
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	info, err := os.Stat(this.path)
+	if err == nil {
+		_, err = this.load(info.ModTime())
+	}
+	if alt := this.cache.alternative(rejected); alt != nil {
+		return alt, nil
+	}
+	return nil, err
+}
+
+// load reads the key file, the lock must be held
+func (this *KeyFileCredentials) load(modTime time.Time) (*Credentials, error) {
+
+	b, err := ioutil.ReadFile(this.path)
+	if err != nil {
+		return nil, err
+	}
+	key := strings.TrimSpace(string(b))
+	if key == "" {
+		return nil, fmt.Errorf("fcm: key file %s is empty", this.path)
+	}
+
+	this.modTime = modTime
+
+	return this.cache.update(&Credentials{ApiKey: key}), nil
+}
+
+// serviceAccount the fields of a service account key file
+type serviceAccount struct {
+	Type        string `json:"type"`
+	ProjectId   string `json:"project_id"`
+	PrivateKey  string `json:"private_key"`
+	ClientEmail string `json:"client_email"`
+	TokenUri    string `json:"token_uri"`
+}
+
+// ServiceAccountCredentials exchanges a signed assertion of a service
+// account key file for an oauth2 access token, refreshed before it expires
+type ServiceAccountCredentials struct {
+	path       string
+	httpClient *http.Client
+	cache      credentialCache
+
+	mu      sync.Mutex
+	expires time.Time
+}
+
+// NewServiceAccountCredentials a provider of access tokens for the service
+// account key file at path, the file is read again on every token refresh
+func NewServiceAccountCredentials(path string) *ServiceAccountCredentials {
+	return &ServiceAccountCredentials{path: path, httpClient: &http.Client{Timeout: 30 * time.Second}}
+}
+
+// ProjectId returns the project id of the service account, for SetV1Credentials
+func (this *ServiceAccountCredentials) ProjectId() (string, error) {
+	account, err := this.readAccount()
+	if err != nil {
+		return "", err
+	}
+	return account.ProjectId, nil
+}
+
+// Credentials returns the access token, fetching a new one if it expires soon
+func (this *ServiceAccountCredentials) Credentials(ctx context.Context) (*Credentials, error) {
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if current := this.cache.get(); current != nil && time.Until(this.expires) > token_refresh_margin {
+		return current, nil
+	}
+
+	return this.fetch(ctx)
+}
+
+// Refresh fetches a new access token if rejected is the current one
+func (this *ServiceAccountCredentials) Refresh(ctx context.Context, rejected *Credentials) (*Credentials, error) {
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if current := this.cache.get(); current != nil && rejected != nil && *current != *rejected {
+		return current, nil
+	}
+
+	return this.fetch(ctx)
+}
+
+// readAccount reads the key file
+func (this *ServiceAccountCredentials) readAccount() (*serviceAccount, error) {
+	b, err := ioutil.ReadFile(this.path)
+	if err != nil {
+		return nil, err
+	}
+	account := new(serviceAccount)
+	if err := json.Unmarshal(b, account); err != nil {
+		return nil, fmt.Errorf("fcm: decoding service account: %w", err)
+	}
+	if account.ClientEmail == "" || account.PrivateKey == "" || account.TokenUri == "" {
+		return nil, errors.New("fcm: incomplete service account file")
+	}
+	return account, nil
+}
+
+// fetch exchanges a new assertion for an access token, the lock must be held
+func (this *ServiceAccountCredentials) fetch(ctx context.Context) (*Credentials, error) {
+
+	account, err := this.readAccount()
+	if err != nil {
+		return nil, err
+	}
+
+	assertion, err := account.assertion(time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{"grant_type": {jwt_bearer_grant}, "assertion": {assertion}}
+	request, err := http.NewRequestWithContext(ctx, "POST", account.TokenUri, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	response, err := this.httpClient.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("fcm: fetching access token: %w", redactUrlError(err))
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, fmt.Errorf("fcm: fetching access token: %w", err)
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fcm: fetching access token: status %d: %s", response.StatusCode, bytes.TrimSpace(body))
+	}
+
+	token := new(struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	})
+	if err := json.Unmarshal(body, token); err != nil || token.AccessToken == "" {
+		return nil, fmt.Errorf("fcm: invalid access token response: %s", bytes.TrimSpace(body))
+	}
+
+	this.expires = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+
+	return this.cache.update(&Credentials{AccessToken: token.AccessToken, ProjectId: account.ProjectId}), nil
+}
+
+// assertion returns the signed (RS256) jwt of the service account
+func (this *serviceAccount) assertion(now time.Time) (string, error) {
+
+	block, _ := pem.Decode([]byte(this.PrivateKey))
+	if block == nil {
+		return "", errors.New("fcm: invalid service account private key")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return "", fmt.Errorf("fcm: parsing service account private key: %w", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return "", errors.New("fcm: service account private key is not an rsa key")
+	}
+
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   this.ClientEmail,
+		"scope": fcm_oauth_scope,
+		"aud":   this.TokenUri,
+		"iat":   now.Unix(),
+		"exp":   now.Add(token_lifetime).Unix(),
+	})
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signed))
+
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
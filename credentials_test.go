@@ -0,0 +1,255 @@
+package fcm
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// keyHandle accepts the send requests authorized with one of the keys
+type keyHandle struct {
+	sync.Mutex
+	accepted map[string]bool
+	seen     []string
+}
+
+func (h *keyHandle) accept(keys ...string) {
+	h.Lock()
+	defer h.Unlock()
+	h.accepted = make(map[string]bool)
+	for _, k := range keys {
+		h.accepted["key="+k] = true
+	}
+}
+
+func (h *keyHandle) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.Lock()
+	defer h.Unlock()
+
+	auth := r.Header.Get("Authorization")
+	h.seen = append(h.seen, auth)
+	if !h.accepted[auth] {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	topicHandle(w, r)
+}
+
+func writeKeyFile(t *testing.T, path string, key string, mod time.Time) {
+	if err := ioutil.WriteFile(path, []byte(key+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, mod, mod); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKeyFileRotation(t *testing.T) {
+	handle := new(keyHandle)
+	srv := httptest.NewServer(handle)
+	chgUrl(srv)
+	defer srv.Close()
+
+	path := filepath.Join(t.TempDir(), "server.key")
+	t0 := time.Now().Add(-time.Hour)
+	writeKeyFile(t, path, "old", t0)
+
+	c := NewFcmClient("").SetCredentialProvider(NewKeyFileCredentials(path, 0))
+	c.NewFcmMsgTo("/topics/news", map[string]string{"msg": "hi"})
+
+	handle.accept("old")
+	if status, err := c.Send(); err != nil || !status.Ok {
+		t.Fatalf("send => %v, %v", status, err)
+	}
+
+	// the new key is not accepted yet, the old one is retried
+	writeKeyFile(t, path, "new", t0.Add(time.Minute))
+	if status, err := c.Send(); err != nil || !status.Ok {
+		t.Fatalf("send during rotation => %v, %v", status, err)
+	}
+
+	handle.accept("new")
+	if status, err := c.Send(); err != nil || !status.Ok {
+		t.Fatalf("send after rotation => %v, %v", status, err)
+	}
+
+	want := "[key=old key=new key=old key=new]"
+	if got := fmt.Sprint(handle.seen); got != want {
+		t.Fatalf("keys => %s, want %s", got, want)
+	}
+
+	// no credential accepted, a single retry
+	handle.accept()
+	handle.seen = nil
+	if status, _ := c.Send(); status.StatusCode != http.StatusUnauthorized || len(handle.seen) != 2 {
+		t.Fatalf("send => %d after %d requests", status.StatusCode, len(handle.seen))
+	}
+}
+
+func TestKeyFileConcurrentRotation(t *testing.T) {
+	handle := new(keyHandle)
+	handle.accept("k0", "k1", "k2", "k3", "k4", "k5")
+	srv := httptest.NewServer(handle)
+	chgUrl(srv)
+	defer srv.Close()
+
+	path := filepath.Join(t.TempDir(), "server.key")
+	t0 := time.Now().Add(-time.Hour)
+	writeKeyFile(t, path, "k0", t0)
+
+	provider := NewKeyFileCredentials(path, time.Millisecond)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c := NewFcmClient("").SetCredentialProvider(provider)
+			c.NewFcmMsgTo("/topics/news", map[string]string{"msg": "hi"})
+			for j := 0; j < 5; j++ {
+				if status, err := c.Send(); err != nil || !status.Ok {
+					t.Errorf("send => %v, %v", status, err)
+				}
+			}
+		}()
+	}
+	for i := 1; i <= 5; i++ {
+		writeKeyFile(t, path, fmt.Sprint("k", i), t0.Add(time.Duration(i)*time.Minute))
+		time.Sleep(2 * time.Millisecond)
+	}
+	wg.Wait()
+}
+
+func TestEnvCredentials(t *testing.T) {
+	handle := new(keyHandle)
+	handle.accept("env-key")
+	srv := httptest.NewServer(handle)
+	chgUrl(srv)
+	defer srv.Close()
+
+	t.Setenv("FCM_TEST_KEY", "env-key")
+
+	c := NewFcmClient("ignored").SetCredentialProvider(NewEnvCredentials("FCM_TEST_KEY", ""))
+	c.NewFcmMsgTo("/topics/news", map[string]string{"msg": "hi"})
+	if status, err := c.Send(); err != nil || !status.Ok {
+		t.Fatalf("send => %v, %v", status, err)
+	}
+
+	t.Setenv("FCM_TEST_KEY", "")
+	if _, err := c.Send(); err == nil {
+		t.Fatal("send without key should fail")
+	}
+}
+
+func TestServiceAccountCredentials(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+
+	var mu sync.Mutex
+	fetched := 0
+	tokenSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		parts := strings.Split(r.Form.Get("assertion"), ".")
+		if r.Form.Get("grant_type") != jwt_bearer_grant || len(parts) != 3 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], sig); err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		claims := make(map[string]interface{})
+		payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		json.Unmarshal(payload, &claims)
+		if claims["iss"] != "sender@p.iam.gserviceaccount.com" || claims["scope"] != fcm_oauth_scope {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		mu.Lock()
+		fetched++
+		n := fetched
+		mu.Unlock()
+		fmt.Fprintf(w, `{"access_token":"token-%d","expires_in":3600,"token_type":"Bearer"}`, n)
+	}))
+	defer tokenSrv.Close()
+
+	account, _ := json.Marshal(map[string]string{
+		"type":         "service_account",
+		"project_id":   "p",
+		"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"client_email": "sender@p.iam.gserviceaccount.com",
+		"token_uri":    tokenSrv.URL,
+	})
+	path := filepath.Join(t.TempDir(), "service-account.json")
+	ioutil.WriteFile(path, account, 0600)
+
+	provider := NewServiceAccountCredentials(path)
+	projectId, err := provider.ProjectId()
+	if err != nil || projectId != "p" {
+		t.Fatalf("project id => %s, %v", projectId, err)
+	}
+
+	// the first token is refused by fcm, a new one is fetched
+	var seen []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		seen = append(seen, auth)
+		if auth != "Bearer token-2" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `{"name":"projects/p/messages/1"}`)
+	}))
+	chgV1Url(srv)
+	defer resetV1Url()
+	defer srv.Close()
+
+	c := NewFcmClient("").SetCredentialProvider(provider).SetV1Credentials(projectId, "")
+	for i := 0; i < 2; i++ {
+		resp, err := c.SendV1(&V1Message{Token: "t"}, false)
+		if err != nil || !resp.Success {
+			t.Fatalf("send => %+v, %v", resp, err)
+		}
+	}
+
+	want := "[Bearer token-1 Bearer token-2 Bearer token-2]"
+	if got := fmt.Sprint(seen); got != want {
+		t.Fatalf("tokens => %s, want %s", got, want)
+	}
+}
+
+func TestStaticCredentials(t *testing.T) {
+	handle := new(keyHandle)
+	srv := httptest.NewServer(handle)
+	chgUrl(srv)
+	defer srv.Close()
+
+	c := NewFcmClient("").SetCredentialProvider(NewStaticCredentials("static", ""))
+	c.NewFcmMsgTo("/topics/news", map[string]string{"msg": "hi"})
+
+	// a refused static key is not retried
+	if status, _ := c.Send(); status.StatusCode != http.StatusUnauthorized || len(handle.seen) != 1 {
+		t.Fatalf("send => %d after %d requests", status.StatusCode, len(handle.seen))
+	}
+}
@@ -0,0 +1,274 @@
+package fcm
+
+import (
+	"bufio"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// default_dedup_ttl how long a key is remembered by default
+	default_dedup_ttl = 24 * time.Hour
+)
+
+// DedupStore remembers the response of the messages sent with an
+// idempotency key, implementations must be safe for concurrent use, see
+// MemoryDedupStore and FileDedupStore
+type DedupStore interface {
+	// Get returns the response recorded under key, if it has not expired
+	Get(key string) (*FcmResponseStatus, bool, error)
+	// Put records the response of key for ttl
+	Put(key string, status *FcmResponseStatus, ttl time.Duration) error
+}
+
+// dedupEntry a recorded response
+type dedupEntry struct {
+	Key     string             `json:"key"`
+	Expires time.Time          `json:"expires"`
+	Status  *FcmResponseStatus `json:"status"`
+}
+
+// SetIdempotencyKey sets the idempotency key of the message
+func (this *FcmClient) SetIdempotencyKey(key string) *FcmClient {
+
+	this.Message.IdempotencyKey = key
+
+	return this
+}
+
+// SetDedupStore sets the store of the idempotency keys, a message with a
+// key sent again within ttl (24h if 0) gets the recorded response and is
+// not sent. A key is scoped to the targets of the message, the same key
+// sent to other tokens is sent. Only the successful responses without
+// retryable token errors are recorded, the concurrent sends of the same
+// key are not deduplicated
+func (this *FcmClient) SetDedupStore(store DedupStore, ttl time.Duration) *FcmClient {
+
+	if ttl <= 0 {
+		ttl = default_dedup_ttl
+	}
+	this.dedupStore = store
+	this.dedupTtl = ttl
+
+	return this
+}
+
+// dedupGet returns the recorded response of the message, if any
+func (this *FcmClient) dedupGet(msg *FcmMsg) (*FcmResponseStatus, bool) {
+	if this.dedupStore == nil || msg.IdempotencyKey == "" {
+		return nil, false
+	}
+
+	status, ok, err := this.dedupStore.Get(msg.dedupKey())
+	if err != nil {
+		this.getLogger().Warn("fcm: reading dedup store", "key", msg.IdempotencyKey, "error", err)
+		return nil, false
+	}
+	if ok {
+		this.getLogger().Info("fcm: duplicate message not sent", "key", msg.IdempotencyKey)
+	}
+	return status, ok
+}
+
+// dedupPut records the response of a message sent with a key
+func (this *FcmClient) dedupPut(msg *FcmMsg, status *FcmResponseStatus) {
+	if this.dedupStore == nil || msg.IdempotencyKey == "" || !status.Ok || status.IsTimeout() {
+		return
+	}
+
+	if err := this.dedupStore.Put(msg.dedupKey(), status, this.dedupTtl); err != nil {
+		this.getLogger().Warn("fcm: writing dedup store", "key", msg.IdempotencyKey, "error", err)
+	}
+}
+
+// dedupKey returns the idempotency key scoped to the targets of the message
+func (this *FcmMsg) dedupKey() string {
+	hash := sha256.New()
+	hash.Write([]byte(this.Condition + "\x00" + this.To))
+	for _, token := range this.RegistrationIds {
+		hash.Write([]byte("\x00" + token))
+	}
+	return this.IdempotencyKey + "\x00" + hex.EncodeToString(hash.Sum(nil))
+}
+
+// MemoryDedupStore an in memory DedupStore keeping the most recently used
+// keys, up to its capacity
+type MemoryDedupStore struct {
+	mu       sync.Mutex
+	capacity int
+	order    *list.List
+	entries  map[string]*list.Element
+}
+
+// NewMemoryDedupStore init a store of at most capacity keys
+func NewMemoryDedupStore(capacity int) *MemoryDedupStore {
+	return &MemoryDedupStore{
+		capacity: capacity,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// Get returns the response of key
+func (this *MemoryDedupStore) Get(key string) (*FcmResponseStatus, bool, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	elem, ok := this.entries[key]
+	if !ok {
+		return nil, false, nil
+	}
+	entry := elem.Value.(*dedupEntry)
+	if time.Now().After(entry.Expires) {
+		this.order.Remove(elem)
+		delete(this.entries, key)
+		return nil, false, nil
+	}
+
+	this.order.MoveToFront(elem)
+	status := *entry.Status
+	return &status, true, nil
+}
+
+// Put records the response of key, the least recently used key is
+// dropped when the store is full
+func (this *MemoryDedupStore) Put(key string, status *FcmResponseStatus, ttl time.Duration) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	saved := *status
+	entry := &dedupEntry{Key: key, Expires: time.Now().Add(ttl), Status: &saved}
+
+	if elem, ok := this.entries[key]; ok {
+		elem.Value = entry
+		this.order.MoveToFront(elem)
+		return nil
+	}
+
+	this.entries[key] = this.order.PushFront(entry)
+	for this.capacity > 0 && this.order.Len() > this.capacity {
+		oldest := this.order.Back()
+		this.order.Remove(oldest)
+		delete(this.entries, oldest.Value.(*dedupEntry).Key)
+	}
+
+	return nil
+}
+
+// FileDedupStore a DedupStore appending the keys to a json lines file, the
+// keys survive restarts. The file is compacted (expired keys dropped) when
+// it is opened
+type FileDedupStore struct {
+	mu      sync.Mutex
+	file    *os.File
+	entries map[string]*dedupEntry
+}
+
+// NewFileDedupStore opens (or creates) the store of path
+func NewFileDedupStore(path string) (*FileDedupStore, error) {
+
+	entries := make(map[string]*dedupEntry)
+
+	if f, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			entry := new(dedupEntry)
+			// a truncated last line is skipped
+			if json.Unmarshal(scanner.Bytes(), entry) == nil && entry.Status != nil {
+				entries[entry.Key] = entry
+			}
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("fcm: reading dedup file: %w", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	now := time.Now()
+	for key, entry := range entries {
+		if now.After(entry.Expires) {
+			delete(entries, key)
+		}
+	}
+
+	// compact into a temporary file renamed over the store
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, entry := range entries {
+		if err := enc.Encode(entry); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	f.Close()
+	if err := os.Rename(tmp, path); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileDedupStore{file: file, entries: entries}, nil
+}
+
+// Get returns the response of key
+func (this *FileDedupStore) Get(key string) (*FcmResponseStatus, bool, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	entry, ok := this.entries[key]
+	if !ok || time.Now().After(entry.Expires) {
+		return nil, false, nil
+	}
+
+	status := *entry.Status
+	return &status, true, nil
+}
+
+// Put appends the response of key to the file
+func (this *FileDedupStore) Put(key string, status *FcmResponseStatus, ttl time.Duration) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	saved := *status
+	entry := &dedupEntry{Key: key, Expires: time.Now().Add(ttl), Status: &saved}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := this.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+
+	this.entries[key] = entry
+	return nil
+}
+
+// Close closes the file
+func (this *FileDedupStore) Close() error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return this.file.Close()
+}
@@ -0,0 +1,166 @@
+package fcm
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSendIdempotencyKey(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		regIdHandle(w, r)
+	}))
+	chgUrl(ts)
+	defer ts.Close()
+
+	c := NewFcmClient("key").SetDedupStore(NewMemoryDedupStore(10), time.Hour)
+	c.NewFcmRegIdsMsg([]string{"a", "b", "c"}, nil).SetIdempotencyKey("job-1")
+
+	first, err := c.Send()
+	if err != nil || first.Success != 2 {
+		t.Fatalf("Send => %+v %v", first, err)
+	}
+	second, err := c.Send()
+	if err != nil || second.MulticastId != first.MulticastId || second.Success != 2 {
+		t.Fatalf("duplicate Send => %+v %v", second, err)
+	}
+	if requests != 1 {
+		t.Fatalf("requests => %d, want 1", requests)
+	}
+
+	c.SetIdempotencyKey("job-2")
+	if _, err := c.Send(); err != nil {
+		t.Fatal(err)
+	}
+	c.SetIdempotencyKey("")
+	if _, err := c.Send(); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 3 {
+		t.Fatalf("requests => %d, want 3", requests)
+	}
+}
+
+func TestSendIdempotencyKeyFailure(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	chgUrl(ts)
+	defer ts.Close()
+
+	c := NewFcmClient("key").SetDedupStore(NewMemoryDedupStore(10), time.Hour)
+	c.NewFcmMsgTo("a", nil).SetIdempotencyKey("job-1")
+
+	c.Send()
+	c.Send()
+	if requests != 2 {
+		t.Fatalf("requests => %d, failures must not be recorded", requests)
+	}
+}
+
+func TestSendIdempotencyKeyPerTarget(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		fmt.Fprint(w, `{"multicast_id":1,"success":1,"results":[{"message_id":"0:1"}]}`)
+	}))
+	chgUrl(ts)
+	defer ts.Close()
+
+	c := NewFcmClient("key").SetDedupStore(NewMemoryDedupStore(10), time.Hour)
+
+	// the router sends a copy of the message per device, keeping the key
+	router := NewFailoverRouter().AddProvider("fcm", c).SetRoute("", "fcm")
+	recipient := &Recipient{Id: "u1", Devices: []Device{
+		{Tokens: map[string]string{"fcm": "t1"}},
+		{Tokens: map[string]string{"fcm": "t2"}},
+	}}
+	if _, err := router.Send(context.Background(), recipient, &FcmMsg{IdempotencyKey: "job-1", Data: map[string]string{"k": "v"}}); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 2 {
+		t.Fatalf("requests => %d, want one per device", requests)
+	}
+}
+
+func TestSendIdempotencyKeyRetryableResult(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		fmt.Fprint(w, `{"multicast_id":1,"failure":1,"results":[{"error":"Unavailable"}]}`)
+	}))
+	chgUrl(ts)
+	defer ts.Close()
+
+	c := NewFcmClient("key").SetDedupStore(NewMemoryDedupStore(10), time.Hour)
+	c.NewFcmMsgTo("a", nil).SetIdempotencyKey("job-1")
+
+	c.Send()
+	c.Send()
+	if requests != 2 {
+		t.Fatalf("requests => %d, retryable results must not be recorded", requests)
+	}
+}
+
+func TestMemoryDedupStore(t *testing.T) {
+	store := NewMemoryDedupStore(2)
+
+	store.Put("a", &FcmResponseStatus{Ok: true, MsgId: 1}, time.Hour)
+	store.Put("b", &FcmResponseStatus{Ok: true, MsgId: 2}, time.Hour)
+	// a is used, b is the least recently used
+	if status, ok, _ := store.Get("a"); !ok || status.MsgId != 1 {
+		t.Fatalf("Get(a) => %+v %v", status, ok)
+	}
+	store.Put("c", &FcmResponseStatus{Ok: true, MsgId: 3}, time.Hour)
+
+	if _, ok, _ := store.Get("b"); ok {
+		t.Fatal("b not evicted")
+	}
+	if _, ok, _ := store.Get("a"); !ok {
+		t.Fatal("a evicted")
+	}
+
+	store.Put("d", &FcmResponseStatus{Ok: true}, -time.Second)
+	if _, ok, _ := store.Get("d"); ok {
+		t.Fatal("expired key returned")
+	}
+}
+
+func TestFileDedupStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dedup.jsonl")
+
+	store, err := NewFileDedupStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := &FcmResponseStatus{Ok: true, StatusCode: 200, Success: 1, Results: []map[string]string{{message_id_key: "m-1"}}}
+	store.Put("a", status, time.Hour)
+	store.Put("expired", status, -time.Second)
+	store.Close()
+
+	store, err = NewFileDedupStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	got, ok, err := store.Get("a")
+	if err != nil || !ok || got.Success != 1 || got.Results[0][message_id_key] != "m-1" {
+		t.Fatalf("Get(a) => %+v %v %v", got, ok, err)
+	}
+	if _, ok, _ := store.Get("expired"); ok {
+		t.Fatal("expired key loaded")
+	}
+	if len(store.entries) != 1 {
+		t.Fatalf("entries => %d, want the file compacted", len(store.entries))
+	}
+}
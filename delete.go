@@ -0,0 +1,179 @@
+package fcm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+const (
+	// delete_instance_srv_url
+	delete_instance_srv_url = "https://iid.googleapis.com/v1/%s"
+
+	// delete_token_srv_url
+	delete_token_srv_url = "https://iid.googleapis.com/iid/v1/%s"
+)
+
+var (
+	// delete urls, for testing purposes
+	deleteInstanceUrl = delete_instance_srv_url
+	deleteTokenUrl    = delete_token_srv_url
+)
+
+// DeleteResponse response of an instance or token deletion
+type DeleteResponse struct {
+	Error      string `json:"error,omitempty"`
+	Status     string
+	StatusCode int
+}
+
+// Err returns the error code of a failed deletion as a BatchError, a 404
+// without code is ErrNotFound, nil if the deletion succeeded
+func (this *DeleteResponse) Err() error {
+	if code := this.code(); code != "" {
+		return BatchError(code)
+	}
+	return nil
+}
+
+// code returns the error code of a failed deletion, empty if it succeeded
+func (this *DeleteResponse) code() string {
+	switch {
+	case this.StatusCode >= 200 && this.StatusCode <= 299:
+		return ""
+	case this.Error != "":
+		return this.Error
+	case this.StatusCode == http.StatusNotFound:
+		return string(ErrNotFound)
+	}
+	return this.Status
+}
+
+// SetTokenStore sets the store the deleted tokens are purged from
+func (this *FcmClient) SetTokenStore(store TokenStore) *FcmClient {
+
+	this.tokenStore = store
+
+	return this
+}
+
+// DeleteInstance deletes an app instance and its tokens, the instance id
+// token is purged from the token store (see SetTokenStore) once deleted
+func (this *FcmClient) DeleteInstance(instanceIdToken string) (*DeleteResponse, error) {
+
+	ctx, span := this.startSpan("fcm.DeleteInstance",
+		Attr(attr_endpoint, endpoint_delete_instance),
+		Attr(attr_target_type, "token"),
+		Attr(attr_token_count, 1))
+
+	resp, err := this.deleteOne(ctx, endpoint_delete_instance, deleteInstanceUrl, instanceIdToken)
+	endSpan(span, err)
+
+	return resp, err
+}
+
+// DeleteToken revokes a registration token, the token is purged from the
+// token store (see SetTokenStore) once revoked
+func (this *FcmClient) DeleteToken(token string) (*DeleteResponse, error) {
+
+	ctx, span := this.startSpan("fcm.DeleteToken",
+		Attr(attr_endpoint, endpoint_delete_token),
+		Attr(attr_target_type, "token"),
+		Attr(attr_token_count, 1))
+
+	resp, err := this.deleteOne(ctx, endpoint_delete_token, deleteTokenUrl, token)
+	endSpan(span, err)
+
+	return resp, err
+}
+
+// DeleteTokens revokes (many) registration tokens concurrently (see
+// SetBatchConcurrency), the results are aligned with the tokens and the
+// revoked tokens are purged from the token store. On a request or token
+// store error the results are returned with the first error, a token whose
+// request failed has the Unavailable error
+func (this *FcmClient) DeleteTokens(tokens []string) (*BatchResponse, error) {
+
+	ctx, span := this.startSpan("fcm.DeleteTokens",
+		Attr(attr_endpoint, endpoint_delete_token),
+		Attr(attr_target_type, "tokens"),
+		Attr(attr_token_count, len(tokens)))
+
+	responses := make([]*DeleteResponse, len(tokens))
+	errs := make([]error, len(tokens))
+
+	runConcurrently(len(tokens), this.getBatchConcurrency(), func(i int) {
+		responses[i], errs[i] = this.deleteOne(ctx, endpoint_delete_token, deleteTokenUrl, tokens[i])
+	})
+
+	// the status is the first non 2xx one, or the first 2xx one
+	var err error
+	result := &BatchResponse{Tokens: tokens}
+	for i, resp := range responses {
+		if errs[i] != nil && err == nil {
+			err = errs[i]
+		}
+		val := map[string]string{}
+		if resp == nil {
+			// the request failed, nothing is known of the token
+			val[error_key] = fcm_unavailable
+			result.Results = append(result.Results, val)
+			continue
+		}
+		if code := resp.code(); code != "" {
+			val[error_key] = code
+		}
+		result.Results = append(result.Results, val)
+		if result.StatusCode == 0 || (result.StatusCode < 300 && resp.StatusCode >= 300) {
+			result.Status, result.StatusCode = resp.Status, resp.StatusCode
+		}
+	}
+
+	this.reportBatchResults(ctx, endpoint_delete_token, tokens, result)
+	endSpan(span, err)
+
+	return result, err
+}
+
+// deleteOne sends a deletion and purges the token if it is gone, a token
+// store error is returned with the response
+func (this *FcmClient) deleteOne(ctx context.Context, endpoint string, srv string, token string) (*DeleteResponse, error) {
+
+	resp, err := this.invoke(ctx, newCall(endpoint, "DELETE", fmt.Sprintf(srv, token), nil), this.deleteInvoker)
+	if err != nil {
+		return nil, err
+	}
+
+	delResponse, ok := resp.(*DeleteResponse)
+	if !ok {
+		return nil, responseTypeError(endpoint, resp)
+	}
+
+	if code := delResponse.code(); this.tokenStore != nil && (code == "" || code == string(ErrNotFound)) {
+		if err := this.tokenStore.Delete([]string{token}); err != nil {
+			return delResponse, fmt.Errorf("fcm: purging token: %w", err)
+		}
+	}
+
+	return delResponse, nil
+}
+
+// deleteInvoker sends the delete call to the instance id server
+func (this *FcmClient) deleteInvoker(ctx context.Context, call *Call) (interface{}, error) {
+
+	response, body, err := this.doRequest(ctx, call, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// the body is empty or not json for some deletions, e.g. a 404
+	delResponse := new(DeleteResponse)
+	if err := json.Unmarshal(body, delResponse); err != nil && len(body) > 0 && response.StatusCode != http.StatusNotFound {
+		return nil, fmt.Errorf("fcm: parsing delete response: %w", err)
+	}
+	delResponse.Status = response.Status
+	delResponse.StatusCode = response.StatusCode
+
+	return delResponse, nil
+}
@@ -0,0 +1,136 @@
+package fcm
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// deleteHandle deletes the tokens once, the tokens prefixed with "bad"
+// are invalid and the tokens prefixed with "gone" are not found
+type deleteHandle struct {
+	sync.Mutex
+	deleted map[string]bool
+	methods map[string]bool
+}
+
+func (h *deleteHandle) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+
+	h.Lock()
+	defer h.Unlock()
+	h.methods[r.Method] = true
+
+	switch {
+	case strings.HasPrefix(token, "bad"):
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"error":"INVALID_ARGUMENT"}`)
+	case strings.HasPrefix(token, "gone") || h.deleted[token]:
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, "Not Found")
+	default:
+		h.deleted[token] = true
+		fmt.Fprint(w, "{}")
+	}
+}
+
+func newDeleteServer(t *testing.T) *deleteHandle {
+	h := &deleteHandle{deleted: make(map[string]bool), methods: make(map[string]bool)}
+	srv := httptest.NewServer(h)
+	chgIidUrl(srv)
+	t.Cleanup(func() {
+		resetIidUrl()
+		srv.Close()
+	})
+	return h
+}
+
+func TestDeleteToken(t *testing.T) {
+	h := newDeleteServer(t)
+
+	store := NewMemoryTokenStore()
+	store.Put([]TokenRecord{{Token: "t1"}, {Token: "t2"}, {Token: "bad3"}})
+	c := NewFcmClient("key").SetTokenStore(store)
+
+	resp, err := c.DeleteToken("t1")
+	if err != nil || resp.StatusCode != http.StatusOK || resp.Err() != nil {
+		t.Fatalf("DeleteToken => %+v %v", resp, err)
+	}
+	if _, ok := store.Get("t1"); ok {
+		t.Fatal("deleted token not purged")
+	}
+
+	resp, err = c.DeleteToken("t1")
+	if err != nil || !errors.Is(resp.Err(), ErrNotFound) {
+		t.Fatalf("DeleteToken again => %+v %v", resp, err)
+	}
+
+	resp, err = c.DeleteInstance("bad3")
+	if err != nil || !errors.Is(resp.Err(), ErrInvalidArgument) {
+		t.Fatalf("DeleteInstance => %+v %v", resp, err)
+	}
+	if _, ok := store.Get("bad3"); !ok {
+		t.Fatal("token purged after a failed deletion")
+	}
+
+	if len(h.methods) != 1 || !h.methods["DELETE"] {
+		t.Fatalf("methods => %v", h.methods)
+	}
+}
+
+func TestDeleteTokens(t *testing.T) {
+	newDeleteServer(t)
+
+	store := NewMemoryTokenStore()
+	tokens := []string{"t1", "bad2", "gone3", "t4"}
+	for _, token := range tokens {
+		store.Put([]TokenRecord{{Token: token}})
+	}
+
+	resp, err := NewFcmClient("key").SetTokenStore(store).SetBatchConcurrency(2).DeleteTokens(tokens)
+	if err != nil {
+		t.Fatalf("DeleteTokens => %v", err)
+	}
+
+	failed := resp.Failed()
+	if len(failed) != 2 || failed[0].Token != "bad2" || !errors.Is(failed[1].Err, ErrNotFound) {
+		t.Fatalf("failed => %+v", failed)
+	}
+	if len(resp.Succeeded()) != 2 {
+		t.Fatalf("succeeded => %+v", resp.Succeeded())
+	}
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("status => %d, want the first non 2xx", resp.StatusCode)
+	}
+
+	// the not found tokens are purged too
+	if remaining := store.Tokens(); len(remaining) != 1 || remaining[0] != "bad2" {
+		t.Fatalf("store => %v", remaining)
+	}
+}
+
+func TestDeleteTokenStoreError(t *testing.T) {
+	newDeleteServer(t)
+
+	resp, err := NewFcmClient("key").SetTokenStore(failingTokenStore{}).DeleteToken("t1")
+	if err == nil || resp == nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("DeleteToken => %+v %v", resp, err)
+	}
+}
+
+func TestDeleteTokensStoreError(t *testing.T) {
+	newDeleteServer(t)
+
+	resp, err := NewFcmClient("key").SetTokenStore(failingTokenStore{}).DeleteTokens([]string{"t1", "bad2", "t3"})
+	if err == nil || resp == nil || len(resp.Results) != 3 {
+		t.Fatalf("DeleteTokens => %+v %v", resp, err)
+	}
+	// the deletions are reported even though the purge failed
+	if failed := resp.Failed(); len(failed) != 1 || failed[0].Token != "bad2" {
+		t.Fatalf("failed => %+v", failed)
+	}
+}
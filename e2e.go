@@ -0,0 +1,281 @@
+package fcm
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const (
+	// e2e_data_key the data field holding the encrypted data
+	e2e_data_key = "fcm_e2e"
+	// e2e_version version of the envelope
+	e2e_version = 1
+	// e2e_aad_prefix prefix of the additional data, followed by the key id
+	e2e_aad_prefix = "fcm-e2e/1/"
+	// e2e_nonce_size size of the aes-gcm nonce
+	e2e_nonce_size = 12
+)
+
+var (
+	// ErrUnknownKey the key id of an envelope is unknown to the provider
+	ErrUnknownKey = errors.New("fcm: unknown encryption key")
+	// ErrMixedKeys the tokens of a message are encrypted with different
+	// keys, they must be sent separately
+	ErrMixedKeys = errors.New("fcm: tokens use different encryption keys")
+)
+
+// KeyProvider provides the AES keys (16, 24 or 32 bytes) of the end to end
+// encrypted data, per app (the same key whatever the target) or per device
+type KeyProvider interface {
+	// EncryptionKey returns the key and key id the data sent to target, a
+	// token, a topic or a condition, is encrypted with
+	EncryptionKey(target string) (keyId string, key []byte, err error)
+	// DecryptionKey returns the key of keyId, ErrUnknownKey if none
+	DecryptionKey(keyId string) ([]byte, error)
+}
+
+// Envelope the encrypted data, sent as json in the fcm_e2e data field:
+// ct is AES-GCM(key, iv, json of the data, aad = "fcm-e2e/1/" + kid)
+// with the 16 bytes tag appended, iv (12 bytes) and ct are standard
+// base64. testdata/e2e_vectors.json holds test vectors
+type Envelope struct {
+	Version int    `json:"v"`
+	KeyId   string `json:"kid"`
+	Iv      string `json:"iv"`
+	Ct      string `json:"ct"`
+}
+
+// AppKeyProvider a KeyProvider with per app keys, the last added key
+// encrypts and the previous ones still decrypt, for rotation
+type AppKeyProvider struct {
+	mu      sync.RWMutex
+	current string
+	keys    map[string][]byte
+}
+
+// NewAppKeyProvider init a provider encrypting with key
+func NewAppKeyProvider(keyId string, key []byte) *AppKeyProvider {
+	provider := &AppKeyProvider{keys: make(map[string][]byte)}
+	return provider.AddKey(keyId, key)
+}
+
+// AddKey adds a key, it becomes the encryption key
+func (this *AppKeyProvider) AddKey(keyId string, key []byte) *AppKeyProvider {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.keys[keyId] = key
+	this.current = keyId
+
+	return this
+}
+
+// EncryptionKey returns the last added key
+func (this *AppKeyProvider) EncryptionKey(target string) (string, []byte, error) {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	return this.current, this.keys[this.current], nil
+}
+
+// DecryptionKey returns the key of keyId
+func (this *AppKeyProvider) DecryptionKey(keyId string) ([]byte, error) {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	key, ok := this.keys[keyId]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownKey, keyId)
+	}
+	return key, nil
+}
+
+// SetEncryption encrypts the data of the messages sent (legacy and v1)
+// with the keys of provider, the data is replaced by the fcm_e2e field.
+// The notification is not encrypted. The tokens of a multicast message
+// must share a key, see ErrMixedKeys. The data is encrypted before the
+// interceptors run: they, and the logs, only see the envelope
+func (this *FcmClient) SetEncryption(provider KeyProvider) *FcmClient {
+
+	this.keyProvider = provider
+
+	return this
+}
+
+// encryptMsg returns msg with its data encrypted
+func (this *FcmClient) encryptMsg(msg FcmMsg) (FcmMsg, error) {
+	if this.keyProvider == nil || msg.Data == nil {
+		return msg, nil
+	}
+
+	targets := msg.RegistrationIds
+	if len(targets) == 0 {
+		target := msg.To
+		if msg.Condition != "" {
+			target = msg.Condition
+		}
+		targets = []string{target}
+	}
+
+	keyId, key, err := this.keyProvider.EncryptionKey(targets[0])
+	if err != nil {
+		return msg, fmt.Errorf("fcm: encryption key: %w", err)
+	}
+	for _, target := range targets[1:] {
+		id, _, err := this.keyProvider.EncryptionKey(target)
+		if err != nil {
+			return msg, fmt.Errorf("fcm: encryption key: %w", err)
+		}
+		if id != keyId {
+			return msg, ErrMixedKeys
+		}
+	}
+
+	data, err := EncryptData(keyId, key, msg.Data)
+	if err != nil {
+		return msg, err
+	}
+	msg.Data = data
+
+	return msg, nil
+}
+
+// encryptV1 returns req with the data of its message encrypted
+func (this *FcmClient) encryptV1(req *V1SendRequest) (*V1SendRequest, error) {
+	if this.keyProvider == nil || req.Message == nil || req.Message.Data == nil {
+		return req, nil
+	}
+
+	target := req.Message.Token
+	switch {
+	case req.Message.Condition != "":
+		target = req.Message.Condition
+	case req.Message.Topic != "":
+		target = topics + req.Message.Topic
+	}
+
+	keyId, key, err := this.keyProvider.EncryptionKey(target)
+	if err != nil {
+		return nil, fmt.Errorf("fcm: encryption key: %w", err)
+	}
+	data, err := EncryptData(keyId, key, req.Message.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := *req.Message
+	msg.Data = data
+	return &V1SendRequest{ValidateOnly: req.ValidateOnly, Message: &msg}, nil
+}
+
+// EncryptData encrypts the json of data with key, it returns the data
+// field to send: {"fcm_e2e": envelope json}
+func EncryptData(keyId string, key []byte, data interface{}) (map[string]string, error) {
+
+	plaintext, err := json.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("fcm: encoding data: %w", err)
+	}
+
+	nonce := make([]byte, e2e_nonce_size)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	envelope, err := sealEnvelope(keyId, key, nonce, plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]string{e2e_data_key: envelope}, nil
+}
+
+// DecryptData decrypts the data received by a device into v, data without
+// the fcm_e2e field is decoded as is
+func DecryptData(provider KeyProvider, data map[string]string, v interface{}) error {
+
+	envelope, ok := data[e2e_data_key]
+	if !ok {
+		plain, _ := json.Marshal(data)
+		return json.Unmarshal(plain, v)
+	}
+
+	plaintext, err := OpenEnvelope(provider, envelope)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(plaintext, v)
+}
+
+// OpenEnvelope returns the plaintext of an envelope
+func OpenEnvelope(provider KeyProvider, envelope string) ([]byte, error) {
+
+	var env Envelope
+	if err := json.Unmarshal([]byte(envelope), &env); err != nil {
+		return nil, fmt.Errorf("fcm: decoding envelope: %w", err)
+	}
+	if env.Version != e2e_version {
+		return nil, fmt.Errorf("fcm: unsupported envelope version %d", env.Version)
+	}
+
+	key, err := provider.DecryptionKey(env.KeyId)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce, err := base64.StdEncoding.DecodeString(env.Iv)
+	if err != nil || len(nonce) != e2e_nonce_size {
+		return nil, errors.New("fcm: invalid envelope iv")
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(env.Ct)
+	if err != nil {
+		return nil, errors.New("fcm: invalid envelope ciphertext")
+	}
+
+	aead, err := newGcm(key)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(nil, nonce, ciphertext, []byte(e2e_aad_prefix+env.KeyId))
+	if err != nil {
+		return nil, fmt.Errorf("fcm: decrypting envelope: %w", err)
+	}
+
+	return plaintext, nil
+}
+
+// sealEnvelope encrypts plaintext into an envelope
+func sealEnvelope(keyId string, key []byte, nonce []byte, plaintext []byte) (string, error) {
+
+	aead, err := newGcm(key)
+	if err != nil {
+		return "", err
+	}
+
+	env := Envelope{
+		Version: e2e_version,
+		KeyId:   keyId,
+		Iv:      base64.StdEncoding.EncodeToString(nonce),
+		Ct:      base64.StdEncoding.EncodeToString(aead.Seal(nil, nonce, plaintext, []byte(e2e_aad_prefix+keyId))),
+	}
+
+	encoded, err := json.Marshal(env)
+	return string(encoded), err
+}
+
+// newGcm init aes-gcm with key
+func newGcm(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("fcm: encryption key: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
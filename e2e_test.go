@@ -0,0 +1,168 @@
+package fcm
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// e2eVector an envelope of testdata/e2e_vectors.json, published for the
+// client implementations, the binary fields are standard base64
+type e2eVector struct {
+	Key       string `json:"key"`
+	KeyId     string `json:"kid"`
+	Iv        string `json:"iv"`
+	Aad       string `json:"aad"`
+	Plaintext string `json:"plaintext"`
+	Ct        string `json:"ct"`
+	Envelope  string `json:"envelope"`
+}
+
+func vectorBytes(n int, first byte) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = first + byte(i)
+	}
+	return b
+}
+
+func TestEnvelopeVectors(t *testing.T) {
+	b, err := ioutil.ReadFile(filepath.Join("testdata", "e2e_vectors.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vectors []e2eVector
+	if err := json.Unmarshal(b, &vectors); err != nil {
+		t.Fatal(err)
+	}
+	if len(vectors) == 0 {
+		t.Fatal("no vectors")
+	}
+
+	for _, v := range vectors {
+		key, _ := base64.StdEncoding.DecodeString(v.Key)
+		iv, _ := base64.StdEncoding.DecodeString(v.Iv)
+		if v.Aad != e2e_aad_prefix+v.KeyId {
+			t.Fatalf("%s: aad => %s", v.KeyId, v.Aad)
+		}
+
+		envelope, err := sealEnvelope(v.KeyId, key, iv, []byte(v.Plaintext))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if envelope != v.Envelope || !strings.Contains(envelope, `"ct":"`+v.Ct+`"`) {
+			t.Fatalf("%s: envelope => %s, want %s", v.KeyId, envelope, v.Envelope)
+		}
+
+		plaintext, err := OpenEnvelope(NewAppKeyProvider(v.KeyId, key), v.Envelope)
+		if err != nil || string(plaintext) != v.Plaintext {
+			t.Fatalf("%s: OpenEnvelope => %s %v", v.KeyId, plaintext, err)
+		}
+	}
+}
+
+func TestOpenEnvelopeErrors(t *testing.T) {
+	provider := NewAppKeyProvider("k1", vectorBytes(32, 0))
+	data, err := EncryptData("k1", vectorBytes(32, 0), map[string]string{"a": "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := OpenEnvelope(NewAppKeyProvider("k2", vectorBytes(32, 0)), data[e2e_data_key]); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("unknown key => %v", err)
+	}
+	if _, err := OpenEnvelope(NewAppKeyProvider("k1", vectorBytes(32, 1)), data[e2e_data_key]); err == nil {
+		t.Fatal("wrong key accepted")
+	}
+	// the key id is authenticated, the device-7 vector under another id
+	tampered := `{"v":1,"kid":"k1","iv":"oKGio6Slpqeoqaqr","ct":"0aRZmUSrUSj3gm6WAASByZdvb1gJKks9ow=="}`
+	if _, err := OpenEnvelope(NewAppKeyProvider("k1", vectorBytes(16, 0)), tampered); err == nil {
+		t.Fatal("tampered envelope accepted")
+	}
+	if _, err := OpenEnvelope(provider, `{"v":2,"kid":"k1"}`); err == nil {
+		t.Fatal("unknown version accepted")
+	}
+}
+
+// deviceKeys a per device KeyProvider
+type deviceKeys map[string]string
+
+func (k deviceKeys) EncryptionKey(target string) (string, []byte, error) {
+	id, ok := k[target]
+	if !ok {
+		return "", nil, ErrUnknownKey
+	}
+	return id, vectorBytes(32, id[0]), nil
+}
+
+func (k deviceKeys) DecryptionKey(keyId string) ([]byte, error) {
+	return vectorBytes(32, keyId[0]), nil
+}
+
+// captureSend returns an interceptor recording the messages sent
+func captureSend(sent *[]interface{}) Interceptor {
+	return func(ctx context.Context, call *Call, next Invoker) (interface{}, error) {
+		*sent = append(*sent, call.Message)
+		if call.Endpoint == endpoint_send {
+			return &FcmResponseStatus{Ok: true, StatusCode: 200, Success: 1}, nil
+		}
+		return &SendResponse{}, nil
+	}
+}
+
+func TestSendEncryptsData(t *testing.T) {
+	var sent []interface{}
+	provider := NewAppKeyProvider("2023", vectorBytes(32, 0))
+	c := NewFcmClient("key").SetEncryption(provider).AddInterceptor(captureSend(&sent))
+
+	data := map[string]string{"otp": "123456"}
+	c.NewFcmRegIdsMsg([]string{"a", "b"}, data)
+	c.SetNotificationPayload(&NotificationPayload{Body: "You have a new code"})
+	if _, err := c.Send(); err != nil {
+		t.Fatal(err)
+	}
+	// rotation, the previous key still decrypts
+	provider.AddKey("2024", vectorBytes(32, 1))
+	if _, err := c.SendV1(&V1Message{Token: "a", Data: data}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	legacy := sent[0].(*FcmMsg)
+	v1 := sent[1].(*V1SendRequest)
+	if c.Message.Data.(map[string]string)["otp"] != "123456" || legacy.Notification.Body != "You have a new code" {
+		t.Fatalf("client message changed => %+v", c.Message)
+	}
+
+	for i, fields := range []map[string]string{legacy.Data.(map[string]string), v1.Message.Data} {
+		if len(fields) != 1 || fields[e2e_data_key] == "" {
+			t.Fatalf("data %d => %v", i, fields)
+		}
+		got := make(map[string]string)
+		if err := DecryptData(provider, fields, &got); err != nil || got["otp"] != "123456" {
+			t.Fatalf("DecryptData %d => %v %v", i, got, err)
+		}
+	}
+}
+
+func TestSendDeviceKeys(t *testing.T) {
+	var sent []interface{}
+	c := NewFcmClient("key").SetEncryption(deviceKeys{"a": "a-key", "b": "b-key", "c": "a-key"}).
+		AddInterceptor(captureSend(&sent))
+
+	c.NewFcmRegIdsMsg([]string{"a", "b"}, map[string]string{"x": "y"})
+	if _, err := c.Send(); !errors.Is(err, ErrMixedKeys) {
+		t.Fatalf("mixed keys => %v", err)
+	}
+	c.NewFcmRegIdsMsg([]string{"a", "c"}, map[string]string{"x": "y"})
+	if _, err := c.Send(); err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != 1 {
+		t.Fatalf("sent => %d", len(sent))
+	}
+}
@@ -2,10 +2,13 @@ package fcm
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"strings"
 	"time"
 )
 
@@ -22,6 +25,23 @@ const (
 	retry_after_header = "Retry-After"
 	// error_key readable error caching !
 	error_key = "error"
+	// registration_id_key canonical registration token of a result
+	registration_id_key = "registration_id"
+	// message_id_key message id of a result
+	message_id_key = "message_id"
+
+	// endpoint names, used for logging and metrics
+	endpoint_send            = "send"
+	endpoint_info            = "info"
+	endpoint_subscribe       = "subscribe"
+	endpoint_batch_add       = "batchAdd"
+	endpoint_batch_remove    = "batchRemove"
+	endpoint_batch_import    = "batchImport"
+	endpoint_web_import      = "webImport"
+	endpoint_delete_instance = "deleteInstance"
+	endpoint_delete_token    = "deleteToken"
+	endpoint_send_v1         = "sendV1"
+	endpoint_batch_send      = "batchSend"
 )
 
 var (
@@ -39,6 +59,52 @@ var (
 type FcmClient struct {
 	ApiKey  string
 	Message FcmMsg
+
+	// batchConcurrency max number of concurrent batch requests
+	batchConcurrency int
+
+	// projectId and accessToken the firebase project and oauth2 access
+	// token of the v1 api
+	projectId   string
+	accessToken string
+
+	// logger receives the client logs, nothing is logged if nil
+	logger Logger
+
+	// tokenStore the tokens are purged from on deletion, if not nil
+	tokenStore TokenStore
+
+	// dedupStore the responses of the messages with an idempotency key are
+	// recorded in for dedupTtl, if not nil
+	dedupStore DedupStore
+	dedupTtl   time.Duration
+
+	// keyProvider the data of the messages is encrypted with, if not nil
+	keyProvider KeyProvider
+
+	// metrics receives the client metrics, nothing is recorded if nil
+	metrics MetricsHook
+
+	// tracer opens a span per call, no spans are recorded if nil
+	tracer Tracer
+
+	// ctx the context of the requests, see WithContext
+	ctx context.Context
+
+	// interceptors wrap every outbound call, the first one is the outermost
+	interceptors []Interceptor
+
+	// outcomes records the outcome of every Send, under the message
+	// NotificationId
+	outcomes OutcomeStore
+
+	// httpClient and limiter of the requests, see SetHttpClient and SetLimiter
+	httpClient *http.Client
+	limiter    Limiter
+
+	// credentials provides the credentials of every request, ApiKey and
+	// accessToken are used if nil
+	credentials CredentialProvider
 }
 
 // FcmMsg represents fcm request message
@@ -56,6 +122,14 @@ type FcmMsg struct {
 	DryRun                bool                `json:"dry_run,omitempty"`
 	Condition             string              `json:"condition,omitempty"`
 	MutableContent        bool                `json:"mutable_content,omitempty"`
+
+	// IdempotencyKey identifies the message across retries, see
+	// SetDedupStore, it is not sent
+	IdempotencyKey string `json:"-"`
+
+	// NotificationId the id the outcome of the message is recorded under,
+	// see SetNotificationId, it is not sent
+	NotificationId string `json:"-"`
 }
 
 // FcmMsg represents fcm response message - (tokens and topics)
@@ -97,6 +171,24 @@ func NewFcmClient(apiKey string) *FcmClient {
 	return fcmc
 }
 
+// WithContext returns a shallow copy of the client using ctx for its
+// requests, for cancellation and span propagation
+func (this *FcmClient) WithContext(ctx context.Context) *FcmClient {
+	c := new(FcmClient)
+	*c = *this
+	c.ctx = ctx
+
+	return c
+}
+
+// context returns the client context or the background one
+func (this *FcmClient) context() context.Context {
+	if this.ctx == nil {
+		return context.Background()
+	}
+	return this.ctx
+}
+
 // NewFcmTopicMsg sets the targeted token/topic and the data payload
 func (this *FcmClient) NewFcmTopicMsg(to string, body map[string]string) *FcmClient {
 
@@ -149,33 +241,163 @@ func (this *FcmClient) AppendDevices(list []string) *FcmClient {
 }
 
 // apiKeyHeader generates the value of the Authorization key
-func (this *FcmClient) apiKeyHeader() string {
-	return fmt.Sprintf("key=%v", this.ApiKey)
+func apiKeyHeader(creds *Credentials) string {
+	return fmt.Sprintf("key=%v", creds.ApiKey)
 }
 
-// sendOnce send a single request to fcm
-func (this *FcmClient) sendOnce() (*FcmResponseStatus, error) {
+// authorizationHeader the Authorization of an endpoint, the v1 endpoints
+// use the oauth2 access token, the others the server key
+func authorizationHeader(endpoint string, creds *Credentials) string {
+	if endpoint == endpoint_send_v1 || endpoint == endpoint_batch_send {
+		return "Bearer " + creds.AccessToken
+	}
+	return apiKeyHeader(creds)
+}
 
-	fcmRespStatus := new(FcmResponseStatus)
+// doRequest sends a request to the fcm/instance id servers and reads
+// the response body, the response is returned for any status code.
+// A 401 is retried once with the refreshed credentials of the provider
+func (this *FcmClient) doRequest(ctx context.Context, call *Call, payload []byte) (*http.Response, []byte, error) {
 
-	jsonByte, err := this.Message.toJsonByte()
+	creds, err := this.getCredentials(ctx)
 	if err != nil {
-		return fcmRespStatus, err
+		return nil, nil, err
+	}
+
+	response, body, err := this.doRequestWith(ctx, call, payload, creds)
+	if err != nil || response.StatusCode != http.StatusUnauthorized {
+		return response, body, err
+	}
+
+	fresh := this.refreshCredentials(ctx, creds)
+	if fresh == nil {
+		return response, body, err
 	}
 
-	request, err := http.NewRequest("POST", fcmServerUrl, bytes.NewBuffer(jsonByte))
-	request.Header.Set("Authorization", this.apiKeyHeader())
+	this.getLogger().Warn("fcm: retrying with refreshed credentials", "endpoint", call.Endpoint)
+	this.getMetrics().ObserveRetry(call.Endpoint)
+
+	return this.doRequestWith(ctx, call, payload, fresh)
+}
+
+// doRequestWith sends a single request with creds
+func (this *FcmClient) doRequestWith(ctx context.Context, call *Call, payload []byte, creds *Credentials) (*http.Response, []byte, error) {
+
+	logger := this.getLogger()
+	metrics := this.getMetrics()
+	endpoint, method := call.Endpoint, call.Method
+
+	var reqBody io.Reader
+	if payload != nil {
+		reqBody = bytes.NewReader(payload)
+	}
+
+	request, err := http.NewRequestWithContext(ctx, method, call.Url, reqBody)
+	if err != nil {
+		return nil, nil, fmt.Errorf("fcm: creating request: %w", redactUrlError(err))
+	}
+	request.Header.Set("Authorization", authorizationHeader(endpoint, creds))
 	request.Header.Set("Content-Type", "application/json")
+	for k, v := range call.Header {
+		request.Header[k] = v
+	}
 
-	client := &http.Client{}
-	response, err := client.Do(request)
+	if this.limiter != nil {
+		if err := this.limiter.Wait(ctx); err != nil {
+			return nil, nil, fmt.Errorf("fcm: waiting for limiter: %w", err)
+		}
+	}
 
+	logger.Debug("fcm: request started", "endpoint", endpoint, "method", method)
+	start := time.Now()
+
+	response, err := this.getHttpClient().Do(request)
 	if err != nil {
-		return fcmRespStatus, err
+		// the returned error is redacted too, callers may show it
+		err = redactUrlError(err)
+		logger.Error("fcm: request failed", "endpoint", endpoint, "error", err)
+		metrics.ObserveRequest(endpoint, 0, time.Since(start))
+		return nil, nil, fmt.Errorf("fcm: sending request: %w", err)
 	}
 	defer response.Body.Close()
 
 	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		logger.Error("fcm: reading response failed", "endpoint", endpoint, "error", err)
+		metrics.ObserveRequest(endpoint, response.StatusCode, time.Since(start))
+		return nil, nil, fmt.Errorf("fcm: reading response: %w", err)
+	}
+
+	level := logger.Debug
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		level = logger.Warn
+	}
+	level("fcm: request finished", "endpoint", endpoint,
+		"status_code", response.StatusCode, "duration", time.Since(start))
+	metrics.ObserveRequest(endpoint, response.StatusCode, time.Since(start))
+	spanFromContext(ctx).SetAttributes(Attr(attr_status_code, response.StatusCode))
+
+	return response, body, nil
+}
+
+// sendOnce send a single request to fcm
+func (this *FcmClient) sendOnce(ctx context.Context) (*FcmResponseStatus, error) {
+
+	msg, err := this.encryptMsg(this.Message)
+	if err != nil {
+		return new(FcmResponseStatus), err
+	}
+
+	// sent the message as sent by the terminal invoker, the interceptors
+	// may have changed or replaced it
+	sent := &msg
+	terminal := func(ctx context.Context, call *Call) (interface{}, error) {
+		if m, ok := call.Message.(*FcmMsg); ok {
+			sent = m
+		}
+		return this.sendInvoker(ctx, call)
+	}
+
+	resp, err := this.invoke(ctx, newCall(endpoint_send, "POST", fcmServerUrl, &msg), terminal)
+	if err != nil {
+		this.recordFailedOutcome(sent, redactUrlError(err).Error())
+		if status, ok := resp.(*FcmResponseStatus); ok && status != nil {
+			return status, err
+		}
+		return new(FcmResponseStatus), err
+	}
+
+	fcmRespStatus, ok := resp.(*FcmResponseStatus)
+	if !ok {
+		return new(FcmResponseStatus), responseTypeError(endpoint_send, resp)
+	}
+
+	if fcmRespStatus.Ok {
+		this.reportSendResults(ctx, sent, fcmRespStatus)
+		this.recordOutcome(sent, fcmRespStatus)
+	} else {
+		this.recordFailedOutcome(sent, fmt.Sprintf("status %d", fcmRespStatus.StatusCode))
+	}
+
+	return fcmRespStatus, nil
+}
+
+// sendInvoker sends the send call to fcm
+func (this *FcmClient) sendInvoker(ctx context.Context, call *Call) (interface{}, error) {
+
+	fcmRespStatus := new(FcmResponseStatus)
+
+	msg, ok := call.Message.(*FcmMsg)
+	if !ok {
+		return fcmRespStatus, messageTypeError(call)
+	}
+
+	jsonByte, err := msg.toJsonByte()
+	if err != nil {
+		return fcmRespStatus, fmt.Errorf("fcm: encoding message: %w", err)
+	}
+
+	response, body, err := this.doRequest(ctx, call, jsonByte)
 	if err != nil {
 		return fcmRespStatus, err
 	}
@@ -190,7 +412,7 @@ func (this *FcmClient) sendOnce() (*FcmResponseStatus, error) {
 
 	err = fcmRespStatus.parseStatusBody(body)
 	if err != nil {
-		return fcmRespStatus, err
+		return fcmRespStatus, fmt.Errorf("fcm: parsing response: %w", err)
 	}
 	fcmRespStatus.Ok = true
 
@@ -199,8 +421,51 @@ func (this *FcmClient) sendOnce() (*FcmResponseStatus, error) {
 
 // Send to fcm
 func (this *FcmClient) Send() (*FcmResponseStatus, error) {
-	return this.sendOnce()
 
+	// the notification id names this send only, a retry sets it again
+	defer func() { this.Message.NotificationId = "" }()
+
+	if status, ok := this.dedupGet(&this.Message); ok {
+		return status, nil
+	}
+
+	ctx, span := this.startSpan("fcm.Send",
+		Attr(attr_endpoint, endpoint_send),
+		Attr(attr_target_type, this.Message.targetType()),
+		Attr(attr_token_count, this.Message.tokenCount()))
+
+	status, err := this.sendOnce(ctx)
+	if err == nil {
+		span.SetAttributes(Attr(attr_success_count, status.Success), Attr(attr_failure_count, status.Fail))
+		this.dedupPut(&this.Message, status)
+	}
+	endSpan(span, err)
+
+	return status, err
+}
+
+// targetType returns the target of the message: condition, topic, token or tokens
+func (this *FcmMsg) targetType() string {
+	switch {
+	case this.Condition != "":
+		return "condition"
+	case strings.HasPrefix(strings.ToLower(this.To), topics):
+		return "topic"
+	case len(this.RegistrationIds) > 0:
+		return "tokens"
+	}
+	return "token"
+}
+
+// tokenCount returns the number of tokens targeted by the message
+func (this *FcmMsg) tokenCount() int {
+	if len(this.RegistrationIds) > 0 {
+		return len(this.RegistrationIds)
+	}
+	if this.To != "" && this.targetType() == "token" {
+		return 1
+	}
+	return 0
 }
 
 // toJsonByte converts FcmMsg to a json byte
@@ -0,0 +1,3 @@
+module github.com/NaySoftware/go-fcm
+
+go 1.22
@@ -1,11 +1,9 @@
 package fcm
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
-	"io/ioutil"
 	"net/http"
 	"strings"
 )
@@ -35,6 +33,8 @@ const (
 	status_key = "status"
 	// reg_token_key
 	reg_token_key = "registration_token"
+	// apns_import_ok status of an imported apns token
+	apns_import_ok = "OK"
 
 	// topics
 	topics = "/topics/"
@@ -48,6 +48,14 @@ var (
 		"INTERNAL":         true,
 		"TOO_MANY_TOPICS":  true,
 	}
+
+	// instance id server urls, for testing purposes
+	instanceIdInfoWithDetailsUrl = instance_id_info_with_details_srv_url
+	instanceIdInfoNoDetailsUrl   = instance_id_info_no_details_srv_url
+	subscribeToTopicUrl          = subscribe_instanceid_to_topic_srv_url
+	batchAddUrl                  = batch_add_srv_url
+	batchRemUrl                  = batch_rem_srv_url
+	apnsBatchImportUrl           = apns_batch_import_srv_url
 )
 
 // InstanceIdInfoResponse response for instance id info request
@@ -77,12 +85,21 @@ type BatchRequest struct {
 	RegTokens []string `json:"registration_tokens,omitempty"`
 }
 
+// IidError a non 2xx response of the instance id server
+type IidError struct {
+	Status     string
+	StatusCode int
+	Code       string `json:"error,omitempty"`
+}
+
 // BatchResponse add/remove response
 type BatchResponse struct {
 	Error      string              `json:"error,omitempty"`
 	Results    []map[string]string `json:"results,omitempty"`
 	Status     string
 	StatusCode int
+	// Tokens the tokens of the request, aligned with Results
+	Tokens []string `json:"-"`
 }
 
 // ApnsBatchRequest apns import request
@@ -103,36 +120,54 @@ type ApnsBatchResponse struct {
 // GetInfo gets the instance id info
 func (this *FcmClient) GetInfo(withDetails bool, instanceIdToken string) (*InstanceIdInfoResponse, error) {
 
-	var request_url string = generateGetInfoUrl(instance_id_info_no_details_srv_url, instanceIdToken)
+	ctx, span := this.startSpan("fcm.GetInfo",
+		Attr(attr_endpoint, endpoint_info),
+		Attr(attr_target_type, "token"),
+		Attr(attr_token_count, 1))
+
+	info, err := this.getInfo(ctx, withDetails, instanceIdToken)
+	endSpan(span, err)
+
+	return info, err
+}
+
+// getInfo sends the instance id info request
+func (this *FcmClient) getInfo(ctx context.Context, withDetails bool, instanceIdToken string) (*InstanceIdInfoResponse, error) {
+
+	var request_url string = generateGetInfoUrl(instanceIdInfoNoDetailsUrl, instanceIdToken)
 
 	if withDetails == true {
-		request_url = generateGetInfoUrl(instance_id_info_with_details_srv_url, instanceIdToken)
+		request_url = generateGetInfoUrl(instanceIdInfoWithDetailsUrl, instanceIdToken)
 	}
 
-	request, err := http.NewRequest("GET", request_url, nil)
-	request.Header.Set("Authorization", this.apiKeyHeader())
-	request.Header.Set("Content-Type", "application/json")
-
+	resp, err := this.invoke(ctx, newCall(endpoint_info, "GET", request_url, nil), this.infoInvoker)
 	if err != nil {
 		return nil, err
 	}
 
-	client := &http.Client{}
-	response, err := client.Do(request)
-	if err != nil {
-		return nil, err
+	infoResponse, ok := resp.(*InstanceIdInfoResponse)
+	if !ok {
+		return nil, responseTypeError(endpoint_info, resp)
 	}
 
-	defer response.Body.Close()
+	return infoResponse, nil
+}
+
+// infoInvoker sends the info call to the instance id server
+func (this *FcmClient) infoInvoker(ctx context.Context, call *Call) (interface{}, error) {
 
-	body, err := ioutil.ReadAll(response.Body)
+	response, body, err := this.doRequest(ctx, call, nil)
 	if err != nil {
 		return nil, err
 	}
 
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return nil, parseIidError(body, response)
+	}
+
 	infoResponse, err := parseGetInfo(body)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("fcm: parsing info response: %w", err)
 	}
 
 	return infoResponse, nil
@@ -180,30 +215,50 @@ func generateGetInfoUrl(srv string, instanceIdToken string) string {
 // SubscribeToTopic subscribes a single device/token to a topic
 func (this *FcmClient) SubscribeToTopic(instanceIdToken string, topic string) (*SubscribeResponse, error) {
 
-	request, err := http.NewRequest("POST", generateSubToTopicUrl(instanceIdToken, topic), nil)
-	request.Header.Set("Authorization", this.apiKeyHeader())
-	request.Header.Set("Content-Type", "application/json")
+	ctx, span := this.startSpan("fcm.SubscribeToTopic",
+		Attr(attr_endpoint, endpoint_subscribe),
+		Attr(attr_target_type, "topic"),
+		Attr(attr_token_count, 1))
+
+	subResponse, err := this.subscribeToTopic(ctx, instanceIdToken, topic)
+	endSpan(span, err)
+
+	return subResponse, err
+}
+
+// subscribeToTopic sends the single topic subscription request
+func (this *FcmClient) subscribeToTopic(ctx context.Context, instanceIdToken string, topic string) (*SubscribeResponse, error) {
+
+	call := newCall(endpoint_subscribe, "POST", generateSubToTopicUrl(instanceIdToken, topic), nil)
 
+	resp, err := this.invoke(ctx, call, this.subscribeInvoker)
 	if err != nil {
 		return nil, err
 	}
 
-	client := &http.Client{}
-	response, err := client.Do(request)
-	if err != nil {
-		return nil, err
+	subResponse, ok := resp.(*SubscribeResponse)
+	if !ok {
+		return nil, responseTypeError(endpoint_subscribe, resp)
 	}
 
-	defer response.Body.Close()
+	return subResponse, nil
+}
+
+// subscribeInvoker sends the subscribe call to the instance id server
+func (this *FcmClient) subscribeInvoker(ctx context.Context, call *Call) (interface{}, error) {
 
-	body, err := ioutil.ReadAll(response.Body)
+	response, body, err := this.doRequest(ctx, call, nil)
 	if err != nil {
 		return nil, err
 	}
 
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return nil, parseIidError(body, response)
+	}
+
 	subResponse, err := parseSubscribeResponse(body, response)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("fcm: parsing subscribe response: %w", err)
 	}
 
 	return subResponse, nil
@@ -241,88 +296,70 @@ func generateSubToTopicUrl(instaceId string, topic string) string {
 		tmp := strings.Split(topic, "/")
 		topic = tmp[len(tmp)-1]
 	}
-	return fmt.Sprintf(subscribe_instanceid_to_topic_srv_url, instaceId, topic)
+	return fmt.Sprintf(subscribeToTopicUrl, instaceId, topic)
 }
 
-// BatchSubscribeToTopic subscribes (many) devices/tokens to a given topic
+// BatchSubscribeToTopic subscribes (many) devices/tokens to a given topic,
+// the tokens are split into chunks of the batchAdd limit (1000 tokens),
+// the response of the other chunks is returned with the error of a chunk
 func (this *FcmClient) BatchSubscribeToTopic(tokens []string, topic string) (*BatchResponse, error) {
+	return this.batchTopic("fcm.BatchSubscribeToTopic", endpoint_batch_add, batchAddUrl, tokens, topic)
+}
 
-	jsonByte, err := generateBatchRequest(tokens, topic)
-	if err != nil {
-		return nil, err
-	}
-
-	request, err := http.NewRequest("POST", batch_add_srv_url, bytes.NewBuffer(jsonByte))
-	request.Header.Set("Authorization", this.apiKeyHeader())
-	request.Header.Set("Content-Type", "application/json")
+// BatchUnsubscribeFromTopic unsubscribes (many) devices/tokens from a given topic,
+// the tokens are split into chunks of the batchRemove limit (1000 tokens),
+// the response of the other chunks is returned with the error of a chunk
+func (this *FcmClient) BatchUnsubscribeFromTopic(tokens []string, topic string) (*BatchResponse, error) {
+	return this.batchTopic("fcm.BatchUnsubscribeFromTopic", endpoint_batch_remove, batchRemUrl, tokens, topic)
+}
 
-	if err != nil {
-		fmt.Println(err)
-	}
+// batchRequestOnce sends a single batchAdd/batchRemove request
+func (this *FcmClient) batchRequestOnce(ctx context.Context, endpoint string, srv string, tokens []string, topic string) (*BatchResponse, error) {
 
-	client := &http.Client{}
-	response, err := client.Do(request)
-	if err != nil {
-		fmt.Println(err)
-	}
-
-	defer response.Body.Close()
+	call := newCall(endpoint, "POST", srv, newBatchRequest(tokens, topic))
 
-	body, err := ioutil.ReadAll(response.Body)
+	resp, err := this.invoke(ctx, call, this.batchInvoker)
 	if err != nil {
 		return nil, err
 	}
-	result, err := generateBatchResponse(body)
-	if err != nil {
-		return nil, err
-	}
-	if result == nil {
-		return nil, errors.New("Parsing response error")
+
+	result, ok := resp.(*BatchResponse)
+	if !ok {
+		return nil, responseTypeError(endpoint, resp)
 	}
-	result.Status = response.Status
-	result.StatusCode = response.StatusCode
 
 	return result, nil
 }
 
-// BatchUnsubscribeFromTopic unsubscribes (many) devices/tokens from a given topic
-func (this *FcmClient) BatchUnsubscribeFromTopic(tokens []string, topic string) (*BatchResponse, error) {
+// batchInvoker sends a batchAdd/batchRemove call to the instance id server
+func (this *FcmClient) batchInvoker(ctx context.Context, call *Call) (interface{}, error) {
 
-	jsonByte, err := generateBatchRequest(tokens, topic)
-	if err != nil {
-		fmt.Println(err)
-		return nil, err
+	batchReq, ok := call.Message.(*BatchRequest)
+	if !ok {
+		return nil, messageTypeError(call)
 	}
 
-	request, err := http.NewRequest("POST", batch_rem_srv_url, bytes.NewBuffer(jsonByte))
-	request.Header.Set("Authorization", this.apiKeyHeader())
-	request.Header.Set("Content-Type", "application/json")
-
+	jsonByte, err := json.Marshal(batchReq)
 	if err != nil {
-		fmt.Println(err)
+		return nil, fmt.Errorf("fcm: encoding batch request: %w", err)
 	}
 
-	client := &http.Client{}
-	response, err := client.Do(request)
+	response, body, err := this.doRequest(ctx, call, jsonByte)
 	if err != nil {
-		fmt.Println(err)
+		return nil, err
 	}
 
-	defer response.Body.Close()
-
-	body, err := ioutil.ReadAll(response.Body)
-	if err != nil {
-		return nil, err
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return nil, parseIidError(body, response)
 	}
+
 	result, err := generateBatchResponse(body)
 	if err != nil {
-		return nil, err
-	}
-	if result == nil {
-		return nil, errors.New("Parsing response error")
+		return nil, fmt.Errorf("fcm: parsing batch response: %w", err)
 	}
 	result.Status = response.Status
 	result.StatusCode = response.StatusCode
+	result.Tokens = batchReq.RegTokens
 
 	return result, nil
 }
@@ -339,15 +376,41 @@ func (this *BatchResponse) PrintResults() {
 	}
 }
 
-// generateBatchRequest based on tokens and topic
-func generateBatchRequest(tokens []string, topic string) ([]byte, error) {
+// Error returns the instance id error message
+func (this *IidError) Error() string {
+	if this.Code != "" {
+		return fmt.Sprintf("fcm: instance id error: %s (%s)", this.Code, this.Status)
+	}
+	return fmt.Sprintf("fcm: instance id error: %s", this.Status)
+}
+
+// IsTokenError whether the request failed because of its token, invalid
+// (400) or unknown (404), with an error code. The other errors, such as
+// an invalid key (401, 403), are errors of the request
+func (this *IidError) IsTokenError() bool {
+	return (this.StatusCode == 400 || this.StatusCode == 404) && this.Code != ""
+}
+
+// parseIidError converts a non 2xx response to an IidError, the error code
+// is left empty if the body is not a json error
+func parseIidError(body []byte, resp *http.Response) *IidError {
+	iidErr := new(IidError)
+	json.Unmarshal(body, iidErr)
+
+	iidErr.Status = resp.Status
+	iidErr.StatusCode = resp.StatusCode
+
+	return iidErr
+}
+
+// newBatchRequest init a BatchRequest based on tokens and topic
+func newBatchRequest(tokens []string, topic string) *BatchRequest {
 	envelope := new(BatchRequest)
 	envelope.To = topics + extractTopicName(topic)
 	envelope.RegTokens = make([]string, len(tokens))
 	copy(envelope.RegTokens, tokens)
 
-	return json.Marshal(envelope)
-
+	return envelope
 }
 
 // extractTopicName extract topic name for valid topic name input
@@ -378,39 +441,64 @@ func generateBatchResponse(resp []byte) (*BatchResponse, error) {
 // ApnsBatchImportRequest apns import requst
 func (this *FcmClient) ApnsBatchImportRequest(apnsReq *ApnsBatchRequest) (*ApnsBatchResponse, error) {
 
-	jsonByte, err := apnsReq.ToByte()
-	if err != nil {
-		return nil, err
+	ctx, span := this.startSpan("fcm.ApnsBatchImportRequest",
+		Attr(attr_endpoint, endpoint_batch_import),
+		Attr(attr_target_type, "apns_tokens"),
+		Attr(attr_token_count, len(apnsReq.ApnsTokens)))
+
+	result, err := this.apnsBatchImport(ctx, apnsReq)
+	if err == nil {
+		failed := result.countFailed()
+		span.SetAttributes(Attr(attr_success_count, len(result.Results)-failed), Attr(attr_failure_count, failed))
 	}
+	endSpan(span, err)
 
-	request, err := http.NewRequest("POST", apns_batch_import_srv_url, bytes.NewBuffer(jsonByte))
-	request.Header.Set("Authorization", this.apiKeyHeader())
-	request.Header.Set("Content-Type", "application/json")
+	return result, err
+}
+
+// apnsBatchImport sends the apns import request
+func (this *FcmClient) apnsBatchImport(ctx context.Context, apnsReq *ApnsBatchRequest) (*ApnsBatchResponse, error) {
+
+	call := newCall(endpoint_batch_import, "POST", apnsBatchImportUrl, apnsReq)
 
+	resp, err := this.invoke(ctx, call, this.apnsBatchImportInvoker)
 	if err != nil {
 		return nil, err
 	}
 
-	client := &http.Client{}
-	response, err := client.Do(request)
-	if err != nil {
-		return nil, err
+	result, ok := resp.(*ApnsBatchResponse)
+	if !ok {
+		return nil, responseTypeError(endpoint_batch_import, resp)
 	}
 
-	defer response.Body.Close()
+	return result, nil
+}
+
+// apnsBatchImportInvoker sends the apns import call to the instance id server
+func (this *FcmClient) apnsBatchImportInvoker(ctx context.Context, call *Call) (interface{}, error) {
+
+	apnsReq, ok := call.Message.(*ApnsBatchRequest)
+	if !ok {
+		return nil, messageTypeError(call)
+	}
 
-	body, err := ioutil.ReadAll(response.Body)
+	jsonByte, err := apnsReq.ToByte()
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("fcm: encoding apns batch request: %w", err)
 	}
 
-	result, err := parseApnsBatchResponse(body)
+	response, body, err := this.doRequest(ctx, call, jsonByte)
 	if err != nil {
 		return nil, err
 	}
 
-	if result == nil {
-		return nil, errors.New("Parsing Request error")
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return nil, parseIidError(body, response)
+	}
+
+	result, err := parseApnsBatchResponse(body)
+	if err != nil {
+		return nil, fmt.Errorf("fcm: parsing apns batch response: %w", err)
 	}
 
 	result.Status = response.Status
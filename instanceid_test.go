@@ -1,6 +1,10 @@
 package fcm
 
 import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 )
 
@@ -128,3 +132,178 @@ func TestExtractTopicName(t *testing.T) {
 	}
 
 }
+
+func chgIidUrl(ts *httptest.Server) {
+	instanceIdInfoWithDetailsUrl = ts.URL + "/iid/info/%s?details=true"
+	instanceIdInfoNoDetailsUrl = ts.URL + "/iid/info/%s"
+	subscribeToTopicUrl = ts.URL + "/iid/v1/%s/rel/topics/%s"
+	batchAddUrl = ts.URL + "/iid/v1:batchAdd"
+	batchRemUrl = ts.URL + "/iid/v1:batchRemove"
+	apnsBatchImportUrl = ts.URL + "/iid/v1:batchImport"
+	webPushImportUrl = ts.URL + "/v1/web/iid"
+	deleteInstanceUrl = ts.URL + "/v1/%s"
+	deleteTokenUrl = ts.URL + "/iid/v1/%s"
+}
+
+func resetIidUrl() {
+	instanceIdInfoWithDetailsUrl = instance_id_info_with_details_srv_url
+	instanceIdInfoNoDetailsUrl = instance_id_info_no_details_srv_url
+	subscribeToTopicUrl = subscribe_instanceid_to_topic_srv_url
+	batchAddUrl = batch_add_srv_url
+	batchRemUrl = batch_rem_srv_url
+	apnsBatchImportUrl = apns_batch_import_srv_url
+	webPushImportUrl = web_push_import_srv_url
+	deleteInstanceUrl = delete_instance_srv_url
+	deleteTokenUrl = delete_token_srv_url
+}
+
+func TestBatchNetworkDown(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	chgIidUrl(srv)
+	defer resetIidUrl()
+	srv.Close()
+
+	c := NewFcmClient("key")
+
+	res, err := c.BatchSubscribeToTopic([]string{"token0"}, "news")
+	if err == nil || res != nil {
+		t.Error("Expected an error with the server down")
+	}
+
+	res, err = c.BatchUnsubscribeFromTopic([]string{"token0"}, "news")
+	if err == nil || res != nil {
+		t.Error("Expected an error with the server down")
+	}
+}
+
+func TestBatchBadUrl(t *testing.T) {
+	batchAddUrl = "http://[::1"
+	defer resetIidUrl()
+
+	c := NewFcmClient("key")
+
+	if _, err := c.BatchSubscribeToTopic([]string{"token0"}, "news"); err == nil {
+		t.Error("Expected a request creation error")
+	}
+}
+
+func TestBatchJsonError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintln(w, `{"error":"Unauthorized"}`)
+	}))
+	chgIidUrl(srv)
+	defer resetIidUrl()
+	defer srv.Close()
+
+	c := NewFcmClient("key")
+
+	_, err := c.BatchUnsubscribeFromTopic([]string{"token0"}, "news")
+
+	iidErr := new(IidError)
+	if !errors.As(err, &iidErr) {
+		t.Fatal("Expected an IidError, got ", err)
+	}
+	if iidErr.StatusCode != http.StatusUnauthorized || iidErr.Code != "Unauthorized" {
+		t.Error("Wrong IidError: ", iidErr)
+	}
+}
+
+func TestBatchNonJsonError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, "<html>Service Unavailable</html>")
+	}))
+	chgIidUrl(srv)
+	defer resetIidUrl()
+	defer srv.Close()
+
+	c := NewFcmClient("key")
+
+	_, err := c.BatchSubscribeToTopic([]string{"token0"}, "news")
+
+	iidErr := new(IidError)
+	if !errors.As(err, &iidErr) {
+		t.Fatal("Expected an IidError, got ", err)
+	}
+	if iidErr.StatusCode != http.StatusServiceUnavailable || iidErr.Code != "" {
+		t.Error("Wrong IidError: ", iidErr)
+	}
+}
+
+func TestGetInfoError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, `{"error":"InvalidToken"}`)
+	}))
+	chgIidUrl(srv)
+	defer resetIidUrl()
+	defer srv.Close()
+
+	c := NewFcmClient("key")
+
+	info, err := c.GetInfo(true, "token0")
+
+	iidErr := new(IidError)
+	if info != nil || !errors.As(err, &iidErr) {
+		t.Fatal("Expected an IidError, got ", info, err)
+	}
+	if iidErr.StatusCode != http.StatusBadRequest || iidErr.Code != "InvalidToken" {
+		t.Error("Wrong IidError: ", iidErr)
+	}
+}
+
+func TestSubscribeToTopicNonJsonError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, "<html>Service Unavailable</html>")
+	}))
+	chgIidUrl(srv)
+	defer resetIidUrl()
+	defer srv.Close()
+
+	c := NewFcmClient("key")
+
+	res, err := c.SubscribeToTopic("token0", "news")
+
+	iidErr := new(IidError)
+	if res != nil || !errors.As(err, &iidErr) {
+		t.Fatal("Expected an IidError, got ", res, err)
+	}
+	if iidErr.StatusCode != http.StatusServiceUnavailable || iidErr.Code != "" {
+		t.Error("Wrong IidError: ", iidErr)
+	}
+}
+
+func TestBatchMalformedBody(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"results":[`)
+	}))
+	chgIidUrl(srv)
+	defer resetIidUrl()
+	defer srv.Close()
+
+	c := NewFcmClient("key")
+
+	res, err := c.BatchSubscribeToTopic([]string{"token0"}, "news")
+	if err == nil || res != nil {
+		t.Error("Expected a parsing error")
+	}
+}
+
+func TestBatchTruncatedBody(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "100")
+		fmt.Fprint(w, `{"results":[`)
+	}))
+	chgIidUrl(srv)
+	defer resetIidUrl()
+	defer srv.Close()
+
+	c := NewFcmClient("key")
+
+	res, err := c.BatchUnsubscribeFromTopic([]string{"token0"}, "news")
+	if err == nil || res != nil {
+		t.Error("Expected a reading error")
+	}
+}
@@ -0,0 +1,86 @@
+package fcm
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// Call an outbound call of the client, as seen by the interceptors
+type Call struct {
+	// Endpoint one of send, info, subscribe, batchAdd, batchRemove,
+	// batchImport, webImport, deleteInstance, deleteToken, sendV1 and
+	// batchSend
+	Endpoint string
+	Method   string
+	Url      string
+	// Header extra request headers, they override the default ones
+	Header http.Header
+	// Message the typed payload, encoded after the interceptors:
+	// *FcmMsg (send), *BatchRequest (batchAdd, batchRemove),
+	// *ApnsBatchRequest (batchImport), *WebImportRequest (webImport),
+	// *V1SendRequest (sendV1), []*V1SendRequest (batchSend), nil for info,
+	// subscribe, deleteInstance and deleteToken
+	Message interface{}
+
+	// client the client running the call, for its logger and metrics
+	client *FcmClient
+}
+
+// Invoker performs a call and returns its typed response:
+// *FcmResponseStatus (send), *InstanceIdInfoResponse (info),
+// *SubscribeResponse (subscribe), *BatchResponse (batchAdd, batchRemove),
+// *ApnsBatchResponse (batchImport), *WebImportResponse (webImport),
+// *DeleteResponse (deleteInstance, deleteToken), *SendResponse (sendV1)
+// or *BatchSendResponse (batchSend)
+type Invoker func(ctx context.Context, call *Call) (interface{}, error)
+
+// Interceptor wraps every outbound call of the client, it can change the
+// call, call next (zero or more times) and change or replace its response
+type Interceptor func(ctx context.Context, call *Call, next Invoker) (interface{}, error)
+
+// AddInterceptor appends interceptors to the chain of the client,
+// the first added interceptor is the outermost one
+func (this *FcmClient) AddInterceptor(interceptors ...Interceptor) *FcmClient {
+
+	this.interceptors = append(this.interceptors, interceptors...)
+
+	return this
+}
+
+// newCall init a Call
+func newCall(endpoint string, method string, url string, message interface{}) *Call {
+	return &Call{
+		Endpoint: endpoint,
+		Method:   method,
+		Url:      url,
+		Header:   make(http.Header),
+		Message:  message,
+	}
+}
+
+// invoke runs the call through the interceptors chain, ending with terminal
+func (this *FcmClient) invoke(ctx context.Context, call *Call, terminal Invoker) (interface{}, error) {
+
+	call.client = this
+	next := terminal
+
+	for i := len(this.interceptors) - 1; i >= 0; i-- {
+		interceptor, inner := this.interceptors[i], next
+		next = func(ctx context.Context, call *Call) (interface{}, error) {
+			return interceptor(ctx, call, inner)
+		}
+	}
+
+	return next(ctx, call)
+}
+
+// messageTypeError an interceptor replaced the message with a wrong type
+func messageTypeError(call *Call) error {
+	return fmt.Errorf("fcm: unexpected message type %T for %s", call.Message, call.Endpoint)
+}
+
+// responseTypeError an interceptor returned a response with a wrong type
+func responseTypeError(endpoint string, resp interface{}) error {
+	return fmt.Errorf("fcm: unexpected response type %T for %s", resp, endpoint)
+}
@@ -0,0 +1,122 @@
+package fcm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestInterceptorHeaderAndPayload(t *testing.T) {
+	var gotHeader string
+	var gotMsg FcmMsg
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotHeader = r.Header.Get("X-Experiment")
+		json.NewDecoder(r.Body).Decode(&gotMsg)
+		fmt.Fprintln(w, `{"message_id":6985435902064854329}`)
+	}))
+	chgUrl(srv)
+	defer srv.Close()
+
+	var order []string
+
+	c := NewFcmClient("key").AddInterceptor(
+		func(ctx context.Context, call *Call, next Invoker) (interface{}, error) {
+			order = append(order, "outer")
+			call.Header.Set("X-Experiment", "b")
+			return next(ctx, call)
+		},
+		func(ctx context.Context, call *Call, next Invoker) (interface{}, error) {
+			order = append(order, "inner")
+			if msg, ok := call.Message.(*FcmMsg); ok {
+				msg.Notification.Title = "Variant B"
+			}
+			resp, err := next(ctx, call)
+			if status, ok := resp.(*FcmResponseStatus); ok {
+				status.Err = "seen"
+			}
+			return resp, err
+		},
+	)
+	c.NewFcmMsgTo("/topics/topicName", map[string]string{"msg": "Hello World"})
+	c.SetNotificationPayload(&NotificationPayload{Title: "Variant A"})
+
+	res, err := c.Send()
+	if err != nil {
+		t.Fatal("Response Error : ", err)
+	}
+
+	if gotHeader != "b" || gotMsg.Notification.Title != "Variant B" {
+		t.Error("The interceptors changes were not sent: ", gotHeader, gotMsg.Notification.Title)
+	}
+	if c.Message.Notification.Title != "Variant A" {
+		t.Error("The client message should not be changed")
+	}
+	if res.Err != "seen" || res.MsgId != 6985435902064854329 {
+		t.Error("Wrong typed response: ", res)
+	}
+	if len(order) != 2 || order[0] != "outer" || order[1] != "inner" {
+		t.Error("Wrong interceptors order: ", order)
+	}
+}
+
+func TestInterceptorShortCircuit(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("The request should not be sent")
+	}))
+	chgIidUrl(srv)
+	defer resetIidUrl()
+	defer srv.Close()
+
+	var endpoints []string
+
+	c := NewFcmClient("key").AddInterceptor(func(ctx context.Context, call *Call, next Invoker) (interface{}, error) {
+		endpoints = append(endpoints, call.Endpoint)
+		switch msg := call.Message.(type) {
+		case *BatchRequest:
+			return &BatchResponse{StatusCode: 200, Results: make([]map[string]string, len(msg.RegTokens))}, nil
+		case *ApnsBatchRequest:
+			return &ApnsBatchResponse{StatusCode: 200}, nil
+		}
+		if call.Endpoint == endpoint_info {
+			return &InstanceIdInfoResponse{Application: "staging"}, nil
+		}
+		return &SubscribeResponse{StatusCode: 200}, nil
+	})
+
+	info, err := c.GetInfo(true, "token0")
+	if err != nil || info.Application != "staging" {
+		t.Error("Wrong info response: ", info, err)
+	}
+	if _, err := c.SubscribeToTopic("token0", "news"); err != nil {
+		t.Error("Subscribe Error: ", err)
+	}
+	batch, err := c.BatchSubscribeToTopic([]string{"token0", "token1"}, "news")
+	if err != nil || len(batch.Results) != 2 {
+		t.Error("Wrong batch response: ", batch, err)
+	}
+	if _, err := c.BatchUnsubscribeFromTopic([]string{"token0"}, "news"); err != nil {
+		t.Error("Batch Error: ", err)
+	}
+	if _, err := c.ApnsBatchImportRequest(&ApnsBatchRequest{App: "com.comp.company"}); err != nil {
+		t.Error("Apns Error: ", err)
+	}
+
+	expected := []string{endpoint_info, endpoint_subscribe, endpoint_batch_add, endpoint_batch_remove, endpoint_batch_import}
+	if fmt.Sprint(endpoints) != fmt.Sprint(expected) {
+		t.Error("Wrong intercepted endpoints: ", endpoints)
+	}
+}
+
+func TestInterceptorWrongResponseType(t *testing.T) {
+	c := NewFcmClient("key").AddInterceptor(func(ctx context.Context, call *Call, next Invoker) (interface{}, error) {
+		return "not a response", nil
+	})
+
+	if _, err := c.GetInfo(false, "token0"); err == nil {
+		t.Error("Expected a response type error")
+	}
+}
@@ -0,0 +1,111 @@
+package fcm
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Limiter limits the rate of the outbound requests, Wait blocks until a
+// request can be sent or ctx is done
+type Limiter interface {
+	Wait(ctx context.Context) error
+}
+
+// RateLimiter a token bucket Limiter, safe for concurrent use
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter init a limiter allowing perSecond (> 0) requests per
+// second, with bursts of up to burst requests
+func NewRateLimiter(perSecond float64, burst int) (*RateLimiter, error) {
+	if !(perSecond > 0) {
+		return nil, errors.New("fcm: rate limit must be positive")
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		rate:   perSecond,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}, nil
+}
+
+// Wait takes a token, waiting for one if the bucket is empty
+func (this *RateLimiter) Wait(ctx context.Context) error {
+	for {
+		this.mu.Lock()
+		if this.takeLocked() {
+			this.mu.Unlock()
+			return nil
+		}
+		wait := time.Duration((1 - this.tokens) / this.rate * float64(time.Second))
+		this.mu.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// Allow takes a token if one is available, it never waits
+func (this *RateLimiter) Allow() bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return this.takeLocked()
+}
+
+// takeLocked refills the bucket and takes a token if there is one
+func (this *RateLimiter) takeLocked() bool {
+	now := time.Now()
+	this.tokens += now.Sub(this.last).Seconds() * this.rate
+	if this.tokens > this.burst {
+		this.tokens = this.burst
+	}
+	this.last = now
+
+	if this.tokens >= 1 {
+		this.tokens--
+		return true
+	}
+	return false
+}
+
+// SetHttpClient sets the http client of the requests, clients sharing
+// it share its transport and connections
+func (this *FcmClient) SetHttpClient(c *http.Client) *FcmClient {
+
+	this.httpClient = c
+
+	return this
+}
+
+// SetLimiter sets the limiter every request waits on, nil disables it
+func (this *FcmClient) SetLimiter(l Limiter) *FcmClient {
+
+	this.limiter = l
+
+	return this
+}
+
+// getHttpClient returns the client http client or a default one
+func (this *FcmClient) getHttpClient() *http.Client {
+	if this.httpClient == nil {
+		return &http.Client{}
+	}
+	return this.httpClient
+}
@@ -0,0 +1,215 @@
+package fcm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+)
+
+const (
+	// redact_keep number of characters kept from a redacted token
+	redact_keep = 8
+)
+
+// Logger receives the logs of the client: request start/finish (debug),
+// non 2xx responses and retries (warn), token failures (info) and
+// request errors (error). kv are alternating key/value pairs, as log/slog.
+// Tokens are redacted and the api key is never logged
+type Logger interface {
+	Debug(msg string, kv ...interface{})
+	Info(msg string, kv ...interface{})
+	Warn(msg string, kv ...interface{})
+	Error(msg string, kv ...interface{})
+}
+
+// nopLogger discards all logs
+type nopLogger struct{}
+
+func (nopLogger) Debug(msg string, kv ...interface{}) {}
+func (nopLogger) Info(msg string, kv ...interface{})  {}
+func (nopLogger) Warn(msg string, kv ...interface{})  {}
+func (nopLogger) Error(msg string, kv ...interface{}) {}
+
+// NewSlogLogger adapts a log/slog logger to a Logger,
+// slog.Default() is used if l is nil
+func NewSlogLogger(l *slog.Logger) Logger {
+	if l == nil {
+		l = slog.Default()
+	}
+	return l
+}
+
+// SetLogger sets the logger of the client, nil disables logging
+func (this *FcmClient) SetLogger(l Logger) *FcmClient {
+
+	this.logger = l
+
+	return this
+}
+
+// getLogger returns the client logger or a no-op one
+func (this *FcmClient) getLogger() Logger {
+	if this.logger == nil {
+		return nopLogger{}
+	}
+	return this.logger
+}
+
+// reportSendResults logs the tokens of msg, as sent, with an error and
+// records the outcome of every token and the canonical ids
+func (this *FcmClient) reportSendResults(ctx context.Context, msg *FcmMsg, resp *FcmResponseStatus) {
+	logger := this.getLogger()
+	metrics := this.getMetrics()
+	span := spanFromContext(ctx)
+
+	if resp.Err != "" {
+		logger.Info("fcm: send failed", "endpoint", endpoint_send, "error", resp.Err)
+		span.AddEvent(event_send_error, Attr(attr_error, resp.Err))
+		metrics.ObserveTokenOutcome(endpoint_send, resp.Err)
+	} else if resp.MsgId != 0 {
+		metrics.ObserveTokenOutcome(endpoint_send, outcome_ok)
+	}
+
+	for i, val := range resp.Results {
+		if val[registration_id_key] != "" {
+			metrics.ObserveCanonicalId(endpoint_send)
+		}
+		if val[error_key] == "" {
+			metrics.ObserveTokenOutcome(endpoint_send, outcome_ok)
+			continue
+		}
+		metrics.ObserveTokenOutcome(endpoint_send, val[error_key])
+
+		token := msg.To
+		if i < len(msg.RegistrationIds) {
+			token = msg.RegistrationIds[i]
+		}
+		logger.Info("fcm: token failed",
+			"endpoint", endpoint_send, "token", redactToken(token), "error", val[error_key])
+		span.AddEvent(event_token_error,
+			Attr(attr_token, redactToken(token)), Attr(attr_token_index, i), Attr(attr_error, val[error_key]))
+	}
+}
+
+// redactToken keeps the first characters of a token, enough to correlate logs
+func redactToken(token string) string {
+	if len(token) <= redact_keep {
+		return "***"
+	}
+	return fmt.Sprintf("%s...(%d)", token[:redact_keep], len(token))
+}
+
+// redactUrlError drops the url of a request error, instance id urls
+// contain the device token
+func redactUrlError(err error) error {
+	urlErr := new(url.Error)
+	if errors.As(err, &urlErr) {
+		return fmt.Errorf("%s: %w", urlErr.Op, urlErr.Err)
+	}
+	return err
+}
+
+// String returns a one line summary of FcmResponseStatus
+func (this *FcmResponseStatus) String() string {
+	return fmt.Sprintf("status_code=%d success=%d failure=%d canonical_ids=%d multicast_id=%d message_id=%d error=%q",
+		this.StatusCode, this.Success, this.Fail, this.Canonical_ids, this.MulticastId, this.MsgId, this.Err)
+}
+
+// LogValue renders FcmResponseStatus in structured logs
+func (this *FcmResponseStatus) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.Int("status_code", this.StatusCode),
+		slog.Int("success", this.Success),
+		slog.Int("failure", this.Fail),
+		slog.Int("canonical_ids", this.Canonical_ids),
+		slog.Int64("multicast_id", this.MulticastId),
+		slog.Int64("message_id", this.MsgId),
+		slog.String("error", this.Err),
+	)
+}
+
+// String returns a one line summary of InstanceIdInfoResponse
+func (this *InstanceIdInfoResponse) String() string {
+	return fmt.Sprintf("application=%s platform=%s app_version=%s topics=%d error=%q",
+		this.Application, this.Platform, this.ApplicationVersion, len(this.Rel[topics_rel_key]), this.Error)
+}
+
+// LogValue renders InstanceIdInfoResponse in structured logs
+func (this *InstanceIdInfoResponse) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("application", this.Application),
+		slog.String("platform", this.Platform),
+		slog.String("app_version", this.ApplicationVersion),
+		slog.Int("topics", len(this.Rel[topics_rel_key])),
+		slog.String("error", this.Error),
+	)
+}
+
+// String returns a one line summary of SubscribeResponse
+func (this *SubscribeResponse) String() string {
+	return fmt.Sprintf("status_code=%d error=%q", this.StatusCode, this.Error)
+}
+
+// LogValue renders SubscribeResponse in structured logs
+func (this *SubscribeResponse) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.Int("status_code", this.StatusCode),
+		slog.String("error", this.Error),
+	)
+}
+
+// String returns a one line summary of BatchResponse
+func (this *BatchResponse) String() string {
+	return fmt.Sprintf("status_code=%d results=%d failed=%d error=%q",
+		this.StatusCode, len(this.Results), countResultErrors(this.Results, error_key), this.Error)
+}
+
+// LogValue renders BatchResponse in structured logs
+func (this *BatchResponse) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.Int("status_code", this.StatusCode),
+		slog.Int("results", len(this.Results)),
+		slog.Int("failed", countResultErrors(this.Results, error_key)),
+		slog.String("error", this.Error),
+	)
+}
+
+// String returns a one line summary of ApnsBatchResponse
+func (this *ApnsBatchResponse) String() string {
+	return fmt.Sprintf("status_code=%d results=%d failed=%d error=%q",
+		this.StatusCode, len(this.Results), this.countFailed(), this.Error)
+}
+
+// LogValue renders ApnsBatchResponse in structured logs
+func (this *ApnsBatchResponse) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.Int("status_code", this.StatusCode),
+		slog.Int("results", len(this.Results)),
+		slog.Int("failed", this.countFailed()),
+		slog.String("error", this.Error),
+	)
+}
+
+// countFailed counts the apns tokens with a status other than OK
+func (this *ApnsBatchResponse) countFailed() int {
+	n := 0
+	for _, val := range this.Results {
+		if val[status_key] != apns_import_ok {
+			n++
+		}
+	}
+	return n
+}
+
+// countResultErrors counts the results with a non empty key
+func countResultErrors(results []map[string]string, key string) int {
+	n := 0
+	for _, val := range results {
+		if val[key] != "" {
+			n++
+		}
+	}
+	return n
+}
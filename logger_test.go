@@ -0,0 +1,127 @@
+package fcm
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSlogLoggerRedacts(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(regIdHandle))
+	chgUrl(srv)
+	defer srv.Close()
+
+	buf := new(bytes.Buffer)
+	handler := slog.NewJSONHandler(buf, &slog.HandlerOptions{Level: slog.LevelDebug})
+
+	c := NewFcmClient("secret-api-key").SetLogger(NewSlogLogger(slog.New(handler)))
+
+	ids := []string{
+		"token0-0123456789abcdef",
+		"token1-0123456789abcdef",
+		"token2-0123456789abcdef",
+	}
+	c.NewFcmRegIdsMsg(ids, map[string]string{"msg": "Hello World"})
+
+	if _, err := c.Send(); err != nil {
+		t.Fatal("Response Error : ", err)
+	}
+
+	logs := buf.String()
+
+	if strings.Contains(logs, "secret-api-key") {
+		t.Error("The api key was logged")
+	}
+	for _, id := range ids {
+		if strings.Contains(logs, id) {
+			t.Error("A token was logged unredacted: ", id)
+		}
+	}
+	if !strings.Contains(logs, `"msg":"fcm: request started"`) || !strings.Contains(logs, `"msg":"fcm: request finished"`) {
+		t.Error("Missing request start/finish logs: ", logs)
+	}
+	if !strings.Contains(logs, `"token":"token2-0...(23)"`) || !strings.Contains(logs, `"error":"InvalidRegistration"`) {
+		t.Error("Missing token failure log: ", logs)
+	}
+}
+
+func TestLoggedTokensOfSentMessage(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(regIdHandle))
+	chgUrl(srv)
+	defer srv.Close()
+
+	buf := new(bytes.Buffer)
+	handler := slog.NewJSONHandler(buf, &slog.HandlerOptions{Level: slog.LevelDebug})
+
+	// the interceptor rewrites the targets, the failure is the third token sent
+	rewrite := func(ctx context.Context, call *Call, next Invoker) (interface{}, error) {
+		msg := *call.Message.(*FcmMsg)
+		msg.RegistrationIds = []string{"sent0-0123456789", "sent1-0123456789", "sent2-0123456789"}
+		call.Message = &msg
+		return next(ctx, call)
+	}
+
+	c := NewFcmClient("key").SetLogger(NewSlogLogger(slog.New(handler))).AddInterceptor(rewrite)
+	c.NewFcmRegIdsMsg([]string{"orig0-0123456789", "orig1-0123456789", "orig2-0123456789"}, nil)
+
+	if _, err := c.Send(); err != nil {
+		t.Fatal("Response Error : ", err)
+	}
+
+	if logs := buf.String(); !strings.Contains(logs, `"token":"sent2-01...(16)"`) {
+		t.Error("Failure not logged against the sent token: ", logs)
+	}
+}
+
+func TestRedactUrlError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	chgIidUrl(srv)
+	defer resetIidUrl()
+	srv.Close()
+
+	buf := new(bytes.Buffer)
+	c := NewFcmClient("key").SetLogger(slog.New(slog.NewTextHandler(buf, nil)))
+
+	_, err := c.GetInfo(true, "secret-device-token")
+	if err == nil {
+		t.Fatal("Expected an error with the server down")
+	}
+	if strings.Contains(err.Error(), "secret-device-token") {
+		t.Error("The device token is in the error: ", err)
+	}
+
+	if strings.Contains(buf.String(), "secret-device-token") {
+		t.Error("The device token was logged: ", buf.String())
+	}
+	if !strings.Contains(buf.String(), "fcm: request failed") {
+		t.Error("Missing request failure log: ", buf.String())
+	}
+}
+
+func TestResponseLogValue(t *testing.T) {
+	buf := new(bytes.Buffer)
+	logger := slog.New(slog.NewJSONHandler(buf, nil))
+
+	resp := &BatchResponse{
+		StatusCode: 200,
+		Results:    []map[string]string{{}, {"error": "NOT_FOUND"}},
+	}
+	logger.Info("batch", "resp", resp)
+
+	if !strings.Contains(buf.String(), `"resp":{"status_code":200,"results":2,"failed":1,"error":""}`) {
+		t.Error("Wrong LogValue: ", buf.String())
+	}
+
+	if resp.String() != `status_code=200 results=2 failed=1 error=""` {
+		t.Error("Wrong String: ", resp.String())
+	}
+
+	status := &FcmResponseStatus{StatusCode: 200, Success: 2, Fail: 1}
+	if !strings.HasPrefix(status.String(), "status_code=200 success=2 failure=1") {
+		t.Error("Wrong String: ", status.String())
+	}
+}
@@ -0,0 +1,236 @@
+package fcm
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// outcome_ok token outcome of a successful result
+	outcome_ok = "OK"
+
+	// prometheus_content_type text exposition format content type
+	prometheus_content_type = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+var (
+	// defaultLatencyBuckets request latency histogram buckets (seconds)
+	defaultLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+)
+
+// MetricsHook receives the client metrics, endpoint is one of send, info,
+// subscribe, batchAdd, batchRemove, batchImport, webImport, deleteInstance,
+// deleteToken, sendV1 and batchSend
+type MetricsHook interface {
+	// ObserveRequest a finished http request, statusCode is 0 if no
+	// response was received
+	ObserveRequest(endpoint string, statusCode int, latency time.Duration)
+	// ObserveTokenOutcome the result of a single token, code is "OK"
+	// or the error code returned by fcm
+	ObserveTokenOutcome(endpoint string, code string)
+	// ObserveRetry a retried request
+	ObserveRetry(endpoint string)
+	// ObserveCanonicalId a result with a canonical registration id
+	ObserveCanonicalId(endpoint string)
+}
+
+// nopMetrics discards all metrics
+type nopMetrics struct{}
+
+func (nopMetrics) ObserveRequest(endpoint string, statusCode int, latency time.Duration) {}
+func (nopMetrics) ObserveTokenOutcome(endpoint string, code string)                      {}
+func (nopMetrics) ObserveRetry(endpoint string)                                          {}
+func (nopMetrics) ObserveCanonicalId(endpoint string)                                    {}
+
+// SetMetrics sets the metrics hook of the client, nil disables metrics
+func (this *FcmClient) SetMetrics(m MetricsHook) *FcmClient {
+
+	this.metrics = m
+
+	return this
+}
+
+// getMetrics returns the client metrics hook or a no-op one
+func (this *FcmClient) getMetrics() MetricsHook {
+	if this.metrics == nil {
+		return nopMetrics{}
+	}
+	return this.metrics
+}
+
+// PrometheusMetrics a MetricsHook keeping counters and histograms in memory,
+// served in the Prometheus text exposition format by ServeHTTP
+type PrometheusMetrics struct {
+	mu       sync.Mutex
+	buckets  []float64
+	requests map[[2]string]uint64
+	outcomes map[[2]string]uint64
+	retries  map[string]uint64
+	canon    map[string]uint64
+	latency  map[string]*histogram
+}
+
+// histogram cumulative buckets of a single label set
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// NewPrometheusMetrics init PrometheusMetrics with the default latency buckets
+func NewPrometheusMetrics() *PrometheusMetrics {
+	return &PrometheusMetrics{
+		buckets:  defaultLatencyBuckets,
+		requests: make(map[[2]string]uint64),
+		outcomes: make(map[[2]string]uint64),
+		retries:  make(map[string]uint64),
+		canon:    make(map[string]uint64),
+		latency:  make(map[string]*histogram),
+	}
+}
+
+// ObserveRequest counts the request by endpoint and status code and
+// records its latency
+func (this *PrometheusMetrics) ObserveRequest(endpoint string, statusCode int, latency time.Duration) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.requests[[2]string{endpoint, strconv.Itoa(statusCode)}]++
+
+	h, ok := this.latency[endpoint]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(this.buckets))}
+		this.latency[endpoint] = h
+	}
+
+	seconds := latency.Seconds()
+	for i, le := range this.buckets {
+		if seconds <= le {
+			h.counts[i]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+// ObserveTokenOutcome counts the token outcome by endpoint and code
+func (this *PrometheusMetrics) ObserveTokenOutcome(endpoint string, code string) {
+	this.mu.Lock()
+	this.outcomes[[2]string{endpoint, code}]++
+	this.mu.Unlock()
+}
+
+// ObserveRetry counts the retry by endpoint
+func (this *PrometheusMetrics) ObserveRetry(endpoint string) {
+	this.mu.Lock()
+	this.retries[endpoint]++
+	this.mu.Unlock()
+}
+
+// ObserveCanonicalId counts the canonical id by endpoint
+func (this *PrometheusMetrics) ObserveCanonicalId(endpoint string) {
+	this.mu.Lock()
+	this.canon[endpoint]++
+	this.mu.Unlock()
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format
+func (this *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", prometheus_content_type)
+	this.WriteTo(w)
+}
+
+// WriteTo writes the metrics in the Prometheus text exposition format
+func (this *PrometheusMetrics) WriteTo(w io.Writer) (int64, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	b := new(strings.Builder)
+
+	writeHeader(b, "fcm_requests_total", "counter", "FCM and instance id http requests by endpoint and status code.")
+	for _, k := range sortedPairs(this.requests) {
+		fmt.Fprintf(b, "fcm_requests_total{endpoint=%s,code=%s} %d\n",
+			quoteLabel(k[0]), quoteLabel(k[1]), this.requests[k])
+	}
+
+	writeHeader(b, "fcm_token_outcomes_total", "counter", "Per token outcomes by endpoint and error code.")
+	for _, k := range sortedPairs(this.outcomes) {
+		fmt.Fprintf(b, "fcm_token_outcomes_total{endpoint=%s,code=%s} %d\n",
+			quoteLabel(k[0]), quoteLabel(k[1]), this.outcomes[k])
+	}
+
+	writeHeader(b, "fcm_retries_total", "counter", "Retried requests by endpoint.")
+	for _, k := range sortedKeys(this.retries) {
+		fmt.Fprintf(b, "fcm_retries_total{endpoint=%s} %d\n", quoteLabel(k), this.retries[k])
+	}
+
+	writeHeader(b, "fcm_canonical_ids_total", "counter", "Results with a canonical registration id by endpoint.")
+	for _, k := range sortedKeys(this.canon) {
+		fmt.Fprintf(b, "fcm_canonical_ids_total{endpoint=%s} %d\n", quoteLabel(k), this.canon[k])
+	}
+
+	writeHeader(b, "fcm_request_duration_seconds", "histogram", "FCM and instance id http request latency by endpoint.")
+	endpoints := make([]string, 0, len(this.latency))
+	for k := range this.latency {
+		endpoints = append(endpoints, k)
+	}
+	sort.Strings(endpoints)
+	for _, endpoint := range endpoints {
+		h := this.latency[endpoint]
+		for i, le := range this.buckets {
+			fmt.Fprintf(b, "fcm_request_duration_seconds_bucket{endpoint=%s,le=\"%s\"} %d\n",
+				quoteLabel(endpoint), strconv.FormatFloat(le, 'g', -1, 64), h.counts[i])
+		}
+		fmt.Fprintf(b, "fcm_request_duration_seconds_bucket{endpoint=%s,le=\"+Inf\"} %d\n", quoteLabel(endpoint), h.count)
+		fmt.Fprintf(b, "fcm_request_duration_seconds_sum{endpoint=%s} %s\n",
+			quoteLabel(endpoint), strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(b, "fcm_request_duration_seconds_count{endpoint=%s} %d\n", quoteLabel(endpoint), h.count)
+	}
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// writeHeader writes the HELP and TYPE lines of a metric
+func writeHeader(b *strings.Builder, name string, kind string, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// quoteLabel quotes a label value, escaping backslash, double-quote and line feed
+func quoteLabel(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, `"`, `\"`)
+	v = strings.ReplaceAll(v, "\n", `\n`)
+	return `"` + v + `"`
+}
+
+// sortedPairs returns the label pairs of a counter in order
+func sortedPairs(m map[[2]string]uint64) [][2]string {
+	keys := make([][2]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	return keys
+}
+
+// sortedKeys returns the labels of a counter in order
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,149 @@
+package fcm
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrometheusMetricsSend(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"multicast_id":1,"success":2,"failure":1,"canonical_ids":1,"results":[{"message_id":"0:1"},{"message_id":"0:2","registration_id":"token9"},{"error":"NotRegistered"}]}`)
+	}))
+	chgUrl(srv)
+	defer srv.Close()
+
+	metrics := NewPrometheusMetrics()
+
+	c := NewFcmClient("key").SetMetrics(metrics)
+	c.NewFcmRegIdsMsg([]string{"token0", "token1", "token2"}, map[string]string{"msg": "Hello World"})
+
+	if _, err := c.Send(); err != nil {
+		t.Fatal("Response Error : ", err)
+	}
+
+	rec := httptest.NewRecorder()
+	metrics.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	body, _ := ioutil.ReadAll(rec.Body)
+	out := string(body)
+
+	expected := []string{
+		"# TYPE fcm_requests_total counter",
+		`fcm_requests_total{endpoint="send",code="200"} 1`,
+		`fcm_token_outcomes_total{endpoint="send",code="OK"} 2`,
+		`fcm_token_outcomes_total{endpoint="send",code="NotRegistered"} 1`,
+		`fcm_canonical_ids_total{endpoint="send"} 1`,
+		"# TYPE fcm_request_duration_seconds histogram",
+		`fcm_request_duration_seconds_bucket{endpoint="send",le="+Inf"} 1`,
+		`fcm_request_duration_seconds_count{endpoint="send"} 1`,
+	}
+	for _, line := range expected {
+		if !strings.Contains(out, line+"\n") {
+			t.Error("Missing metric line: ", line)
+		}
+	}
+	if !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Error("Wrong content type: ", rec.Header().Get("Content-Type"))
+	}
+}
+
+func TestPrometheusMetricsBatchRetry(t *testing.T) {
+	batchRetryBackoff = 0
+
+	h := &batchHandle{seen: make(map[string]bool)}
+	srv := httptest.NewServer(h)
+	chgIidUrl(srv)
+	defer resetIidUrl()
+	defer srv.Close()
+
+	metrics := NewPrometheusMetrics()
+	c := NewFcmClient("key").SetMetrics(metrics)
+
+	if _, err := c.BatchSubscribeToTopic([]string{"token0", "flaky1", "bad2"}, "news"); err != nil {
+		t.Fatal("Batch Error: ", err)
+	}
+
+	out := new(strings.Builder)
+	metrics.WriteTo(out)
+
+	expected := []string{
+		`fcm_requests_total{endpoint="batchAdd",code="200"} 2`,
+		`fcm_retries_total{endpoint="batchAdd"} 1`,
+		`fcm_token_outcomes_total{endpoint="batchAdd",code="OK"} 2`,
+		`fcm_token_outcomes_total{endpoint="batchAdd",code="NOT_FOUND"} 1`,
+	}
+	for _, line := range expected {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Error("Missing metric line: ", line)
+		}
+	}
+}
+
+func TestPrometheusMetricsRetryInterceptor(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, `{"multicast_id":1,"success":1,"results":[{"message_id":"0:1"}]}`)
+	}))
+	chgUrl(srv)
+	defer srv.Close()
+
+	metrics := NewPrometheusMetrics()
+	c := NewFcmClient("key").SetMetrics(metrics).AddInterceptor(RetryInterceptor(2, time.Millisecond))
+	c.NewFcmMsgTo("token0", map[string]string{"msg": "Hello World"})
+
+	if status, err := c.Send(); err != nil || !status.Ok {
+		t.Fatal("Send => ", status, err)
+	}
+
+	out := new(strings.Builder)
+	metrics.WriteTo(out)
+
+	expected := []string{
+		`fcm_requests_total{endpoint="send",code="503"} 1`,
+		`fcm_requests_total{endpoint="send",code="200"} 1`,
+		`fcm_retries_total{endpoint="send"} 1`,
+	}
+	for _, line := range expected {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Error("Missing metric line: ", line)
+		}
+	}
+}
+
+func TestPrometheusHistogramBuckets(t *testing.T) {
+	metrics := NewPrometheusMetrics()
+	metrics.ObserveRequest("info", 0, 30*time.Millisecond)
+	metrics.ObserveRequest("info", 200, 3*time.Second)
+
+	out := new(strings.Builder)
+	metrics.WriteTo(out)
+
+	expected := []string{
+		`fcm_requests_total{endpoint="info",code="0"} 1`,
+		`fcm_request_duration_seconds_bucket{endpoint="info",le="0.025"} 0`,
+		`fcm_request_duration_seconds_bucket{endpoint="info",le="0.05"} 1`,
+		`fcm_request_duration_seconds_bucket{endpoint="info",le="5"} 2`,
+		`fcm_request_duration_seconds_sum{endpoint="info"} 3.03`,
+	}
+	for _, line := range expected {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Error("Missing metric line: ", line, "\n", out.String())
+		}
+	}
+}
+
+func TestQuoteLabel(t *testing.T) {
+	if quoteLabel("a\"b\\c\nd") != `"a\"b\\c\nd"` {
+		t.Error("Wrong label escaping: ", quoteLabel("a\"b\\c\nd"))
+	}
+}
@@ -0,0 +1,370 @@
+package fcm
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrOutcomeNotFound no outcome is recorded for the notification id
+	ErrOutcomeNotFound = errors.New("fcm: outcome not found")
+)
+
+// OutcomeStore records what happened to the notifications: the send
+// attempts, the result of every token and the delivery receipts.
+// Implementations must be safe for concurrent use, see MemoryOutcomeStore
+type OutcomeStore interface {
+	// RecordAttempt records a send attempt, a new attempt of an already
+	// recorded notification id counts as a retry
+	RecordAttempt(attempt *SendAttempt) error
+	// RecordReceipt attaches a delivery receipt to the token result with
+	// the same message id
+	RecordReceipt(receipt *DeliveryReceipt) error
+	// Get returns the outcome of a notification or ErrOutcomeNotFound
+	Get(notificationId string) (*Outcome, error)
+	// ByToken returns the outcomes of the notifications sent to a token
+	ByToken(token string) ([]*Outcome, error)
+	// Between returns the outcomes of the notifications first sent in [from, to)
+	Between(from time.Time, to time.Time) ([]*Outcome, error)
+}
+
+// SendAttempt a single send of a notification
+type SendAttempt struct {
+	NotificationId string
+	Time           time.Time
+	Results        []TokenResult
+}
+
+// TokenResult the result of a notification for a token (or topic)
+type TokenResult struct {
+	Token       string
+	MessageId   string
+	Error       string
+	CanonicalId string
+	Receipt     *DeliveryReceipt
+}
+
+// DeliveryReceipt a delivery receipt of a message
+type DeliveryReceipt struct {
+	MessageId string
+	Token     string
+	Status    string
+	Time      time.Time
+}
+
+// Outcome everything recorded about a notification, Tokens holds the
+// latest result of every token
+type Outcome struct {
+	NotificationId string
+	FirstSent      time.Time
+	LastSent       time.Time
+	Attempts       int
+	Retries        int
+	MessageIds     []string
+	Tokens         []TokenResult
+}
+
+// OutcomeStats aggregate counts of a set of outcomes
+type OutcomeStats struct {
+	Notifications int
+	Retries       int
+	Tokens        int
+	Succeeded     int
+	Failed        int
+	Delivered     int
+	// Errors error code -> number of tokens
+	Errors map[string]int
+}
+
+// MemoryOutcomeStore an in memory OutcomeStore, the outcomes are lost on restart
+type MemoryOutcomeStore struct {
+	mu        sync.RWMutex
+	outcomes  map[string]*Outcome
+	byMessage map[string]string
+	byToken   map[string]map[string]bool
+}
+
+// NewMemoryOutcomeStore init an empty in memory store
+func NewMemoryOutcomeStore() *MemoryOutcomeStore {
+	return &MemoryOutcomeStore{
+		outcomes:  make(map[string]*Outcome),
+		byMessage: make(map[string]string),
+		byToken:   make(map[string]map[string]bool),
+	}
+}
+
+// RecordAttempt records a send attempt
+func (this *MemoryOutcomeStore) RecordAttempt(attempt *SendAttempt) error {
+
+	if attempt.NotificationId == "" {
+		return errors.New("fcm: outcome without notification id")
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	outcome, ok := this.outcomes[attempt.NotificationId]
+	if !ok {
+		outcome = &Outcome{NotificationId: attempt.NotificationId, FirstSent: attempt.Time}
+		this.outcomes[attempt.NotificationId] = outcome
+	} else {
+		outcome.Retries++
+	}
+	outcome.Attempts++
+	outcome.LastSent = attempt.Time
+
+	for _, result := range attempt.Results {
+		if result.MessageId != "" {
+			outcome.MessageIds = append(outcome.MessageIds, result.MessageId)
+			this.byMessage[result.MessageId] = attempt.NotificationId
+		}
+
+		if this.byToken[result.Token] == nil {
+			this.byToken[result.Token] = make(map[string]bool)
+		}
+		this.byToken[result.Token][attempt.NotificationId] = true
+
+		outcome.setResult(result)
+	}
+
+	return nil
+}
+
+// RecordReceipt attaches a delivery receipt to its token result
+func (this *MemoryOutcomeStore) RecordReceipt(receipt *DeliveryReceipt) error {
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	id, ok := this.byMessage[receipt.MessageId]
+	if !ok {
+		return ErrOutcomeNotFound
+	}
+
+	outcome := this.outcomes[id]
+	for i := range outcome.Tokens {
+		if outcome.Tokens[i].MessageId == receipt.MessageId {
+			r := *receipt
+			outcome.Tokens[i].Receipt = &r
+			return nil
+		}
+	}
+
+	return ErrOutcomeNotFound
+}
+
+// Get returns the outcome of a notification
+func (this *MemoryOutcomeStore) Get(notificationId string) (*Outcome, error) {
+
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	outcome, ok := this.outcomes[notificationId]
+	if !ok {
+		return nil, ErrOutcomeNotFound
+	}
+
+	return outcome.copy(), nil
+}
+
+// ByToken returns the outcomes of the notifications sent to token, oldest first
+func (this *MemoryOutcomeStore) ByToken(token string) ([]*Outcome, error) {
+
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	var outcomes []*Outcome
+	for id := range this.byToken[token] {
+		outcomes = append(outcomes, this.outcomes[id].copy())
+	}
+	sortOutcomes(outcomes)
+
+	return outcomes, nil
+}
+
+// Between returns the outcomes first sent in [from, to), oldest first
+func (this *MemoryOutcomeStore) Between(from time.Time, to time.Time) ([]*Outcome, error) {
+
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	var outcomes []*Outcome
+	for _, outcome := range this.outcomes {
+		if !outcome.FirstSent.Before(from) && outcome.FirstSent.Before(to) {
+			outcomes = append(outcomes, outcome.copy())
+		}
+	}
+	sortOutcomes(outcomes)
+
+	return outcomes, nil
+}
+
+// OutcomeStatsBetween aggregates the outcomes first sent in [from, to)
+func OutcomeStatsBetween(store OutcomeStore, from time.Time, to time.Time) (*OutcomeStats, error) {
+
+	outcomes, err := store.Between(from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewOutcomeStats(outcomes), nil
+}
+
+// NewOutcomeStats aggregates outcomes
+func NewOutcomeStats(outcomes []*Outcome) *OutcomeStats {
+
+	stats := &OutcomeStats{Errors: make(map[string]int)}
+
+	for _, outcome := range outcomes {
+		stats.Notifications++
+		stats.Retries += outcome.Retries
+
+		for _, result := range outcome.Tokens {
+			stats.Tokens++
+			if result.Error != "" {
+				stats.Failed++
+				stats.Errors[result.Error]++
+				continue
+			}
+			stats.Succeeded++
+			if result.Receipt != nil {
+				stats.Delivered++
+			}
+		}
+	}
+
+	return stats
+}
+
+// Delivered whether a delivery receipt is recorded for token
+func (this *Outcome) Delivered(token string) bool {
+	for _, result := range this.Tokens {
+		if result.Token == token {
+			return result.Receipt != nil
+		}
+	}
+	return false
+}
+
+// setResult replaces the result of the token, a receipt of the previous
+// result is kept if the message id did not change
+func (this *Outcome) setResult(result TokenResult) {
+	for i := range this.Tokens {
+		if this.Tokens[i].Token == result.Token {
+			if result.Receipt == nil && result.MessageId == this.Tokens[i].MessageId {
+				result.Receipt = this.Tokens[i].Receipt
+			}
+			this.Tokens[i] = result
+			return
+		}
+	}
+	this.Tokens = append(this.Tokens, result)
+}
+
+// copy returns a copy, safe to use outside of the store lock
+func (this *Outcome) copy() *Outcome {
+	c := *this
+	c.MessageIds = append([]string(nil), this.MessageIds...)
+	c.Tokens = append([]TokenResult(nil), this.Tokens...)
+	return &c
+}
+
+// sortOutcomes sorts outcomes by first send time
+func sortOutcomes(outcomes []*Outcome) {
+	sort.Slice(outcomes, func(i, j int) bool {
+		if outcomes[i].FirstSent.Equal(outcomes[j].FirstSent) {
+			return outcomes[i].NotificationId < outcomes[j].NotificationId
+		}
+		return outcomes[i].FirstSent.Before(outcomes[j].FirstSent)
+	})
+}
+
+// SetOutcomeStore sets the store recording the outcome of every Send, nil disables it
+func (this *FcmClient) SetOutcomeStore(store OutcomeStore) *FcmClient {
+
+	this.outcomes = store
+
+	return this
+}
+
+// SetNotificationId sets the id the outcome of the next Send is recorded
+// under, it is cleared by Send: set the same id again to record a retry.
+// Without an id the multicast id (or message id) of the response is used
+func (this *FcmClient) SetNotificationId(id string) *FcmClient {
+
+	this.Message.NotificationId = id
+
+	return this
+}
+
+// recordOutcome records the send attempt in the outcome store
+func (this *FcmClient) recordOutcome(msg *FcmMsg, resp *FcmResponseStatus) {
+
+	if this.outcomes == nil {
+		return
+	}
+
+	attempt := &SendAttempt{NotificationId: msg.NotificationId, Time: time.Now()}
+
+	if attempt.NotificationId == "" {
+		if resp.MulticastId != 0 {
+			attempt.NotificationId = strconv.FormatInt(resp.MulticastId, 10)
+		} else {
+			attempt.NotificationId = strconv.FormatInt(resp.MsgId, 10)
+		}
+	}
+
+	if len(resp.Results) == 0 {
+		result := TokenResult{Token: msg.To, Error: resp.Err}
+		if resp.MsgId != 0 {
+			result.MessageId = strconv.FormatInt(resp.MsgId, 10)
+		}
+		attempt.Results = append(attempt.Results, result)
+	}
+
+	for i, val := range resp.Results {
+		token := msg.To
+		if i < len(msg.RegistrationIds) {
+			token = msg.RegistrationIds[i]
+		}
+		attempt.Results = append(attempt.Results, TokenResult{
+			Token:       token,
+			MessageId:   val[message_id_key],
+			Error:       val[error_key],
+			CanonicalId: val[registration_id_key],
+		})
+	}
+
+	if err := this.outcomes.RecordAttempt(attempt); err != nil {
+		this.getLogger().Warn("fcm: recording outcome failed",
+			"notification_id", attempt.NotificationId, "error", err)
+	}
+}
+
+// recordFailedOutcome records a send attempt without a valid response (a
+// request error or a non 2xx status), every target gets errorCode. Nothing
+// is recorded without a notification id, fcm gave none
+func (this *FcmClient) recordFailedOutcome(msg *FcmMsg, errorCode string) {
+
+	if this.outcomes == nil || msg.NotificationId == "" {
+		return
+	}
+
+	attempt := &SendAttempt{NotificationId: msg.NotificationId, Time: time.Now()}
+
+	targets := msg.RegistrationIds
+	if len(targets) == 0 {
+		targets = []string{msg.To}
+	}
+	for _, token := range targets {
+		attempt.Results = append(attempt.Results, TokenResult{Token: token, Error: errorCode})
+	}
+
+	if err := this.outcomes.RecordAttempt(attempt); err != nil {
+		this.getLogger().Warn("fcm: recording outcome failed",
+			"notification_id", attempt.NotificationId, "error", err)
+	}
+}
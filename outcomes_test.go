@@ -0,0 +1,196 @@
+package fcm
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMemoryOutcomeStore(t *testing.T) {
+	store := NewMemoryOutcomeStore()
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	store.RecordAttempt(&SendAttempt{NotificationId: "n-1", Time: t0, Results: []TokenResult{
+		{Token: "a", MessageId: "m-a"},
+		{Token: "b", Error: "Unavailable"},
+	}})
+	store.RecordAttempt(&SendAttempt{NotificationId: "n-1", Time: t0.Add(time.Minute), Results: []TokenResult{
+		{Token: "b", MessageId: "m-b"},
+	}})
+	store.RecordAttempt(&SendAttempt{NotificationId: "n-2", Time: t0.Add(time.Hour), Results: []TokenResult{
+		{Token: "a", Error: "NotRegistered"},
+	}})
+
+	if err := store.RecordReceipt(&DeliveryReceipt{MessageId: "m-b", Token: "b", Status: "MESSAGE_SENT_TO_DEVICE"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.RecordReceipt(&DeliveryReceipt{MessageId: "unknown"}); !errors.Is(err, ErrOutcomeNotFound) {
+		t.Fatalf("err => %v, want ErrOutcomeNotFound", err)
+	}
+
+	outcome, err := store.Get("n-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outcome.Attempts != 2 || outcome.Retries != 1 || len(outcome.Tokens) != 2 || len(outcome.MessageIds) != 2 {
+		t.Fatalf("outcome => %+v", outcome)
+	}
+	if outcome.Tokens[1].Error != "" || !outcome.Delivered("b") || outcome.Delivered("a") {
+		t.Fatalf("tokens => %+v", outcome.Tokens)
+	}
+	if !outcome.LastSent.Equal(t0.Add(time.Minute)) {
+		t.Fatalf("last sent => %v", outcome.LastSent)
+	}
+
+	if _, err := store.Get("n-3"); !errors.Is(err, ErrOutcomeNotFound) {
+		t.Fatalf("err => %v, want ErrOutcomeNotFound", err)
+	}
+
+	byToken, _ := store.ByToken("a")
+	if len(byToken) != 2 || byToken[0].NotificationId != "n-1" || byToken[1].NotificationId != "n-2" {
+		t.Fatalf("by token => %v", byToken)
+	}
+
+	between, _ := store.Between(t0.Add(time.Second), t0.Add(2*time.Hour))
+	if len(between) != 1 || between[0].NotificationId != "n-2" {
+		t.Fatalf("between => %v", between)
+	}
+
+	stats, err := OutcomeStatsBetween(store, t0, t0.Add(2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Notifications != 2 || stats.Retries != 1 || stats.Tokens != 3 ||
+		stats.Succeeded != 2 || stats.Failed != 1 || stats.Delivered != 1 || stats.Errors["NotRegistered"] != 1 {
+		t.Fatalf("stats => %+v", stats)
+	}
+}
+
+func TestSendOutcome(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(regIdHandle))
+	chgUrl(srv)
+	defer srv.Close()
+
+	store := NewMemoryOutcomeStore()
+	c := NewFcmClient("key").SetOutcomeStore(store).SetNotificationId("welcome-42")
+	c.NewFcmRegIdsMsg([]string{"t1", "t2", "t3"}, map[string]string{"msg": "Hello World"})
+
+	if _, err := c.Send(); err != nil {
+		t.Fatal(err)
+	}
+
+	outcome, err := store.Get("welcome-42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outcome.Tokens) != 3 || outcome.Tokens[0].MessageId != "0:1448128667408487%ecaaa23db3fd7efd" ||
+		outcome.Tokens[2].Token != "t3" || outcome.Tokens[2].Error != "InvalidRegistration" {
+		t.Fatalf("outcome => %+v", outcome.Tokens)
+	}
+}
+
+func TestSendOutcomeIdNotReused(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(topicHandle))
+	chgUrl(srv)
+	defer srv.Close()
+
+	store := NewMemoryOutcomeStore()
+	c := NewFcmClient("key").SetOutcomeStore(store)
+
+	c.NewFcmMsgTo("tokA", nil).SetNotificationId("like-1")
+	if _, err := c.Send(); err != nil {
+		t.Fatal(err)
+	}
+	c.NewFcmMsgTo("tokB", nil)
+	if _, err := c.Send(); err != nil {
+		t.Fatal(err)
+	}
+
+	outcome, err := store.Get("like-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outcome.Attempts != 1 || outcome.Retries != 0 || len(outcome.Tokens) != 1 || outcome.Tokens[0].Token != "tokA" {
+		t.Fatalf("outcome => %+v", outcome)
+	}
+}
+
+func TestSendOutcomeFailedAttempts(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		topicHandle(w, r)
+	}))
+	chgUrl(srv)
+	defer srv.Close()
+
+	store := NewMemoryOutcomeStore()
+	c := NewFcmClient("key").SetOutcomeStore(store)
+	c.NewFcmMsgTo("tokA", nil)
+
+	for i := 0; i < 2; i++ {
+		c.SetNotificationId("otp-7")
+		if _, err := c.Send(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	outcome, err := store.Get("otp-7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outcome.Attempts != 2 || outcome.Retries != 1 || len(outcome.Tokens) != 1 ||
+		outcome.Tokens[0].Error != "" || outcome.Tokens[0].MessageId == "" {
+		t.Fatalf("outcome => %+v", outcome)
+	}
+}
+
+func TestXmppOutcome(t *testing.T) {
+	stub := newXmppStub(t)
+	defer stub.ln.Close()
+
+	store := NewMemoryOutcomeStore()
+	handler := &recordHandler{done: make(chan struct{}, 1)}
+	c := stub.client(handler).SetOutcomeStore(store)
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	err := c.Send(context.Background(), &XmppMessage{FcmMsg: FcmMsg{To: "token"}, MessageId: "m-1", DeliveryReceiptRequested: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Send(context.Background(), &XmppMessage{FcmMsg: FcmMsg{To: "bad"}, MessageId: "m-2"})
+
+	stub.conn(0).writeGcm(map[string]interface{}{"from": "gcm.googleapis.com", "message_id": "dr2:m-1", "message_type": "receipt",
+		"data": map[string]string{"message_status": "MESSAGE_SENT_TO_DEVICE", "original_message_id": "m-1",
+			"device_registration_id": "token", "message_sent_timestamp": "1430277821658"}})
+
+	select {
+	case <-handler.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+
+	outcome, err := store.Get("m-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	receipt := outcome.Tokens[0].Receipt
+	if receipt == nil || receipt.Status != "MESSAGE_SENT_TO_DEVICE" || receipt.Time.UnixMilli() != 1430277821658 {
+		t.Fatalf("receipt => %+v", receipt)
+	}
+
+	outcome, err = store.Get("m-2")
+	if err != nil || outcome.Tokens[0].Error != "BAD_REGISTRATION" {
+		t.Fatalf("nack outcome => %+v, %v", outcome, err)
+	}
+}
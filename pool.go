@@ -0,0 +1,258 @@
+package fcm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+)
+
+var (
+	// ErrNoRoute no project of the pool matches the route
+	ErrNoRoute = errors.New("fcm: no project matches the route")
+)
+
+// ProjectConfig the credentials and routing rules of a project of a
+// ClientPool, the credentials are read from the environment variables
+// (ApiKeyEnv, AccessTokenEnv) if not set
+type ProjectConfig struct {
+	ProjectId      string `json:"project_id"`
+	ApiKey         string `json:"api_key,omitempty"`
+	ApiKeyEnv      string `json:"api_key_env,omitempty"`
+	AccessToken    string `json:"access_token,omitempty"`
+	AccessTokenEnv string `json:"access_token_env,omitempty"`
+	// AppIds firebase app ids routed to the project
+	AppIds []string `json:"app_ids,omitempty"`
+	// PackageNames restricted package names routed to the project
+	PackageNames []string `json:"package_names,omitempty"`
+	// Default routes the messages matching no other project
+	Default bool `json:"default,omitempty"`
+}
+
+// MessageRoute what a message is routed on, in order: the explicit
+// ProjectId, the AppId and the PackageName
+type MessageRoute struct {
+	ProjectId   string
+	AppId       string
+	PackageName string
+}
+
+// ClientPool holds a client per firebase project and routes messages to
+// them, the clients share the http client (transport), the limiter and the
+// options (logger, metrics, tracer, interceptors...) of the base client.
+// Projects can be added and removed while the pool is in use
+type ClientPool struct {
+	base *FcmClient
+
+	mu             sync.RWMutex
+	projects       map[string]*FcmClient
+	configs        map[string]ProjectConfig
+	byApp          map[string]string
+	byPackage      map[string]string
+	defaultProject string
+}
+
+// NewClientPool init an empty pool, the project clients are copies of
+// base with their own credentials, the credential provider of base is not
+// used. A shared http client is created if base has none, base can be nil
+func NewClientPool(base *FcmClient) *ClientPool {
+
+	if base == nil {
+		base = NewFcmClient("")
+	}
+
+	shared := new(FcmClient)
+	*shared = *base
+	shared.Message = FcmMsg{}
+	shared.interceptors = append([]Interceptor(nil), base.interceptors...)
+	if shared.httpClient == nil {
+		shared.httpClient = &http.Client{Transport: http.DefaultTransport.(*http.Transport).Clone()}
+	}
+
+	return &ClientPool{
+		base:      shared,
+		projects:  make(map[string]*FcmClient),
+		configs:   make(map[string]ProjectConfig),
+		byApp:     make(map[string]string),
+		byPackage: make(map[string]string),
+	}
+}
+
+// Add adds a project, or replaces it if already in the pool. An app id or
+// package name already routed to another project is an error
+func (this *ClientPool) Add(cfg ProjectConfig) error {
+
+	if cfg.ProjectId == "" {
+		return errors.New("fcm: project without project id")
+	}
+
+	apiKey, accessToken := cfg.ApiKey, cfg.AccessToken
+	if apiKey == "" && cfg.ApiKeyEnv != "" {
+		apiKey = os.Getenv(cfg.ApiKeyEnv)
+	}
+	if accessToken == "" && cfg.AccessTokenEnv != "" {
+		accessToken = os.Getenv(cfg.AccessTokenEnv)
+	}
+	if apiKey == "" && accessToken == "" {
+		return fmt.Errorf("fcm: project %s has no credentials", cfg.ProjectId)
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	for _, app := range cfg.AppIds {
+		if owner, ok := this.byApp[app]; ok && owner != cfg.ProjectId {
+			return fmt.Errorf("fcm: app %s is already routed to project %s", app, owner)
+		}
+	}
+	for _, pkg := range cfg.PackageNames {
+		if owner, ok := this.byPackage[pkg]; ok && owner != cfg.ProjectId {
+			return fmt.Errorf("fcm: package %s is already routed to project %s", pkg, owner)
+		}
+	}
+	if cfg.Default && this.defaultProject != "" && this.defaultProject != cfg.ProjectId {
+		return fmt.Errorf("fcm: project %s is already the default", this.defaultProject)
+	}
+
+	this.removeLocked(cfg.ProjectId)
+
+	client := new(FcmClient)
+	*client = *this.base
+	// the credentials of the project only, never the provider of base
+	client.credentials = nil
+	client.interceptors = append([]Interceptor(nil), this.base.interceptors...)
+	client.ApiKey = apiKey
+	client.SetV1Credentials(cfg.ProjectId, accessToken)
+
+	this.projects[cfg.ProjectId] = client
+	this.configs[cfg.ProjectId] = cfg
+	for _, app := range cfg.AppIds {
+		this.byApp[app] = cfg.ProjectId
+	}
+	for _, pkg := range cfg.PackageNames {
+		this.byPackage[pkg] = cfg.ProjectId
+	}
+	if cfg.Default {
+		this.defaultProject = cfg.ProjectId
+	}
+
+	return nil
+}
+
+// LoadProjects adds the projects of a json array of ProjectConfig
+func (this *ClientPool) LoadProjects(r io.Reader) error {
+
+	var configs []ProjectConfig
+	if err := json.NewDecoder(r).Decode(&configs); err != nil {
+		return fmt.Errorf("fcm: decoding projects: %w", err)
+	}
+
+	for _, cfg := range configs {
+		if err := this.Add(cfg); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Remove removes a project and its routes, the clients already returned
+// by the pool keep working. It returns false if the project is unknown
+func (this *ClientPool) Remove(projectId string) bool {
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return this.removeLocked(projectId)
+}
+
+// Projects returns the project ids of the pool in order
+func (this *ClientPool) Projects() []string {
+
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	ids := make([]string, 0, len(this.projects))
+	for id := range this.projects {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	return ids
+}
+
+// Client returns a new client of the project, ready for a message
+func (this *ClientPool) Client(projectId string) (*FcmClient, error) {
+	return this.Route(MessageRoute{ProjectId: projectId})
+}
+
+// Route returns a new client of the project matching route: the explicit
+// project id, else the app id, else the package name, else the default project
+func (this *ClientPool) Route(route MessageRoute) (*FcmClient, error) {
+
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	projectId := route.ProjectId
+	if projectId == "" {
+		projectId = this.byApp[route.AppId]
+	}
+	if projectId == "" {
+		projectId = this.byPackage[route.PackageName]
+	}
+	if projectId == "" {
+		projectId = this.defaultProject
+	}
+
+	template, ok := this.projects[projectId]
+	if !ok {
+		return nil, fmt.Errorf("%w: %+v", ErrNoRoute, route)
+	}
+
+	client := new(FcmClient)
+	*client = *template
+	// AddInterceptor on a routed client must not append to the shared array
+	client.interceptors = append([]Interceptor(nil), template.interceptors...)
+
+	return client, nil
+}
+
+// RouteMsg routes msg on its restricted package name and returns a client
+// of the project with msg as its message
+func (this *ClientPool) RouteMsg(msg *FcmMsg) (*FcmClient, error) {
+
+	client, err := this.Route(MessageRoute{PackageName: msg.RestrictedPackageName})
+	if err != nil {
+		return nil, err
+	}
+	client.Message = *msg
+
+	return client, nil
+}
+
+// removeLocked removes a project and its routes, the lock must be held
+func (this *ClientPool) removeLocked(projectId string) bool {
+
+	cfg, ok := this.configs[projectId]
+	if !ok {
+		return false
+	}
+
+	for _, app := range cfg.AppIds {
+		delete(this.byApp, app)
+	}
+	for _, pkg := range cfg.PackageNames {
+		delete(this.byPackage, pkg)
+	}
+	if this.defaultProject == projectId {
+		this.defaultProject = ""
+	}
+	delete(this.projects, projectId)
+	delete(this.configs, projectId)
+
+	return true
+}
@@ -0,0 +1,265 @@
+package fcm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const pool_projects = `[
+	{"project_id": "brand-a", "api_key": "key-a", "app_ids": ["1:1:android:a"], "package_names": ["com.brand.a"], "default": true},
+	{"project_id": "brand-b", "api_key_env": "FCM_TEST_KEY_B", "package_names": ["com.brand.b"]}
+]`
+
+func newTestPool(t *testing.T) *ClientPool {
+	t.Setenv("FCM_TEST_KEY_B", "key-b")
+
+	pool := NewClientPool(nil)
+	if err := pool.LoadProjects(strings.NewReader(pool_projects)); err != nil {
+		t.Fatal(err)
+	}
+	return pool
+}
+
+func TestClientPoolRoute(t *testing.T) {
+	pool := newTestPool(t)
+
+	tests := []struct {
+		route MessageRoute
+		key   string
+	}{
+		{MessageRoute{ProjectId: "brand-b"}, "key-b"},
+		{MessageRoute{AppId: "1:1:android:a"}, "key-a"},
+		{MessageRoute{PackageName: "com.brand.b"}, "key-b"},
+		{MessageRoute{PackageName: "com.other"}, "key-a"},
+	}
+
+	for _, test := range tests {
+		c, err := pool.Route(test.route)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.ApiKey != test.key {
+			t.Errorf("route %+v => %s, want %s", test.route, c.ApiKey, test.key)
+		}
+	}
+
+	if _, err := pool.Client("brand-c"); !errors.Is(err, ErrNoRoute) {
+		t.Fatalf("err => %v, want ErrNoRoute", err)
+	}
+
+	a, _ := pool.Client("brand-a")
+	b, _ := pool.Client("brand-b")
+	if a.httpClient == nil || a.httpClient != b.httpClient {
+		t.Fatal("clients should share the http client")
+	}
+}
+
+func TestClientPoolHotAddRemove(t *testing.T) {
+	pool := newTestPool(t)
+
+	err := pool.Add(ProjectConfig{ProjectId: "brand-c", ApiKey: "key-c", PackageNames: []string{"com.brand.b"}})
+	if err == nil {
+		t.Fatal("a package routed to another project should be refused")
+	}
+	if err := pool.Add(ProjectConfig{ProjectId: "brand-c"}); err == nil {
+		t.Fatal("a project without credentials should be refused")
+	}
+
+	if !pool.Remove("brand-b") || pool.Remove("brand-b") {
+		t.Fatal("Remove should remove the project once")
+	}
+	if err := pool.Add(ProjectConfig{ProjectId: "brand-c", ApiKey: "key-c", PackageNames: []string{"com.brand.b"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := pool.RouteMsg(&FcmMsg{To: "token", RestrictedPackageName: "com.brand.b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.ApiKey != "key-c" || c.Message.To != "token" {
+		t.Fatalf("client => %s %+v", c.ApiKey, c.Message)
+	}
+
+	if got := fmt.Sprint(pool.Projects()); got != "[brand-a brand-c]" {
+		t.Fatalf("projects => %s", got)
+	}
+
+	// concurrent routing while projects are replaced
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			pool.Route(MessageRoute{PackageName: "com.brand.b"})
+		}()
+		go func(i int) {
+			defer wg.Done()
+			pool.Add(ProjectConfig{ProjectId: "brand-c", ApiKey: fmt.Sprint("key-c", i), PackageNames: []string{"com.brand.b"}})
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestClientPoolSend(t *testing.T) {
+	var mu sync.Mutex
+	var keys []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		keys = append(keys, r.Header.Get("Authorization"))
+		mu.Unlock()
+		topicHandle(w, r)
+	}))
+	chgUrl(srv)
+	defer srv.Close()
+
+	pool := newTestPool(t)
+
+	for _, pkg := range []string{"com.brand.a", "com.brand.b"} {
+		c, err := pool.RouteMsg(&FcmMsg{To: "token", RestrictedPackageName: pkg})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.Send(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := fmt.Sprint(keys); got != "[key=key-a key=key-b]" {
+		t.Fatalf("keys => %s", got)
+	}
+}
+
+func TestClientPoolIgnoresBaseCredentials(t *testing.T) {
+	var mu sync.Mutex
+	var keys []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		keys = append(keys, r.Header.Get("Authorization"))
+		mu.Unlock()
+		topicHandle(w, r)
+	}))
+	chgUrl(srv)
+	defer srv.Close()
+
+	noop := func(ctx context.Context, call *Call, next Invoker) (interface{}, error) {
+		return next(ctx, call)
+	}
+	// three appends leave spare capacity in the interceptors of base
+	base := NewFcmClient("").SetCredentialProvider(NewStaticCredentials("base-key", "")).
+		AddInterceptor(noop).AddInterceptor(noop).AddInterceptor(noop)
+	pool := NewClientPool(base)
+	if err := pool.Add(ProjectConfig{ProjectId: "a", ApiKey: "key-a", Default: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.Add(ProjectConfig{ProjectId: "b", ApiKey: "key-b"}); err != nil {
+		t.Fatal(err)
+	}
+
+	a, _ := pool.Client("a")
+	b, _ := pool.Client("b")
+	counts := make(map[string]int)
+	for name, c := range map[string]*FcmClient{"a": a, "b": b} {
+		name := name
+		c.AddInterceptor(func(ctx context.Context, call *Call, next Invoker) (interface{}, error) {
+			counts[name]++
+			return next(ctx, call)
+		})
+	}
+
+	for _, c := range []*FcmClient{a, b} {
+		c.NewFcmMsgTo("token", nil)
+		if _, err := c.Send(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := fmt.Sprint(keys); got != "[key=key-a key=key-b]" {
+		t.Fatalf("keys => %s", got)
+	}
+	if counts["a"] != 1 || counts["b"] != 1 {
+		t.Fatalf("interceptor calls => %v", counts)
+	}
+}
+
+func TestClientPoolRouteCopiesInterceptors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(topicHandle))
+	chgUrl(srv)
+	defer srv.Close()
+
+	noop := func(ctx context.Context, call *Call, next Invoker) (interface{}, error) {
+		return next(ctx, call)
+	}
+	// five interceptors copied with spare capacity in the project client
+	base := NewFcmClient("").AddInterceptor(noop, noop, noop, noop, noop)
+	pool := NewClientPool(base)
+	if err := pool.Add(ProjectConfig{ProjectId: "a", ApiKey: "key-a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	first, _ := pool.Client("a")
+	second, _ := pool.Client("a")
+	counts := make(map[string]int)
+	for name, c := range map[string]*FcmClient{"first": first, "second": second} {
+		name := name
+		c.AddInterceptor(func(ctx context.Context, call *Call, next Invoker) (interface{}, error) {
+			counts[name]++
+			return next(ctx, call)
+		})
+	}
+
+	for _, c := range []*FcmClient{first, second} {
+		c.NewFcmMsgTo("token", nil)
+		if _, err := c.Send(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if counts["first"] != 1 || counts["second"] != 1 {
+		t.Fatalf("interceptor calls => %v", counts)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	l, err := NewRateLimiter(50, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if err := l.Wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 2 from the burst, 3 at 50/s
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("elapsed => %v, want about 60ms", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	l, _ = NewRateLimiter(0.001, 1)
+	if err := l.Wait(ctx); err != nil {
+		t.Fatal("the burst should not wait")
+	}
+	if err := l.Wait(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("err => %v, want context canceled", err)
+	}
+
+	l, _ = NewRateLimiter(0.001, 2)
+	if !l.Allow() || !l.Allow() || l.Allow() {
+		t.Fatal("Allow should take the burst, then refuse")
+	}
+
+	for _, rate := range []float64{0, -1} {
+		if _, err := NewRateLimiter(rate, 1); err == nil {
+			t.Fatalf("rate %v accepted", rate)
+		}
+	}
+}
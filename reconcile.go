@@ -0,0 +1,182 @@
+package fcm
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+const (
+	// topics_rel_key the rel key holding the topics of an instance
+	topics_rel_key = "topics"
+)
+
+// TopicPlan holds the changes needed to move devices/tokens from their
+// current topic subscriptions to the desired ones
+type TopicPlan struct {
+	// Subscribe topic name -> tokens to be added
+	Subscribe map[string][]string
+	// Unsubscribe topic name -> tokens to be removed
+	Unsubscribe map[string][]string
+	// Errors token -> instance id info error, these tokens are left untouched
+	Errors map[string]string
+}
+
+// TopicReconcileResult the plan and the batch responses of applying it
+type TopicReconcileResult struct {
+	Plan         *TopicPlan
+	DryRun       bool
+	Subscribed   map[string]*BatchResponse
+	Unsubscribed map[string]*BatchResponse
+}
+
+// PlanTopics compares the desired topics of each token (token -> topics)
+// with the current subscriptions (GetInfo with details) and returns
+// the adds and removes needed, nothing is changed
+func (this *FcmClient) PlanTopics(desired map[string][]string) (*TopicPlan, error) {
+
+	plan := newTopicPlan()
+
+	for token, wanted := range desired {
+
+		info, err := this.GetInfo(true, token)
+		var iidErr *IidError
+		if errors.As(err, &iidErr) && iidErr.IsTokenError() {
+			// the token is unknown or invalid, the others are still planned
+			plan.Errors[token] = iidErr.Code
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if info.Error != "" {
+			plan.Errors[token] = info.Error
+			continue
+		}
+
+		current := info.Rel[topics_rel_key]
+
+		want := make(map[string]bool, len(wanted))
+		for _, topic := range wanted {
+			topic = extractTopicName(topic)
+			want[topic] = true
+			if _, ok := current[topic]; !ok {
+				plan.Subscribe[topic] = append(plan.Subscribe[topic], token)
+			}
+		}
+
+		for topic := range current {
+			if !want[topic] {
+				plan.Unsubscribe[topic] = append(plan.Unsubscribe[topic], token)
+			}
+		}
+	}
+
+	plan.sortTokens()
+
+	return plan, nil
+}
+
+// ApplyTopicPlan executes the plan with one batch request per topic,
+// it stops at the first failing request and returns what has been done so
+// far, the response of the failing request included
+func (this *FcmClient) ApplyTopicPlan(plan *TopicPlan) (*TopicReconcileResult, error) {
+
+	result := &TopicReconcileResult{
+		Plan:         plan,
+		Subscribed:   make(map[string]*BatchResponse),
+		Unsubscribed: make(map[string]*BatchResponse),
+	}
+
+	for _, topic := range sortedTopics(plan.Subscribe) {
+		resp, err := this.BatchSubscribeToTopic(plan.Subscribe[topic], topic)
+		if resp != nil {
+			result.Subscribed[topic] = resp
+		}
+		if err != nil {
+			return result, err
+		}
+	}
+
+	for _, topic := range sortedTopics(plan.Unsubscribe) {
+		resp, err := this.BatchUnsubscribeFromTopic(plan.Unsubscribe[topic], topic)
+		if resp != nil {
+			result.Unsubscribed[topic] = resp
+		}
+		if err != nil {
+			return result, err
+		}
+	}
+
+	return result, nil
+}
+
+// ReconcileTopics plans the topic changes for the desired state and applies
+// them, with dryRun set to true only the plan is returned
+func (this *FcmClient) ReconcileTopics(desired map[string][]string, dryRun bool) (*TopicReconcileResult, error) {
+
+	plan, err := this.PlanTopics(desired)
+	if err != nil {
+		return nil, err
+	}
+
+	if dryRun {
+		return &TopicReconcileResult{Plan: plan, DryRun: true}, nil
+	}
+
+	return this.ApplyTopicPlan(plan)
+}
+
+// IsEmpty whether the plan has no changes
+func (this *TopicPlan) IsEmpty() bool {
+	return len(this.Subscribe) == 0 && len(this.Unsubscribe) == 0
+}
+
+// PrintResults prints TopicPlan, for reviewing a dry run
+func (this *TopicPlan) PrintResults() {
+	for _, topic := range sortedTopics(this.Subscribe) {
+		fmt.Println("+", topic, ":", len(this.Subscribe[topic]), "token(s)")
+		for _, token := range this.Subscribe[topic] {
+			fmt.Println("\t", token)
+		}
+	}
+	for _, topic := range sortedTopics(this.Unsubscribe) {
+		fmt.Println("-", topic, ":", len(this.Unsubscribe[topic]), "token(s)")
+		for _, token := range this.Unsubscribe[topic] {
+			fmt.Println("\t", token)
+		}
+	}
+	for token, e := range this.Errors {
+		fmt.Println("!", token, ":", e)
+	}
+}
+
+// newTopicPlan init an empty TopicPlan
+func newTopicPlan() *TopicPlan {
+	return &TopicPlan{
+		Subscribe:   make(map[string][]string),
+		Unsubscribe: make(map[string][]string),
+		Errors:      make(map[string]string),
+	}
+}
+
+// sortTokens sorts the tokens of every topic, for a stable plan
+func (this *TopicPlan) sortTokens() {
+	for _, tokens := range this.Subscribe {
+		sort.Strings(tokens)
+	}
+	for _, tokens := range this.Unsubscribe {
+		sort.Strings(tokens)
+	}
+}
+
+// sortedTopics returns the topic names in order
+func sortedTopics(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,200 @@
+package fcm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeIid a minimal in memory instance id server
+type fakeIid struct {
+	sync.Mutex
+	topics  map[string]map[string]bool
+	added   map[string][]string
+	removed map[string][]string
+	calls   int
+}
+
+func newFakeIid(topics map[string][]string) *fakeIid {
+	f := &fakeIid{
+		topics:  make(map[string]map[string]bool),
+		added:   make(map[string][]string),
+		removed: make(map[string][]string),
+	}
+	for token, list := range topics {
+		f.topics[token] = make(map[string]bool)
+		for _, t := range list {
+			f.topics[token][t] = true
+		}
+	}
+	return f
+}
+
+func (f *fakeIid) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/iid/info/"):
+		token := strings.TrimPrefix(r.URL.Path, "/iid/info/")
+		current, ok := f.topics[token]
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, `{"error":"No information found about this instance id."}`)
+			return
+		}
+		rel := map[string]map[string]map[string]string{"topics": {}}
+		for t := range current {
+			rel["topics"][t] = map[string]string{"addDate": "2016-07-02"}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"application": "com.comp.company", "rel": rel})
+
+	case r.URL.Path == "/iid/v1:batchAdd" || r.URL.Path == "/iid/v1:batchRemove":
+		f.calls++
+		req := new(BatchRequest)
+		json.NewDecoder(r.Body).Decode(req)
+		topic := extractTopicName(req.To)
+		results := make([]map[string]string, len(req.RegTokens))
+		for i, token := range req.RegTokens {
+			results[i] = map[string]string{}
+			if _, ok := f.topics[token]; !ok {
+				results[i]["error"] = "NOT_FOUND"
+				continue
+			}
+			if r.URL.Path == "/iid/v1:batchAdd" {
+				f.topics[token][topic] = true
+				f.added[topic] = append(f.added[topic], token)
+			} else {
+				delete(f.topics[token], topic)
+				f.removed[topic] = append(f.removed[topic], token)
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"results": results})
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestPlanTopics(t *testing.T) {
+	fake := newFakeIid(map[string][]string{
+		"token0": {"news", "sports"},
+		"token1": {"news"},
+	})
+	srv := httptest.NewServer(fake)
+	chgIidUrl(srv)
+	defer resetIidUrl()
+	defer srv.Close()
+
+	c := NewFcmClient("key")
+
+	plan, err := c.PlanTopics(map[string][]string{
+		"token0": {"/topics/news", "weather"},
+		"token1": {"sports", "weather"},
+		"token2": {"news"},
+	})
+	if err != nil {
+		t.Fatal("Plan Error: ", err)
+	}
+
+	if !reflect.DeepEqual(plan.Subscribe, map[string][]string{
+		"weather": {"token0", "token1"},
+		"sports":  {"token1"},
+	}) {
+		t.Error("Wrong subscribe plan: ", plan.Subscribe)
+	}
+	if !reflect.DeepEqual(plan.Unsubscribe, map[string][]string{
+		"sports": {"token0"},
+		"news":   {"token1"},
+	}) {
+		t.Error("Wrong unsubscribe plan: ", plan.Unsubscribe)
+	}
+	if _, ok := plan.Errors["token2"]; !ok {
+		t.Error("Expected an error for token2")
+	}
+}
+
+func TestPlanTopicsAuthError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintln(w, `{"error":"Unauthorized"}`)
+	}))
+	chgIidUrl(srv)
+	defer resetIidUrl()
+	defer srv.Close()
+
+	plan, err := NewFcmClient("bad-key").PlanTopics(map[string][]string{"token0": {"news"}})
+
+	iidErr := new(IidError)
+	if !errors.As(err, &iidErr) || iidErr.StatusCode != 401 || plan != nil {
+		t.Error("Expected the request error, got ", plan, err)
+	}
+}
+
+func TestReconcileTopicsDryRun(t *testing.T) {
+	fake := newFakeIid(map[string][]string{"token0": {"news"}})
+	srv := httptest.NewServer(fake)
+	chgIidUrl(srv)
+	defer resetIidUrl()
+	defer srv.Close()
+
+	c := NewFcmClient("key")
+
+	res, err := c.ReconcileTopics(map[string][]string{"token0": {"sports"}}, true)
+	if err != nil {
+		t.Fatal("Reconcile Error: ", err)
+	}
+	if !res.DryRun || res.Plan.IsEmpty() {
+		t.Error("Expected a non empty dry run plan")
+	}
+	if fake.calls != 0 {
+		t.Error("Dry run should not call batchAdd/batchRemove")
+	}
+}
+
+func TestReconcileTopicsApply(t *testing.T) {
+	current := make(map[string][]string)
+	desired := make(map[string][]string)
+	for i := 0; i < 2500; i++ {
+		token := fmt.Sprintf("token%d", i)
+		current[token] = []string{"old"}
+		desired[token] = []string{"new"}
+	}
+
+	fake := newFakeIid(current)
+	srv := httptest.NewServer(fake)
+	chgIidUrl(srv)
+	defer resetIidUrl()
+	defer srv.Close()
+
+	c := NewFcmClient("key")
+
+	res, err := c.ReconcileTopics(desired, false)
+	if err != nil {
+		t.Fatal("Reconcile Error: ", err)
+	}
+
+	if len(fake.added["new"]) != 2500 || len(fake.removed["old"]) != 2500 {
+		t.Error("Not all tokens were moved")
+	}
+	if len(res.Subscribed["new"].Results) != 2500 || len(res.Unsubscribed["old"].Results) != 2500 {
+		t.Error("Expected one merged result per token")
+	}
+	if fake.calls != 6 {
+		t.Error("Expected the tokens to be chunked into 3 requests per topic, got ", fake.calls)
+	}
+
+	plan, err := c.PlanTopics(desired)
+	if err != nil {
+		t.Fatal("Plan Error: ", err)
+	}
+	if !plan.IsEmpty() {
+		t.Error("Expected an empty plan after reconciling")
+	}
+}
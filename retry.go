@@ -0,0 +1,55 @@
+package fcm
+
+import (
+	"context"
+	"strconv"
+	"time"
+)
+
+// RetryInterceptor retries the send calls answered with an unavailable
+// error, at most retries times, waiting backoff doubled on every attempt
+// or the Retry-After of the response. A multicast is only retried if
+// nothing was sent (5xx), the other calls are not retried. The retries are
+// logged, counted and added to the span like the batch retries
+func RetryInterceptor(retries int, backoff time.Duration) Interceptor {
+	return func(ctx context.Context, call *Call, next Invoker) (interface{}, error) {
+		for attempt := 0; ; attempt++ {
+			resp, err := next(ctx, call)
+
+			status, ok := resp.(*FcmResponseStatus)
+			if err != nil || !ok || attempt >= retries || !status.retryable() {
+				return resp, err
+			}
+
+			wait := backoff << attempt
+			if seconds, err := strconv.Atoi(status.RetryAfter); err == nil && seconds > 0 {
+				wait = time.Duration(seconds) * time.Second
+			}
+			call.observeRetry(ctx, attempt+1, wait)
+
+			select {
+			case <-ctx.Done():
+				return resp, err
+			case <-time.After(wait):
+			}
+		}
+	}
+}
+
+// retryable whether a send response can be retried without sending twice
+func (this *FcmResponseStatus) retryable() bool {
+	if this.StatusCode >= 500 {
+		return true
+	}
+	return len(this.Results) <= 1 && this.IsTimeout()
+}
+
+// observeRetry reports a retry of the call to the logger, metrics and span
+func (this *Call) observeRetry(ctx context.Context, attempt int, wait time.Duration) {
+	if this.client != nil {
+		this.client.getLogger().Warn("fcm: retrying request",
+			"endpoint", this.Endpoint, "attempt", attempt, "backoff", wait)
+		this.client.getMetrics().ObserveRetry(this.Endpoint)
+	}
+	spanFromContext(ctx).AddEvent(event_retry, Attr(attr_retry_attempt, attempt))
+}
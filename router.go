@@ -0,0 +1,235 @@
+package fcm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+var (
+	// ErrNotDelivered no provider or fallback delivered the message
+	ErrNotDelivered = errors.New("fcm: message not delivered")
+)
+
+// Recipient a user and its devices
+type Recipient struct {
+	Id      string
+	Devices []Device
+}
+
+// Device a device of a recipient and its token for every provider, e.g.
+// {"fcm": fcm registration token, "apns": apns device token}
+type Device struct {
+	// Platform the route of the device, e.g. android, ios or web
+	Platform string
+	Tokens   map[string]string
+}
+
+// Fallback a non push channel (email, sms, ...) used when no device of a
+// recipient got the message
+type Fallback interface {
+	Name() string
+	Notify(ctx context.Context, recipient *Recipient, msg *FcmMsg) error
+}
+
+// RouteAttempt a send of a message to a device, or a fallback
+type RouteAttempt struct {
+	// Provider the provider or fallback name
+	Provider string
+	Token    string
+	// Error the error code or message, empty if delivered
+	Error string
+}
+
+// DeviceDelivery the delivery of a device
+type DeviceDelivery struct {
+	Platform string
+	// Provider the provider that delivered, empty if none did
+	Provider string
+	Attempts []RouteAttempt
+}
+
+// Delivery the outcome of FailoverRouter.Send
+type Delivery struct {
+	RecipientId string
+	Devices     []DeviceDelivery
+	// Fallback the fallback that delivered, if no device did
+	Fallback string
+	// FallbackAttempts the fallbacks tried, in order
+	FallbackAttempts []RouteAttempt
+}
+
+// Delivered reports whether a device or a fallback got the message
+func (this *Delivery) Delivered() bool {
+	if this.Fallback != "" {
+		return true
+	}
+	for _, device := range this.Devices {
+		if device.Provider != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// FailoverRouter sends a message to the devices of a recipient over the
+// providers of their platform, in the configured order: a provider that is
+// down (request error, 5xx, Unavailable) or refuses the token is followed
+// by the next one. When no device got the message, the fallbacks are
+// tried in order until one succeeds
+type FailoverRouter struct {
+	providers map[string]Sender
+	routes    map[string][]string
+	fallbacks []Fallback
+	logger    Logger
+}
+
+// NewFailoverRouter init a router without providers
+func NewFailoverRouter() *FailoverRouter {
+	return &FailoverRouter{
+		providers: make(map[string]Sender),
+		routes:    make(map[string][]string),
+	}
+}
+
+// AddProvider adds a provider under name, e.g. fcm or apns
+func (this *FailoverRouter) AddProvider(name string, sender Sender) *FailoverRouter {
+
+	this.providers[name] = sender
+
+	return this
+}
+
+// SetRoute sets the providers of a platform, in the order they are tried,
+// the route of the empty platform is used for the platforms without one
+func (this *FailoverRouter) SetRoute(platform string, providers ...string) *FailoverRouter {
+
+	this.routes[platform] = providers
+
+	return this
+}
+
+// AddFallback appends a fallback
+func (this *FailoverRouter) AddFallback(fallback Fallback) *FailoverRouter {
+
+	this.fallbacks = append(this.fallbacks, fallback)
+
+	return this
+}
+
+// SetLogger sets the logger of the router, nil disables logging
+func (this *FailoverRouter) SetLogger(l Logger) *FailoverRouter {
+
+	this.logger = l
+
+	return this
+}
+
+// getLogger returns the router logger or a no-op one
+func (this *FailoverRouter) getLogger() Logger {
+	if this.logger == nil {
+		return nopLogger{}
+	}
+	return this.logger
+}
+
+// Send sends msg (its notification, data and options, the targets are
+// replaced) to every device of recipient. The delivery records which
+// provider or fallback delivered, ErrNotDelivered is returned if none did
+func (this *FailoverRouter) Send(ctx context.Context, recipient *Recipient, msg *FcmMsg) (*Delivery, error) {
+
+	delivery := &Delivery{RecipientId: recipient.Id}
+
+	// providers found down are skipped for the next devices
+	down := make(map[string]bool)
+
+	for _, device := range recipient.Devices {
+		delivery.Devices = append(delivery.Devices, this.sendDevice(ctx, device, msg, down))
+		if ctx.Err() != nil {
+			return delivery, ctx.Err()
+		}
+	}
+
+	if delivery.Delivered() {
+		return delivery, nil
+	}
+
+	for _, fallback := range this.fallbacks {
+		err := fallback.Notify(ctx, recipient, msg)
+		if err == nil {
+			delivery.Fallback = fallback.Name()
+			delivery.FallbackAttempts = append(delivery.FallbackAttempts, RouteAttempt{Provider: fallback.Name()})
+			return delivery, nil
+		}
+		this.getLogger().Warn("fcm: fallback failed",
+			"recipient", recipient.Id, "fallback", fallback.Name(), "error", err)
+		delivery.FallbackAttempts = append(delivery.FallbackAttempts, RouteAttempt{Provider: fallback.Name(), Error: err.Error()})
+	}
+
+	return delivery, ErrNotDelivered
+}
+
+// sendDevice tries the providers of the device platform until one delivers
+func (this *FailoverRouter) sendDevice(ctx context.Context, device Device, msg *FcmMsg, down map[string]bool) DeviceDelivery {
+
+	result := DeviceDelivery{Platform: device.Platform}
+
+	route, ok := this.routes[device.Platform]
+	if !ok {
+		route = this.routes[""]
+	}
+
+	for _, name := range route {
+		token := device.Tokens[name]
+		sender := this.providers[name]
+		if token == "" || sender == nil || down[name] {
+			continue
+		}
+
+		single := *msg
+		single.To, single.RegistrationIds, single.Condition = token, nil, ""
+
+		code, unavailable := sendResult(sender.SendMsg(ctx, &single))
+		result.Attempts = append(result.Attempts, RouteAttempt{Provider: name, Token: token, Error: code})
+
+		if code == "" {
+			result.Provider = name
+			return result
+		}
+		if unavailable {
+			down[name] = true
+		}
+
+		this.getLogger().Warn("fcm: provider failed, trying the next one",
+			"platform", device.Platform, "provider", name, "token", redactToken(token), "error", code)
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	return result
+}
+
+// sendResult returns the error code of a single token send, empty if it
+// was delivered, and whether the provider is unavailable
+func sendResult(status *FcmResponseStatus, err error) (string, bool) {
+	switch {
+	case err != nil:
+		return err.Error(), true
+	case status == nil || status.StatusCode == 0:
+		return fcm_unavailable, true
+	case !status.Ok:
+		code := fmt.Sprintf("status %d", status.StatusCode)
+		return code, status.StatusCode >= 500 || status.StatusCode == http.StatusTooManyRequests
+	case status.Success > 0:
+		return "", false
+	case len(status.Results) > 0 && status.Results[0][error_key] != "":
+		code := status.Results[0][error_key]
+		return code, retreyableErrors[code]
+	case status.Err != "":
+		return status.Err, retreyableErrors[status.Err]
+	}
+	return fcm_unavailable, true
+}
@@ -0,0 +1,106 @@
+package fcm
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// fakeSender answers with a result per token: delivered, the error of
+// errors[token], or fails the request if down
+type fakeSender struct {
+	down   bool
+	errors map[string]string
+	sent   []string
+}
+
+func (s *fakeSender) SendMsg(ctx context.Context, msg *FcmMsg) (*FcmResponseStatus, error) {
+	s.sent = append(s.sent, msg.To)
+	if s.down {
+		return &FcmResponseStatus{StatusCode: 503}, nil
+	}
+	status := &FcmResponseStatus{Ok: true, StatusCode: 200}
+	if code := s.errors[msg.To]; code != "" {
+		status.Fail = 1
+		status.Results = []map[string]string{{error_key: code}}
+	} else {
+		status.Success = 1
+		status.Results = []map[string]string{{message_id_key: "id"}}
+	}
+	return status, nil
+}
+
+type fakeFallback struct {
+	name   string
+	err    error
+	called int
+}
+
+func (f *fakeFallback) Name() string { return f.name }
+
+func (f *fakeFallback) Notify(ctx context.Context, recipient *Recipient, msg *FcmMsg) error {
+	f.called++
+	return f.err
+}
+
+func TestFailoverRouterFailsOver(t *testing.T) {
+	fcmSender := &fakeSender{down: true}
+	apnsSender := &fakeSender{}
+	webSender := &fakeSender{errors: map[string]string{"w1": fcm_not_registered}}
+
+	router := NewFailoverRouter().
+		AddProvider("fcm", fcmSender).
+		AddProvider("apns", apnsSender).
+		AddProvider("webpush", webSender).
+		SetRoute("ios", "fcm", "apns").
+		SetRoute("", "fcm", "webpush")
+
+	recipient := &Recipient{Id: "u1", Devices: []Device{
+		{Platform: "ios", Tokens: map[string]string{"fcm": "f1", "apns": "a1"}},
+		{Platform: "ios", Tokens: map[string]string{"fcm": "f2", "apns": "a2"}},
+		{Platform: "web", Tokens: map[string]string{"fcm": "f3", "webpush": "w1"}},
+	}}
+
+	delivery, err := router.Send(context.Background(), recipient, &FcmMsg{To: "ignored", Data: map[string]string{"k": "v"}})
+	if err != nil {
+		t.Fatalf("Send => %v", err)
+	}
+	if delivery.Devices[0].Provider != "apns" || delivery.Devices[1].Provider != "apns" || delivery.Devices[2].Provider != "" {
+		t.Fatalf("delivery => %+v", delivery)
+	}
+	// fcm is skipped once found down
+	if len(fcmSender.sent) != 1 || len(apnsSender.sent) != 2 || apnsSender.sent[0] != "a1" {
+		t.Fatalf("sent fcm %v apns %v", fcmSender.sent, apnsSender.sent)
+	}
+	if attempts := delivery.Devices[2].Attempts; len(attempts) != 1 || attempts[0].Error != fcm_not_registered {
+		t.Fatalf("web attempts => %+v", attempts)
+	}
+}
+
+func TestFailoverRouterFallback(t *testing.T) {
+	email := &fakeFallback{name: "email", err: errors.New("smtp down")}
+	sms := &fakeFallback{name: "sms"}
+
+	router := NewFailoverRouter().
+		AddProvider("fcm", &fakeSender{errors: map[string]string{"f1": fcm_not_registered}}).
+		SetRoute("", "fcm").
+		AddFallback(email).
+		AddFallback(sms)
+
+	recipient := &Recipient{Id: "u1", Devices: []Device{{Platform: "android", Tokens: map[string]string{"fcm": "f1"}}}}
+
+	delivery, err := router.Send(context.Background(), recipient, &FcmMsg{})
+	if err != nil || delivery.Fallback != "sms" || !delivery.Delivered() {
+		t.Fatalf("Send => %+v %v", delivery, err)
+	}
+	if len(delivery.FallbackAttempts) != 2 || delivery.FallbackAttempts[0].Error != "smtp down" {
+		t.Fatalf("fallback attempts => %+v", delivery.FallbackAttempts)
+	}
+
+	// no device and no working fallback
+	sms.err = errors.New("no phone number")
+	delivery, err = router.Send(context.Background(), &Recipient{Id: "u2"}, &FcmMsg{})
+	if !errors.Is(err, ErrNotDelivered) || delivery.Delivered() {
+		t.Fatalf("Send => %+v %v", delivery, err)
+	}
+}
@@ -0,0 +1,26 @@
+package fcm
+
+import "context"
+
+// Sender sends a message, FcmClient, ApnsSender and WebPushSender
+// implement it so the provider can be chosen by configuration. Results of
+// the response are aligned with the tokens of the message, a token that
+// is no longer valid has the NotRegistered error whatever the provider
+type Sender interface {
+	SendMsg(ctx context.Context, msg *FcmMsg) (*FcmResponseStatus, error)
+}
+
+var (
+	_ Sender = (*FcmClient)(nil)
+	_ Sender = (*ApnsSender)(nil)
+	_ Sender = (*WebPushSender)(nil)
+)
+
+// SendMsg sends msg to fcm with ctx, the Message of the client is left
+// unchanged
+func (this *FcmClient) SendMsg(ctx context.Context, msg *FcmMsg) (*FcmResponseStatus, error) {
+	c := this.WithContext(ctx)
+	c.Message = *msg
+
+	return c.Send()
+}
@@ -0,0 +1,502 @@
+package fcm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+const (
+	// fcm_v1_send_srv_url fcm http v1 send url
+	fcm_v1_send_srv_url = "https://fcm.googleapis.com/v1/projects/%s/messages:send"
+	// fcm_batch_srv_url fcm batch url
+	fcm_batch_srv_url = "https://fcm.googleapis.com/batch"
+	// fcm_v1_send_path the path of a v1 send request inside a batch request
+	fcm_v1_send_path = "/v1/projects/%s/messages:send"
+
+	// max_batch_messages max number of messages per batch request
+	max_batch_messages = 500
+
+	// fcm_error_type the type of the fcm error details
+	fcm_error_type = "type.googleapis.com/google.firebase.fcm.v1.FcmError"
+
+	// batch_response_id_prefix Content-ID prefix of the batch response parts
+	batch_response_id_prefix = "response-"
+)
+
+var (
+	// v1 urls, for testing purposes
+	fcmV1SendUrl = fcm_v1_send_srv_url
+	fcmBatchUrl  = fcm_batch_srv_url
+)
+
+// SendResponse the outcome of a single v1 message
+type SendResponse struct {
+	Success bool
+	// MessageName projects/{project_id}/messages/{message_id}
+	MessageName string `json:"name,omitempty"`
+	StatusCode  int
+	// Error a *V1Error for an fcm error, or the request error of SendEach
+	Error error `json:"-"`
+}
+
+// BatchSendResponse the outcome of many v1 messages,
+// Responses are in the same order of the messages
+type BatchSendResponse struct {
+	SuccessCount int
+	FailureCount int
+	Responses    []*SendResponse
+}
+
+// V1Error an error response of the v1 api
+type V1Error struct {
+	StatusCode int
+	// Status the canonical error, e.g. INVALID_ARGUMENT
+	Status string
+	// ErrorCode the fcm error code, e.g. UNREGISTERED, or Status if the
+	// response has no fcm error details
+	ErrorCode string
+	Message   string
+}
+
+// v1ErrorBody the json body of a v1 error response
+type v1ErrorBody struct {
+	Error struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+		Status  string `json:"status"`
+		Details []struct {
+			Type      string `json:"@type"`
+			ErrorCode string `json:"errorCode"`
+		} `json:"details"`
+	} `json:"error"`
+}
+
+// SetV1Credentials sets the firebase project id and the oauth2 access
+// token used by the v1 api (SendV1, SendEach and SendAll)
+func (this *FcmClient) SetV1Credentials(projectId string, accessToken string) *FcmClient {
+
+	this.projectId = projectId
+	this.accessToken = accessToken
+
+	return this
+}
+
+// Error returns the v1 error message
+func (this *V1Error) Error() string {
+	return fmt.Sprintf("fcm: %s (%d): %s", this.ErrorCode, this.StatusCode, this.Message)
+}
+
+// SendV1 sends a single v1 message, an fcm error is returned in
+// SendResponse.Error, the error is for the request itself
+func (this *FcmClient) SendV1(msg *V1Message, validateOnly bool) (*SendResponse, error) {
+
+	ctx, span := this.startSpan("fcm.SendV1",
+		Attr(attr_endpoint, endpoint_send_v1),
+		Attr(attr_target_type, msg.targetType()),
+		Attr(attr_token_count, msg.tokenCount()))
+
+	resp, err := this.sendV1Once(ctx, &V1SendRequest{ValidateOnly: validateOnly, Message: msg})
+	if err == nil {
+		this.reportV1Results(ctx, endpoint_send_v1, []*V1Message{msg}, []*SendResponse{resp})
+	}
+	endSpan(span, err)
+
+	return resp, err
+}
+
+// SendEach sends every message with its own v1 request, at most
+// SetBatchConcurrency requests at the same time. Request errors are
+// returned in the SendResponse of the message
+func (this *FcmClient) SendEach(messages []*V1Message, validateOnly bool) (*BatchSendResponse, error) {
+
+	if len(messages) == 0 {
+		return nil, errors.New("fcm: no messages to send")
+	}
+
+	ctx, span := this.startSpan("fcm.SendEach",
+		Attr(attr_endpoint, endpoint_send_v1),
+		Attr(attr_token_count, len(messages)))
+
+	responses := make([]*SendResponse, len(messages))
+
+	runConcurrently(len(messages), this.getBatchConcurrency(), func(i int) {
+		resp, err := this.sendV1Once(ctx, &V1SendRequest{ValidateOnly: validateOnly, Message: messages[i]})
+		if err != nil {
+			resp = &SendResponse{Error: err}
+		}
+		responses[i] = resp
+	})
+
+	result := newBatchSendResponse(responses)
+	this.reportV1Results(ctx, endpoint_send_v1, messages, responses)
+	endSpan(span, nil)
+
+	return result, nil
+}
+
+// SendAll sends the messages with the fcm batch endpoint, packed as
+// multipart/mixed requests of at most 500 messages. If a batch request
+// fails as a whole, its error is returned with the responses of all the
+// messages, the messages of the failed batch having it as Error
+func (this *FcmClient) SendAll(messages []*V1Message, validateOnly bool) (*BatchSendResponse, error) {
+
+	if len(messages) == 0 {
+		return nil, errors.New("fcm: no messages to send")
+	}
+
+	ctx, span := this.startSpan("fcm.SendAll",
+		Attr(attr_endpoint, endpoint_batch_send),
+		Attr(attr_token_count, len(messages)))
+
+	numChunks := (len(messages) + max_batch_messages - 1) / max_batch_messages
+	chunks := make([][]*SendResponse, numChunks)
+	errs := make([]error, numChunks)
+
+	runConcurrently(numChunks, this.getBatchConcurrency(), func(i int) {
+		end := (i + 1) * max_batch_messages
+		if end > len(messages) {
+			end = len(messages)
+		}
+
+		requests := make([]*V1SendRequest, 0, end-i*max_batch_messages)
+		for _, msg := range messages[i*max_batch_messages : end] {
+			requests = append(requests, &V1SendRequest{ValidateOnly: validateOnly, Message: msg})
+		}
+
+		chunks[i], errs[i] = this.batchSendOnce(ctx, requests)
+	})
+
+	var firstErr error
+	responses := make([]*SendResponse, 0, len(messages))
+	for i, chunk := range chunks {
+		if errs[i] == nil {
+			responses = append(responses, chunk...)
+			continue
+		}
+		if firstErr == nil {
+			firstErr = errs[i]
+		}
+		for j := i * max_batch_messages; j < len(messages) && j < (i+1)*max_batch_messages; j++ {
+			responses = append(responses, &SendResponse{Error: errs[i]})
+		}
+	}
+
+	result := newBatchSendResponse(responses)
+	this.reportV1Results(ctx, endpoint_batch_send, messages, responses)
+	endSpan(span, firstErr)
+
+	return result, firstErr
+}
+
+// sendV1Once sends a single v1 request through the interceptors
+func (this *FcmClient) sendV1Once(ctx context.Context, req *V1SendRequest) (*SendResponse, error) {
+
+	req, err := this.encryptV1(req)
+	if err != nil {
+		return nil, err
+	}
+
+	call := newCall(endpoint_send_v1, "POST", fmt.Sprintf(fcmV1SendUrl, this.projectId), req)
+
+	resp, err := this.invoke(ctx, call, this.sendV1Invoker)
+	if err != nil {
+		return nil, err
+	}
+
+	sendResp, ok := resp.(*SendResponse)
+	if !ok {
+		return nil, responseTypeError(endpoint_send_v1, resp)
+	}
+
+	return sendResp, nil
+}
+
+// sendV1Invoker sends the v1 send call to fcm
+func (this *FcmClient) sendV1Invoker(ctx context.Context, call *Call) (interface{}, error) {
+
+	req, ok := call.Message.(*V1SendRequest)
+	if !ok {
+		return nil, messageTypeError(call)
+	}
+
+	jsonByte, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("fcm: encoding v1 message: %w", err)
+	}
+
+	response, body, err := this.doRequest(ctx, call, jsonByte)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseV1Response(response.StatusCode, body), nil
+}
+
+// batchSendOnce sends a single batch request through the interceptors
+func (this *FcmClient) batchSendOnce(ctx context.Context, requests []*V1SendRequest) ([]*SendResponse, error) {
+
+	for i, req := range requests {
+		encrypted, err := this.encryptV1(req)
+		if err != nil {
+			return nil, err
+		}
+		requests[i] = encrypted
+	}
+
+	call := newCall(endpoint_batch_send, "POST", fcmBatchUrl, requests)
+
+	resp, err := this.invoke(ctx, call, this.batchSendInvoker)
+	if err != nil {
+		return nil, err
+	}
+
+	batchResp, ok := resp.(*BatchSendResponse)
+	if !ok {
+		return nil, responseTypeError(endpoint_batch_send, resp)
+	}
+
+	return batchResp.Responses, nil
+}
+
+// batchSendInvoker packs the v1 requests as a multipart/mixed request and
+// parses the multipart/mixed response
+func (this *FcmClient) batchSendInvoker(ctx context.Context, call *Call) (interface{}, error) {
+
+	requests, ok := call.Message.([]*V1SendRequest)
+	if !ok {
+		return nil, messageTypeError(call)
+	}
+
+	payload, contentType, err := this.encodeBatchSend(requests)
+	if err != nil {
+		return nil, err
+	}
+	call.Header.Set("Content-Type", contentType)
+
+	response, body, err := this.doRequest(ctx, call, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return nil, parseV1Error(response.StatusCode, body)
+	}
+
+	responses, err := decodeBatchSend(response.Header.Get("Content-Type"), body, len(requests))
+	if err != nil {
+		return nil, err
+	}
+
+	return newBatchSendResponse(responses), nil
+}
+
+// encodeBatchSend writes every request as an application/http part
+func (this *FcmClient) encodeBatchSend(requests []*V1SendRequest) ([]byte, string, error) {
+
+	buf := new(bytes.Buffer)
+	w := multipart.NewWriter(buf)
+	path := fmt.Sprintf(fcm_v1_send_path, this.projectId)
+
+	for i, req := range requests {
+		jsonByte, err := json.Marshal(req)
+		if err != nil {
+			return nil, "", fmt.Errorf("fcm: encoding v1 message %d: %w", i, err)
+		}
+
+		header := make(textproto.MIMEHeader)
+		header.Set("Content-Type", "application/http")
+		header.Set("Content-Transfer-Encoding", "binary")
+		header.Set("Content-ID", strconv.Itoa(i+1))
+
+		part, err := w.CreatePart(header)
+		if err != nil {
+			return nil, "", fmt.Errorf("fcm: encoding batch request: %w", err)
+		}
+
+		fmt.Fprintf(part, "POST %s HTTP/1.1\r\n", path)
+		fmt.Fprintf(part, "Content-Type: application/json; charset=UTF-8\r\n")
+		fmt.Fprintf(part, "Content-Length: %d\r\n\r\n", len(jsonByte))
+		part.Write(jsonByte)
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, "", fmt.Errorf("fcm: encoding batch request: %w", err)
+	}
+
+	return buf.Bytes(), "multipart/mixed; boundary=" + w.Boundary(), nil
+}
+
+// decodeBatchSend parses the http response of every part, in the order of
+// their Content-ID (response-N) or of the parts
+func decodeBatchSend(contentType string, body []byte, n int) ([]*SendResponse, error) {
+
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		return nil, fmt.Errorf("fcm: unexpected batch response type %q", contentType)
+	}
+
+	responses := make([]*SendResponse, n)
+	reader := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+
+	for i := 0; ; i++ {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("fcm: reading batch response: %w", err)
+		}
+
+		idx := i
+		if id := strings.Trim(part.Header.Get("Content-ID"), "<>"); strings.HasPrefix(id, batch_response_id_prefix) {
+			if num, err := strconv.Atoi(strings.TrimPrefix(id, batch_response_id_prefix)); err == nil {
+				idx = num - 1
+			}
+		}
+		if idx < 0 || idx >= n {
+			return nil, fmt.Errorf("fcm: unexpected batch response part %d", idx+1)
+		}
+
+		partResp, err := http.ReadResponse(bufio.NewReader(part), nil)
+		if err != nil {
+			return nil, fmt.Errorf("fcm: reading batch response part %d: %w", idx+1, err)
+		}
+		partBody, err := ioutil.ReadAll(partResp.Body)
+		partResp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("fcm: reading batch response part %d: %w", idx+1, err)
+		}
+
+		responses[idx] = parseV1Response(partResp.StatusCode, partBody)
+	}
+
+	for i, resp := range responses {
+		if resp == nil {
+			return nil, fmt.Errorf("fcm: missing batch response part %d", i+1)
+		}
+	}
+
+	return responses, nil
+}
+
+// parseV1Response parses the response of a v1 send request
+func parseV1Response(statusCode int, body []byte) *SendResponse {
+
+	resp := &SendResponse{StatusCode: statusCode}
+
+	if statusCode < 200 || statusCode > 299 {
+		resp.Error = parseV1Error(statusCode, body)
+		return resp
+	}
+
+	if err := json.Unmarshal(body, resp); err != nil {
+		resp.Error = fmt.Errorf("fcm: parsing v1 response: %w", err)
+		return resp
+	}
+	resp.Success = true
+
+	return resp
+}
+
+// parseV1Error parses a v1 error response, the status is used as error
+// code if the body is not a json error
+func parseV1Error(statusCode int, body []byte) *V1Error {
+
+	v1Err := &V1Error{StatusCode: statusCode}
+
+	errBody := new(v1ErrorBody)
+	if err := json.Unmarshal(body, errBody); err != nil {
+		v1Err.ErrorCode = http.StatusText(statusCode)
+		v1Err.Message = strings.TrimSpace(string(body))
+		return v1Err
+	}
+
+	v1Err.Status = errBody.Error.Status
+	v1Err.Message = errBody.Error.Message
+	v1Err.ErrorCode = errBody.Error.Status
+	for _, detail := range errBody.Error.Details {
+		if detail.Type == fcm_error_type && detail.ErrorCode != "" {
+			v1Err.ErrorCode = detail.ErrorCode
+		}
+	}
+
+	return v1Err
+}
+
+// newBatchSendResponse counts the successful and failed responses
+func newBatchSendResponse(responses []*SendResponse) *BatchSendResponse {
+	result := &BatchSendResponse{Responses: responses}
+	for _, resp := range responses {
+		if resp.Success {
+			result.SuccessCount++
+		} else {
+			result.FailureCount++
+		}
+	}
+	return result
+}
+
+// reportV1Results logs, records and traces the outcome of every message
+func (this *FcmClient) reportV1Results(ctx context.Context, endpoint string, messages []*V1Message, responses []*SendResponse) {
+	logger := this.getLogger()
+	metrics := this.getMetrics()
+	span := spanFromContext(ctx)
+
+	failed := 0
+	for i, resp := range responses {
+		if resp.Success {
+			metrics.ObserveTokenOutcome(endpoint, outcome_ok)
+			continue
+		}
+		failed++
+
+		code := "UNKNOWN"
+		v1Err := new(V1Error)
+		if errors.As(resp.Error, &v1Err) {
+			code = v1Err.ErrorCode
+		}
+		metrics.ObserveTokenOutcome(endpoint, code)
+
+		target := messages[i].Token
+		if target != "" {
+			target = redactToken(target)
+		} else {
+			target = messages[i].Topic + messages[i].Condition
+		}
+		logger.Info("fcm: message failed", "endpoint", endpoint, "target", target, "error", resp.Error)
+		span.AddEvent(event_token_error, Attr(attr_token, target), Attr(attr_token_index, i), Attr(attr_error, code))
+	}
+
+	span.SetAttributes(Attr(attr_success_count, len(responses)-failed), Attr(attr_failure_count, failed))
+}
+
+// targetType returns the target of the message: condition, topic or token
+func (this *V1Message) targetType() string {
+	switch {
+	case this.Condition != "":
+		return "condition"
+	case this.Topic != "":
+		return "topic"
+	}
+	return "token"
+}
+
+// tokenCount returns the number of tokens targeted by the message
+func (this *V1Message) tokenCount() int {
+	if this.Token != "" {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,264 @@
+package fcm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const (
+	unregistered_body = `{"error":{"code":404,"message":"Requested entity was not found.","status":"NOT_FOUND","details":[{"@type":"type.googleapis.com/google.firebase.fcm.v1.FcmError","errorCode":"UNREGISTERED"}]}}`
+)
+
+// v1Handle answers v1 send and batch requests, tokens prefixed with "bad"
+// are unregistered
+type v1Handle struct {
+	sync.Mutex
+	sends   int
+	batches int
+	auth    string
+}
+
+func (h *v1Handle) reply(req *V1SendRequest) (int, string) {
+	if strings.HasPrefix(req.Message.Token, "bad") {
+		return http.StatusNotFound, unregistered_body
+	}
+	return http.StatusOK, fmt.Sprintf(`{"name":"projects/p/messages/%s"}`, req.Message.Token)
+}
+
+func (h *v1Handle) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.Lock()
+	h.auth = r.Header.Get("Authorization")
+	h.Unlock()
+
+	if r.URL.Path == "/v1/projects/p/messages:send" {
+		h.Lock()
+		h.sends++
+		h.Unlock()
+
+		req := new(V1SendRequest)
+		json.NewDecoder(r.Body).Decode(req)
+		code, body := h.reply(req)
+		w.WriteHeader(code)
+		fmt.Fprint(w, body)
+		return
+	}
+
+	h.Lock()
+	h.batches++
+	h.Unlock()
+
+	_, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	reader := multipart.NewReader(r.Body, params["boundary"])
+
+	out := multipart.NewWriter(w)
+	w.Header().Set("Content-Type", "multipart/mixed; boundary="+out.Boundary())
+
+	var parts []string
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			break
+		}
+		inner, err := http.ReadRequest(bufio.NewReader(part))
+		if err != nil || inner.URL.Path != "/v1/projects/p/messages:send" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		req := new(V1SendRequest)
+		json.NewDecoder(inner.Body).Decode(req)
+		code, body := h.reply(req)
+		parts = append(parts, fmt.Sprintf("HTTP/1.1 %d %s\r\nContent-Type: application/json\r\n\r\n%s", code, http.StatusText(code), body))
+	}
+
+	// reply in reverse order, the Content-ID keeps them aligned
+	for i := len(parts) - 1; i >= 0; i-- {
+		pw, _ := out.CreatePart(map[string][]string{
+			"Content-Type": {"application/http"},
+			"Content-ID":   {fmt.Sprintf("<response-%d>", i+1)},
+		})
+		fmt.Fprint(pw, parts[i])
+	}
+	out.Close()
+}
+
+func chgV1Url(ts *httptest.Server) {
+	fcmV1SendUrl = ts.URL + "/v1/projects/%s/messages:send"
+	fcmBatchUrl = ts.URL + "/batch"
+}
+
+func resetV1Url() {
+	fcmV1SendUrl = fcm_v1_send_srv_url
+	fcmBatchUrl = fcm_batch_srv_url
+}
+
+func v1Messages(n int) []*V1Message {
+	messages := make([]*V1Message, n)
+	for i := range messages {
+		token := fmt.Sprintf("token%d", i)
+		if i%4 == 3 {
+			token = fmt.Sprintf("bad%d", i)
+		}
+		messages[i] = &V1Message{Token: token, Notification: &V1Notification{Title: token}}
+	}
+	return messages
+}
+
+func checkBatchSendResponse(t *testing.T, messages []*V1Message, resp *BatchSendResponse) {
+	if len(resp.Responses) != len(messages) {
+		t.Fatal("Expected one response per message, got ", len(resp.Responses))
+	}
+	for i, msg := range messages {
+		r := resp.Responses[i]
+		if strings.HasPrefix(msg.Token, "bad") {
+			v1Err := new(V1Error)
+			if r.Success || !errors.As(r.Error, &v1Err) || v1Err.ErrorCode != "UNREGISTERED" || v1Err.StatusCode != 404 {
+				t.Fatal("Expected UNREGISTERED for ", msg.Token, ": ", r.Error)
+			}
+			continue
+		}
+		if !r.Success || r.MessageName != "projects/p/messages/"+msg.Token {
+			t.Fatal("Response not aligned with message ", msg.Token, ": ", r.MessageName)
+		}
+	}
+	if resp.FailureCount != len(messages)/4 || resp.SuccessCount != len(messages)-len(messages)/4 {
+		t.Error("Wrong counts: ", resp.SuccessCount, resp.FailureCount)
+	}
+}
+
+func TestSendAll(t *testing.T) {
+	h := new(v1Handle)
+	srv := httptest.NewServer(h)
+	chgV1Url(srv)
+	defer resetV1Url()
+	defer srv.Close()
+
+	c := NewFcmClient("key").SetV1Credentials("p", "access-token")
+
+	messages := v1Messages(1200)
+
+	resp, err := c.SendAll(messages, false)
+	if err != nil {
+		t.Fatal("SendAll Error: ", err)
+	}
+
+	checkBatchSendResponse(t, messages, resp)
+
+	if h.batches != 3 || h.sends != 0 {
+		t.Error("Expected 3 batch requests, got ", h.batches, h.sends)
+	}
+	if h.auth != "Bearer access-token" {
+		t.Error("Wrong authorization: ", h.auth)
+	}
+}
+
+func TestSendEach(t *testing.T) {
+	h := new(v1Handle)
+	srv := httptest.NewServer(h)
+	chgV1Url(srv)
+	defer resetV1Url()
+	defer srv.Close()
+
+	c := NewFcmClient("key").SetV1Credentials("p", "access-token")
+
+	messages := v1Messages(40)
+
+	resp, err := c.SendEach(messages, true)
+	if err != nil {
+		t.Fatal("SendEach Error: ", err)
+	}
+
+	checkBatchSendResponse(t, messages, resp)
+
+	if h.sends != 40 || h.batches != 0 {
+		t.Error("Expected 40 single requests, got ", h.sends, h.batches)
+	}
+}
+
+func TestSendAllRequestError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"error":{"code":401,"message":"Request had invalid authentication credentials.","status":"UNAUTHENTICATED"}}`)
+	}))
+	chgV1Url(srv)
+	defer resetV1Url()
+	defer srv.Close()
+
+	c := NewFcmClient("key").SetV1Credentials("p", "expired")
+
+	_, err := c.SendAll(v1Messages(2), false)
+
+	v1Err := new(V1Error)
+	if !errors.As(err, &v1Err) || v1Err.ErrorCode != "UNAUTHENTICATED" {
+		t.Error("Expected an UNAUTHENTICATED error, got ", err)
+	}
+
+	if _, err := c.SendAll(nil, false); err == nil {
+		t.Error("Expected an error for no messages")
+	}
+}
+
+func TestSendAllPartialFailure(t *testing.T) {
+	h := new(v1Handle)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		// the second batch fails
+		if strings.Contains(string(body), `"token500"`) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		h.ServeHTTP(w, r)
+	}))
+	chgV1Url(srv)
+	defer resetV1Url()
+	defer srv.Close()
+
+	c := NewFcmClient("key").SetV1Credentials("p", "access-token")
+
+	messages := v1Messages(1000)
+	resp, err := c.SendAll(messages, false)
+	if err == nil || resp == nil || len(resp.Responses) != len(messages) {
+		t.Fatal("Expected the responses with the error, got ", resp, err)
+	}
+
+	checkBatchSendResponse(t, messages[:500], &BatchSendResponse{SuccessCount: 375, FailureCount: 125, Responses: resp.Responses[:500]})
+	for _, r := range resp.Responses[500:] {
+		if r.Success || r.Error != err {
+			t.Fatal("Expected the batch error, got ", r.Error)
+		}
+	}
+	if resp.SuccessCount != 375 || resp.FailureCount != 625 {
+		t.Error("Wrong counts: ", resp.SuccessCount, resp.FailureCount)
+	}
+}
+
+func TestSendV1(t *testing.T) {
+	h := new(v1Handle)
+	srv := httptest.NewServer(h)
+	chgV1Url(srv)
+	defer resetV1Url()
+	defer srv.Close()
+
+	c := NewFcmClient("key").SetV1Credentials("p", "access-token")
+
+	resp, err := c.SendV1(&V1Message{Token: "token0"}, false)
+	if err != nil || !resp.Success || resp.MessageName != "projects/p/messages/token0" {
+		t.Error("Wrong response: ", resp, err)
+	}
+
+	resp, err = c.SendV1(&V1Message{Token: "bad0"}, false)
+	if err != nil || resp.Success || resp.Error == nil {
+		t.Error("Expected an fcm error: ", resp, err)
+	}
+}
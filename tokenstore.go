@@ -0,0 +1,91 @@
+package fcm
+
+import (
+	"sort"
+	"sync"
+)
+
+const (
+	// token platforms of a TokenRecord
+	platform_apns = "apns"
+)
+
+// TokenRecord a registration token and what it was created from
+type TokenRecord struct {
+	// Token the fcm registration token
+	Token string
+	// Platform the platform of the source token, e.g. apns
+	Platform string
+	// App the application (bundle id) of the token
+	App string
+	// Sandbox whether the source token is an apns sandbox token
+	Sandbox bool
+	// Source the platform token the registration token was created for
+	Source string
+}
+
+// TokenStore persists the registration tokens created by the importers
+// and purged by the deletions, implementations must be safe for concurrent
+// use, see MemoryTokenStore
+type TokenStore interface {
+	// Put saves the records, replacing the records with the same Token
+	Put(records []TokenRecord) error
+	// Delete removes the records of the registration tokens, unknown
+	// tokens are ignored
+	Delete(tokens []string) error
+}
+
+// MemoryTokenStore an in memory TokenStore
+type MemoryTokenStore struct {
+	mu      sync.RWMutex
+	records map[string]TokenRecord
+}
+
+// NewMemoryTokenStore init an empty in memory store
+func NewMemoryTokenStore() *MemoryTokenStore {
+	return &MemoryTokenStore{records: make(map[string]TokenRecord)}
+}
+
+// Put saves the records
+func (this *MemoryTokenStore) Put(records []TokenRecord) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	for _, record := range records {
+		this.records[record.Token] = record
+	}
+	return nil
+}
+
+// Delete removes the records of the tokens
+func (this *MemoryTokenStore) Delete(tokens []string) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	for _, token := range tokens {
+		delete(this.records, token)
+	}
+	return nil
+}
+
+// Get returns the record of a registration token
+func (this *MemoryTokenStore) Get(token string) (TokenRecord, bool) {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	record, ok := this.records[token]
+	return record, ok
+}
+
+// Tokens returns the registration tokens of the store in order
+func (this *MemoryTokenStore) Tokens() []string {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	tokens := make([]string, 0, len(this.records))
+	for token := range this.records {
+		tokens = append(tokens, token)
+	}
+	sort.Strings(tokens)
+	return tokens
+}
@@ -0,0 +1,110 @@
+package fcm
+
+import (
+	"context"
+)
+
+const (
+	// span attribute keys
+	attr_endpoint      = "fcm.endpoint"
+	attr_target_type   = "fcm.target_type"
+	attr_token_count   = "fcm.token_count"
+	attr_status_code   = "http.status_code"
+	attr_success_count = "fcm.success_count"
+	attr_failure_count = "fcm.failure_count"
+	attr_retry_attempt = "fcm.retry_attempt"
+	attr_token         = "fcm.token"
+	attr_token_index   = "fcm.token_index"
+	attr_error         = "fcm.error"
+
+	// span event names
+	event_retry       = "fcm.retry"
+	event_token_error = "fcm.token_error"
+	event_send_error  = "fcm.send_error"
+)
+
+// Tracer opens a span around every client call, named after the method
+// (fcm.Send, fcm.SendAll, fcm.DeleteTokens, ...), it follows the
+// OpenTelemetry API so an adapter is a few lines. The returned context
+// is used for the http requests of the call
+type Tracer interface {
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span a single traced call
+type Span interface {
+	SetAttributes(attrs ...Attribute)
+	AddEvent(name string, attrs ...Attribute)
+	RecordError(err error)
+	End()
+}
+
+// Attribute a span attribute or event attribute
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// Attr creates an Attribute
+func Attr(key string, value interface{}) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// spanKey context key of the current span
+type spanKey struct{}
+
+// nopTracer opens no-op spans
+type nopTracer struct{}
+
+func (nopTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	return ctx, nopSpan{}
+}
+
+// nopSpan discards everything
+type nopSpan struct{}
+
+func (nopSpan) SetAttributes(attrs ...Attribute)         {}
+func (nopSpan) AddEvent(name string, attrs ...Attribute) {}
+func (nopSpan) RecordError(err error)                    {}
+func (nopSpan) End()                                     {}
+
+// SetTracer sets the tracer of the client, nil disables tracing
+func (this *FcmClient) SetTracer(t Tracer) *FcmClient {
+
+	this.tracer = t
+
+	return this
+}
+
+// getTracer returns the client tracer or a no-op one
+func (this *FcmClient) getTracer() Tracer {
+	if this.tracer == nil {
+		return nopTracer{}
+	}
+	return this.tracer
+}
+
+// startSpan opens a span from the client context, the span is kept in the
+// returned context so the request internals can add attributes and events
+func (this *FcmClient) startSpan(name string, attrs ...Attribute) (context.Context, Span) {
+	ctx, span := this.getTracer().Start(this.context(), name)
+	span.SetAttributes(attrs...)
+
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// spanFromContext returns the span of the context or a no-op one
+func spanFromContext(ctx context.Context) Span {
+	if span, ok := ctx.Value(spanKey{}).(Span); ok {
+		return span
+	}
+	return nopSpan{}
+}
+
+// endSpan records the error, if any, and ends the span
+func endSpan(span Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
+}
@@ -0,0 +1,146 @@
+package fcm
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// recordTracer keeps the spans in memory
+type recordTracer struct {
+	sync.Mutex
+	spans []*recordSpan
+}
+
+type recordSpan struct {
+	sync.Mutex
+	name   string
+	attrs  map[string]interface{}
+	events []string
+	err    error
+	ended  bool
+}
+
+type traceKey struct{}
+
+func (t *recordTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	span := &recordSpan{name: name, attrs: make(map[string]interface{})}
+	t.Lock()
+	t.spans = append(t.spans, span)
+	t.Unlock()
+	return context.WithValue(ctx, traceKey{}, name), span
+}
+
+func (s *recordSpan) SetAttributes(attrs ...Attribute) {
+	s.Lock()
+	defer s.Unlock()
+	for _, a := range attrs {
+		s.attrs[a.Key] = a.Value
+	}
+}
+
+func (s *recordSpan) AddEvent(name string, attrs ...Attribute) {
+	s.Lock()
+	defer s.Unlock()
+	s.events = append(s.events, name)
+}
+
+func (s *recordSpan) RecordError(err error) { s.err = err }
+
+func (s *recordSpan) End() { s.ended = true }
+
+func TestTracerSend(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(regIdHandle))
+	chgUrl(srv)
+	defer srv.Close()
+
+	tracer := new(recordTracer)
+	c := NewFcmClient("key").SetTracer(tracer)
+	c.NewFcmRegIdsMsg([]string{"token0", "token1", "token2"}, map[string]string{"msg": "Hello World"})
+
+	if _, err := c.Send(); err != nil {
+		t.Fatal("Response Error : ", err)
+	}
+
+	if len(tracer.spans) != 1 {
+		t.Fatal("Expected a single span, got ", len(tracer.spans))
+	}
+
+	span := tracer.spans[0]
+	if span.name != "fcm.Send" || !span.ended {
+		t.Error("Wrong span: ", span.name, span.ended)
+	}
+
+	expected := map[string]interface{}{
+		attr_endpoint:      endpoint_send,
+		attr_target_type:   "tokens",
+		attr_token_count:   3,
+		attr_status_code:   200,
+		attr_success_count: 2,
+		attr_failure_count: 1,
+	}
+	for k, v := range expected {
+		if span.attrs[k] != v {
+			t.Error("Wrong attribute ", k, ": ", span.attrs[k])
+		}
+	}
+
+	if len(span.events) != 1 || span.events[0] != event_token_error {
+		t.Error("Expected a token error event, got ", span.events)
+	}
+}
+
+func TestTracerBatchRetry(t *testing.T) {
+	batchRetryBackoff = 0
+
+	h := &batchHandle{seen: make(map[string]bool)}
+	srv := httptest.NewServer(h)
+	chgIidUrl(srv)
+	defer resetIidUrl()
+	defer srv.Close()
+
+	tracer := new(recordTracer)
+	c := NewFcmClient("key").SetTracer(tracer)
+
+	if _, err := c.BatchSubscribeToTopic([]string{"token0", "flaky1", "bad2"}, "news"); err != nil {
+		t.Fatal("Batch Error: ", err)
+	}
+
+	span := tracer.spans[0]
+	if span.name != "fcm.BatchSubscribeToTopic" {
+		t.Error("Wrong span name: ", span.name)
+	}
+	if span.attrs[attr_success_count] != 2 || span.attrs[attr_failure_count] != 1 {
+		t.Error("Wrong counts: ", span.attrs)
+	}
+	if len(span.events) != 2 || span.events[0] != event_retry || span.events[1] != event_token_error {
+		t.Error("Wrong events: ", span.events)
+	}
+}
+
+func TestTracerContextPropagation(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(topicHandle))
+	chgUrl(srv)
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tracer := new(recordTracer)
+	c := NewFcmClient("key").SetTracer(tracer).WithContext(ctx)
+	c.NewFcmMsgTo("/topics/topicName", map[string]string{"msg": "Hello World"})
+
+	if _, err := c.Send(); err == nil {
+		t.Error("Expected an error with a canceled context")
+	}
+
+	span := tracer.spans[0]
+	if span.err == nil || !span.ended {
+		t.Error("Expected the error to be recorded on the span")
+	}
+	if span.attrs[attr_target_type] != "topic" || span.attrs[attr_token_count] != 0 {
+		t.Error("Wrong target attributes: ", span.attrs)
+	}
+}
@@ -0,0 +1,122 @@
+package fcm
+
+const (
+	// v1 android priorities
+	android_priority_high   = "HIGH"
+	android_priority_normal = "NORMAL"
+
+	// apns headers
+	apns_priority_header    = "apns-priority"
+	apns_collapse_id_header = "apns-collapse-id"
+
+	// apns priorities
+	apns_priority_high   = "10"
+	apns_priority_normal = "5"
+
+	// webpush ttl header
+	webpush_ttl_header = "TTL"
+)
+
+// V1Message represents a fcm http v1 message
+// https://firebase.google.com/docs/reference/fcm/rest/v1/projects.messages
+type V1Message struct {
+	Name         string            `json:"name,omitempty"`
+	Data         map[string]string `json:"data,omitempty"`
+	Notification *V1Notification   `json:"notification,omitempty"`
+	Android      *AndroidConfig    `json:"android,omitempty"`
+	Webpush      *WebpushConfig    `json:"webpush,omitempty"`
+	Apns         *ApnsConfig       `json:"apns,omitempty"`
+	FcmOptions   *V1FcmOptions     `json:"fcm_options,omitempty"`
+	Token        string            `json:"token,omitempty"`
+	Topic        string            `json:"topic,omitempty"`
+	Condition    string            `json:"condition,omitempty"`
+}
+
+// V1Notification basic notification template used across all platforms
+type V1Notification struct {
+	Title string `json:"title,omitempty"`
+	Body  string `json:"body,omitempty"`
+	Image string `json:"image,omitempty"`
+}
+
+// AndroidConfig android specific options
+type AndroidConfig struct {
+	CollapseKey           string               `json:"collapse_key,omitempty"`
+	Priority              string               `json:"priority,omitempty"`
+	Ttl                   string               `json:"ttl,omitempty"`
+	RestrictedPackageName string               `json:"restricted_package_name,omitempty"`
+	Data                  map[string]string    `json:"data,omitempty"`
+	Notification          *AndroidNotification `json:"notification,omitempty"`
+}
+
+// AndroidNotification notification sent to android devices
+type AndroidNotification struct {
+	Title        string   `json:"title,omitempty"`
+	Body         string   `json:"body,omitempty"`
+	Icon         string   `json:"icon,omitempty"`
+	Color        string   `json:"color,omitempty"`
+	Sound        string   `json:"sound,omitempty"`
+	Tag          string   `json:"tag,omitempty"`
+	ClickAction  string   `json:"click_action,omitempty"`
+	BodyLocKey   string   `json:"body_loc_key,omitempty"`
+	BodyLocArgs  []string `json:"body_loc_args,omitempty"`
+	TitleLocKey  string   `json:"title_loc_key,omitempty"`
+	TitleLocArgs []string `json:"title_loc_args,omitempty"`
+	ChannelId    string   `json:"channel_id,omitempty"`
+}
+
+// WebpushConfig webpush protocol options
+type WebpushConfig struct {
+	Headers      map[string]string      `json:"headers,omitempty"`
+	Data         map[string]string      `json:"data,omitempty"`
+	Notification map[string]interface{} `json:"notification,omitempty"`
+	FcmOptions   *WebpushFcmOptions     `json:"fcm_options,omitempty"`
+}
+
+// WebpushFcmOptions options for features provided by the fcm sdk for web
+type WebpushFcmOptions struct {
+	Link string `json:"link,omitempty"`
+}
+
+// ApnsConfig apple push notification service specific options
+type ApnsConfig struct {
+	Headers map[string]string `json:"headers,omitempty"`
+	Payload *ApnsPayload      `json:"payload,omitempty"`
+}
+
+// ApnsPayload the apns payload, only the aps dictionary is supported
+type ApnsPayload struct {
+	Aps *Aps `json:"aps,omitempty"`
+}
+
+// Aps the aps dictionary of an apns payload
+type Aps struct {
+	Alert            *ApsAlert `json:"alert,omitempty"`
+	Badge            *int      `json:"badge,omitempty"`
+	Sound            string    `json:"sound,omitempty"`
+	ContentAvailable int       `json:"content-available,omitempty"`
+	MutableContent   int       `json:"mutable-content,omitempty"`
+	Category         string    `json:"category,omitempty"`
+	ThreadId         string    `json:"thread-id,omitempty"`
+}
+
+// ApsAlert the alert dictionary of aps
+type ApsAlert struct {
+	Title        string   `json:"title,omitempty"`
+	Body         string   `json:"body,omitempty"`
+	LocKey       string   `json:"loc-key,omitempty"`
+	LocArgs      []string `json:"loc-args,omitempty"`
+	TitleLocKey  string   `json:"title-loc-key,omitempty"`
+	TitleLocArgs []string `json:"title-loc-args,omitempty"`
+}
+
+// V1FcmOptions platform independent options
+type V1FcmOptions struct {
+	AnalyticsLabel string `json:"analytics_label,omitempty"`
+}
+
+// V1SendRequest the body of a v1 messages:send request
+type V1SendRequest struct {
+	ValidateOnly bool       `json:"validate_only,omitempty"`
+	Message      *V1Message `json:"message"`
+}
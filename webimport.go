@@ -0,0 +1,231 @@
+package fcm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	// web_push_import_srv_url
+	web_push_import_srv_url = "https://iid.googleapis.com/v1/web/iid"
+
+	// crypto_key_header carries the vapid public key of a web push import
+	crypto_key_header = "Crypto-Key"
+)
+
+var (
+	// webPushImportUrl for testing purposes
+	webPushImportUrl = web_push_import_srv_url
+)
+
+// WebPushSubscription a browser Push API subscription, as returned by
+// PushSubscription.toJSON()
+type WebPushSubscription struct {
+	Endpoint string      `json:"endpoint"`
+	Keys     WebPushKeys `json:"keys"`
+}
+
+// WebPushKeys the encryption keys of a subscription, base64url encoded
+type WebPushKeys struct {
+	P256dh string `json:"p256dh"`
+	Auth   string `json:"auth"`
+}
+
+// WebImportRequest the import of a single subscription, VapidKey is the
+// base64url application server (vapid) public key of the subscription
+type WebImportRequest struct {
+	VapidKey     string
+	Subscription WebPushSubscription
+}
+
+// WebImportResponse the response of a single subscription import
+type WebImportResponse struct {
+	Token      string `json:"token,omitempty"`
+	Error      string `json:"error,omitempty"`
+	Status     string
+	StatusCode int
+}
+
+// WebImportResult the outcome of a subscription of WebPushImportRequest
+type WebImportResult struct {
+	Endpoint string
+	// Token the fcm registration token of the subscription
+	Token string
+	// Err a BatchError (or the error of the request), nil if the token was created
+	Err error
+}
+
+// WebImportBatchResponse the results of WebPushImportRequest, aligned with
+// the subscriptions
+type WebImportBatchResponse struct {
+	Results []WebImportResult
+}
+
+// WebPushImportRequest creates the registration tokens of web push
+// subscriptions, the subscriptions are imported concurrently (see
+// SetBatchConcurrency) and the INTERNAL and 5xx errors are retried
+func (this *FcmClient) WebPushImportRequest(vapidKey string, subscriptions []WebPushSubscription) (*WebImportBatchResponse, error) {
+
+	ctx, span := this.startSpan("fcm.WebPushImportRequest",
+		Attr(attr_endpoint, endpoint_web_import),
+		Attr(attr_target_type, "web_subscriptions"),
+		Attr(attr_token_count, len(subscriptions)))
+
+	result := &WebImportBatchResponse{Results: make([]WebImportResult, len(subscriptions))}
+
+	runConcurrently(len(subscriptions), this.getBatchConcurrency(), func(i int) {
+		result.Results[i] = this.webImportOne(ctx, &WebImportRequest{VapidKey: vapidKey, Subscription: subscriptions[i]})
+	})
+
+	failed := 0
+	for _, val := range result.Results {
+		if val.Err == nil {
+			this.getMetrics().ObserveTokenOutcome(endpoint_web_import, outcome_ok)
+			continue
+		}
+		failed++
+		this.getMetrics().ObserveTokenOutcome(endpoint_web_import, webImportCode(val.Err))
+		this.getLogger().Info("fcm: web subscription failed",
+			"endpoint", endpoint_web_import, "error", val.Err)
+	}
+	span.SetAttributes(Attr(attr_success_count, len(subscriptions)-failed), Attr(attr_failure_count, failed))
+
+	var err error
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	endSpan(span, err)
+
+	return result, err
+}
+
+// webImportOne imports a subscription, retrying the INTERNAL and 5xx errors
+// with an exponential backoff
+func (this *FcmClient) webImportOne(ctx context.Context, req *WebImportRequest) WebImportResult {
+
+	result := WebImportResult{Endpoint: req.Subscription.Endpoint}
+	backoff := batchRetryBackoff
+
+	for attempt := 0; ; attempt++ {
+
+		resp, err := this.webImport(ctx, req)
+
+		var iidErr *IidError
+		switch {
+		case err == nil:
+			result.Token, result.Err = resp.Token, nil
+			return result
+		case errors.As(err, &iidErr) && iidErr.Code != "":
+			result.Err = BatchError(iidErr.Code)
+		default:
+			result.Err = err
+		}
+
+		retryable := errors.Is(err, ErrInternal) || (iidErr != nil && iidErr.StatusCode >= 500)
+		if !retryable || attempt >= batch_max_retries {
+			return result
+		}
+
+		this.getLogger().Warn("fcm: retrying web subscription",
+			"endpoint", endpoint_web_import, "attempt", attempt+1, "backoff", backoff)
+		this.getMetrics().ObserveRetry(endpoint_web_import)
+		spanFromContext(ctx).AddEvent(event_retry, Attr(attr_retry_attempt, attempt+1))
+
+		select {
+		case <-ctx.Done():
+			return result
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// webImport sends a single web push import request, a non 2xx response
+// is returned as an *IidError
+func (this *FcmClient) webImport(ctx context.Context, req *WebImportRequest) (*WebImportResponse, error) {
+
+	call := newCall(endpoint_web_import, "POST", webPushImportUrl, req)
+	call.Header.Set(crypto_key_header, "p256ecdsa="+req.VapidKey)
+
+	resp, err := this.invoke(ctx, call, this.webImportInvoker)
+	if err != nil {
+		return nil, err
+	}
+
+	result, ok := resp.(*WebImportResponse)
+	if !ok {
+		return nil, responseTypeError(endpoint_web_import, resp)
+	}
+
+	return result, nil
+}
+
+// webImportInvoker sends the web push import call to the instance id server
+func (this *FcmClient) webImportInvoker(ctx context.Context, call *Call) (interface{}, error) {
+
+	webReq, ok := call.Message.(*WebImportRequest)
+	if !ok {
+		return nil, messageTypeError(call)
+	}
+
+	jsonByte, err := json.Marshal(webReq.Subscription)
+	if err != nil {
+		return nil, fmt.Errorf("fcm: encoding web push import request: %w", err)
+	}
+
+	response, body, err := this.doRequest(ctx, call, jsonByte)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return nil, parseIidError(body, response)
+	}
+
+	result := new(WebImportResponse)
+	if err := json.Unmarshal(body, result); err != nil {
+		return nil, fmt.Errorf("fcm: parsing web push import response: %w", err)
+	}
+	result.Status = response.Status
+	result.StatusCode = response.StatusCode
+
+	return result, nil
+}
+
+// webImportCode the metrics code of a failed subscription
+func webImportCode(err error) string {
+	var code BatchError
+	if errors.As(err, &code) {
+		return string(code)
+	}
+	var iidErr *IidError
+	if errors.As(err, &iidErr) {
+		return http.StatusText(iidErr.StatusCode)
+	}
+	return "error"
+}
+
+// Succeeded returns the results of the subscriptions imported
+func (this *WebImportBatchResponse) Succeeded() []WebImportResult {
+	return partitionWeb(this.Results, true)
+}
+
+// Failed returns the results of the subscriptions not imported
+func (this *WebImportBatchResponse) Failed() []WebImportResult {
+	return partitionWeb(this.Results, false)
+}
+
+// partitionWeb returns the web results succeeded (or failed)
+func partitionWeb(results []WebImportResult, succeeded bool) []WebImportResult {
+	var part []WebImportResult
+	for _, result := range results {
+		if (result.Err == nil) == succeeded {
+			part = append(part, result)
+		}
+	}
+	return part
+}
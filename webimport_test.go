@@ -0,0 +1,81 @@
+package fcm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// webImportHandle creates "reg-<endpoint>" tokens, replies INVALID_ARGUMENT
+// for the endpoints prefixed with "bad" and INTERNAL for the first request
+// of the endpoints prefixed with "flaky"
+type webImportHandle struct {
+	sync.Mutex
+	seen  map[string]bool
+	calls int
+	keys  map[string]bool
+}
+
+func (h *webImportHandle) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	sub := WebPushSubscription{}
+	json.NewDecoder(r.Body).Decode(&sub)
+
+	h.Lock()
+	defer h.Unlock()
+	h.calls++
+	h.keys[r.Header.Get(crypto_key_header)] = true
+
+	switch {
+	case sub.Keys.P256dh == "" || sub.Keys.Auth == "" || strings.HasPrefix(sub.Endpoint, "bad"):
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"error":"INVALID_ARGUMENT"}`)
+	case strings.HasPrefix(sub.Endpoint, "flaky") && !h.seen[sub.Endpoint]:
+		h.seen[sub.Endpoint] = true
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, `{"error":"INTERNAL"}`)
+	default:
+		fmt.Fprintf(w, `{"token":"reg-%s"}`, sub.Endpoint)
+	}
+}
+
+func TestWebPushImport(t *testing.T) {
+	batchRetryBackoff = 0
+
+	h := &webImportHandle{seen: make(map[string]bool), keys: make(map[string]bool)}
+	srv := httptest.NewServer(h)
+	chgIidUrl(srv)
+	defer resetIidUrl()
+	defer srv.Close()
+
+	keys := WebPushKeys{P256dh: "BNc...", Auth: "tBH..."}
+	subscriptions := []WebPushSubscription{
+		{Endpoint: "e1", Keys: keys},
+		{Endpoint: "bad2", Keys: keys},
+		{Endpoint: "flaky3", Keys: keys},
+		{Endpoint: "e4"},
+	}
+
+	resp, err := NewFcmClient("key").SetBatchConcurrency(2).WebPushImportRequest("vapid", subscriptions)
+	if err != nil {
+		t.Fatalf("WebPushImportRequest => %v", err)
+	}
+
+	if len(resp.Results) != 4 || resp.Results[0].Token != "reg-e1" || resp.Results[2].Token != "reg-flaky3" {
+		t.Fatalf("results => %+v", resp.Results)
+	}
+	failed := resp.Failed()
+	if len(failed) != 2 || failed[0].Endpoint != "bad2" || !errors.Is(failed[1].Err, ErrInvalidArgument) {
+		t.Fatalf("failed => %+v", failed)
+	}
+	if len(resp.Succeeded()) != 2 {
+		t.Fatalf("succeeded => %+v", resp.Succeeded())
+	}
+	if h.calls != 5 || len(h.keys) != 1 || !h.keys["p256ecdsa=vapid"] {
+		t.Fatalf("calls => %d, keys => %v", h.calls, h.keys)
+	}
+}
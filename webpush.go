@@ -0,0 +1,479 @@
+package fcm
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// web push request headers
+	webpush_urgency_header = "Urgency"
+	webpush_topic_header   = "Topic"
+
+	// webpush_default_ttl ttl of the messages without time_to_live, web
+	// push requires one
+	webpush_default_ttl = 4 * 7 * 24 * 3600
+
+	// webpush_record_size the aes128gcm record size, a single record is sent
+	webpush_record_size = 4096
+
+	// webpush_max_body max size of the encrypted body accepted by the push
+	// services
+	webpush_max_body = 4096
+
+	// webpush_header_size size of the aes128gcm header: salt, record size,
+	// key id length and the uncompressed p-256 key
+	webpush_header_size = 16 + 4 + 1 + 65
+
+	// webpush_max_payload max plaintext size: the body minus the header,
+	// the padding delimiter and the gcm tag
+	webpush_max_payload = webpush_max_body - webpush_header_size - 1 - 16
+
+	// webpush_max_topic max size of the Topic header
+	webpush_max_topic = 32
+
+	// base64UrlAlphabet the characters of a web push topic
+	base64UrlAlphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
+
+	// default_webpush_timeout timeout of a push service request
+	default_webpush_timeout = 30 * time.Second
+
+	// vapid_token_lifetime how long a vapid token is used, at most 24h
+	vapid_token_lifetime = 12 * time.Hour
+
+	// fcm_message_too_big error of a payload refused by the push service
+	fcm_message_too_big = "MessageTooBig"
+)
+
+// WebPushSender sends the messages straight to the push services of the
+// browsers (RFC 8030), the payload is encrypted with aes128gcm (RFC 8291)
+// and the requests authenticated with vapid (RFC 8292). The tokens of the
+// messages are subscriptions, as the json of PushSubscription by default
+// (see SetSubscriptionResolver). An expired subscription (404, 410) has the
+// NotRegistered error and is purged from the token store
+type WebPushSender struct {
+	key     *ecdsa.PrivateKey
+	public  []byte
+	subject string
+
+	resolver    func(token string) (*WebPushSubscription, error)
+	httpClient  *http.Client
+	logger      Logger
+	tokenStore  TokenStore
+	concurrency int
+
+	mu     sync.Mutex
+	tokens map[string]vapidToken
+}
+
+// vapidToken a signed vapid jwt of an audience
+type vapidToken struct {
+	jwt     string
+	expires time.Time
+}
+
+// webPushPayload the json sent to the service worker
+type webPushPayload struct {
+	Notification *V1Notification   `json:"notification,omitempty"`
+	Data         map[string]string `json:"data,omitempty"`
+}
+
+// NewWebPushSender init a sender with the base64url vapid private key
+// (the raw P-256 scalar) and the subject, a mailto: or https: contact url
+func NewWebPushSender(privateKey string, subject string) (*WebPushSender, error) {
+
+	raw, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(privateKey, "="))
+	if err != nil {
+		return nil, fmt.Errorf("fcm: decoding vapid key: %w", err)
+	}
+	priv, err := ecdh.P256().NewPrivateKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("fcm: invalid vapid key: %w", err)
+	}
+
+	public := priv.PublicKey().Bytes()
+	key := &ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(public[1:33]),
+			Y:     new(big.Int).SetBytes(public[33:]),
+		},
+		D: new(big.Int).SetBytes(raw),
+	}
+
+	return &WebPushSender{
+		key:        key,
+		public:     public,
+		subject:    subject,
+		resolver:   decodeWebPushSubscription,
+		httpClient: &http.Client{Timeout: default_webpush_timeout},
+		tokens:     make(map[string]vapidToken),
+	}, nil
+}
+
+// VapidPublicKey returns the base64url public key, the applicationServerKey
+// of the browser subscriptions
+func (this *WebPushSender) VapidPublicKey() string {
+	return base64.RawURLEncoding.EncodeToString(this.public)
+}
+
+// SetSubscriptionResolver sets the function returning the subscription
+// of a token, e.g. from a database
+func (this *WebPushSender) SetSubscriptionResolver(fn func(token string) (*WebPushSubscription, error)) *WebPushSender {
+
+	this.resolver = fn
+
+	return this
+}
+
+// SetHttpClient sets the http client of the push service requests
+func (this *WebPushSender) SetHttpClient(c *http.Client) *WebPushSender {
+
+	this.httpClient = c
+
+	return this
+}
+
+// SetLogger sets the logger of the sender, nil disables logging
+func (this *WebPushSender) SetLogger(l Logger) *WebPushSender {
+
+	this.logger = l
+
+	return this
+}
+
+// SetTokenStore sets the store the expired subscriptions are purged from
+func (this *WebPushSender) SetTokenStore(store TokenStore) *WebPushSender {
+
+	this.tokenStore = store
+
+	return this
+}
+
+// SetConcurrency sets the max number of subscriptions sent at the same time
+func (this *WebPushSender) SetConcurrency(n int) *WebPushSender {
+
+	this.concurrency = n
+
+	return this
+}
+
+// getLogger returns the sender logger or a no-op one
+func (this *WebPushSender) getLogger() Logger {
+	if this.logger == nil {
+		return nopLogger{}
+	}
+	return this.logger
+}
+
+// SendMsg sends the notification and data of msg to every subscription.
+// The results are aligned with the tokens: the Location of the push
+// message as message_id, or the error: NotRegistered (404, 410),
+// MessageTooBig (413), Unavailable (429, 5xx) or the status
+func (this *WebPushSender) SendMsg(ctx context.Context, msg *FcmMsg) (*FcmResponseStatus, error) {
+
+	if msg.DryRun {
+		return new(FcmResponseStatus), errors.New("fcm: dry_run is not supported by web push")
+	}
+
+	conv, err := ConvertToV1(msg)
+	if err != nil {
+		return new(FcmResponseStatus), err
+	}
+	if conv.Messages[0].Token == "" {
+		return new(FcmResponseStatus), errors.New("fcm: web push sender only supports subscriptions")
+	}
+
+	payload, err := json.Marshal(&webPushPayload{Notification: conv.Messages[0].Notification, Data: conv.Messages[0].Data})
+	if err != nil {
+		return new(FcmResponseStatus), fmt.Errorf("fcm: encoding web push payload: %w", err)
+	}
+	if len(payload) > webpush_max_payload {
+		return new(FcmResponseStatus), fmt.Errorf("fcm: web push payload of %d bytes, max %d", len(payload), webpush_max_payload)
+	}
+
+	headers, err := webPushHeaders(msg)
+	if err != nil {
+		return new(FcmResponseStatus), err
+	}
+
+	status := &FcmResponseStatus{Ok: true, StatusCode: http.StatusOK}
+	status.Results = make([]map[string]string, len(conv.Messages))
+
+	concurrency := this.concurrency
+	if concurrency <= 0 {
+		concurrency = default_batch_concurrency
+	}
+	runConcurrently(len(conv.Messages), concurrency, func(i int) {
+		status.Results[i] = this.sendSubscription(ctx, conv.Messages[i].Token, headers, payload)
+	})
+
+	var expired []string
+	for i, val := range status.Results {
+		switch val[error_key] {
+		case "":
+			status.Success++
+			continue
+		case fcm_not_registered:
+			expired = append(expired, conv.Messages[i].Token)
+		}
+		status.Fail++
+	}
+
+	if this.tokenStore != nil && len(expired) > 0 {
+		if err := this.tokenStore.Delete(expired); err != nil {
+			return status, fmt.Errorf("fcm: purging tokens: %w", err)
+		}
+	}
+
+	return status, ctx.Err()
+}
+
+// webPushHeaders maps the ttl, priority and collapse key of msg
+func webPushHeaders(msg *FcmMsg) (http.Header, error) {
+
+	headers := make(http.Header)
+
+	ttl := webpush_default_ttl
+	if msg.TimeToLive > 0 {
+		ttl = msg.TimeToLive
+	}
+	headers.Set(webpush_ttl_header, strconv.Itoa(ttl))
+
+	switch msg.Priority {
+	case Priority_HIGH:
+		headers.Set(webpush_urgency_header, "high")
+	case Priority_NORMAL:
+		headers.Set(webpush_urgency_header, "normal")
+	}
+
+	if msg.CollapseKey != "" {
+		if len(msg.CollapseKey) > webpush_max_topic || strings.Trim(msg.CollapseKey, base64UrlAlphabet) != "" {
+			return nil, fmt.Errorf("fcm: collapse_key %q is not a web push topic (max %d base64url characters)", msg.CollapseKey, webpush_max_topic)
+		}
+		headers.Set(webpush_topic_header, msg.CollapseKey)
+	}
+
+	headers.Set("Content-Encoding", "aes128gcm")
+	headers.Set("Content-Type", "application/octet-stream")
+
+	return headers, nil
+}
+
+// sendSubscription encrypts and sends the payload to a subscription
+func (this *WebPushSender) sendSubscription(ctx context.Context, token string, headers http.Header, payload []byte) map[string]string {
+
+	result := this.post(ctx, token, headers, payload)
+	if result[error_key] != "" {
+		this.getLogger().Info("fcm: web push subscription failed",
+			"token", redactToken(token), "error", result[error_key])
+	}
+	return result
+}
+
+// post sends a single push message and returns its result
+func (this *WebPushSender) post(ctx context.Context, token string, headers http.Header, payload []byte) map[string]string {
+
+	sub, err := this.resolver(token)
+	if err != nil {
+		return map[string]string{error_key: fmt.Sprintf("fcm: resolving subscription: %v", err)}
+	}
+
+	body, err := encryptWebPush(sub, payload)
+	if err != nil {
+		return map[string]string{error_key: err.Error()}
+	}
+
+	auth, err := this.vapidHeader(sub.Endpoint)
+	if err != nil {
+		return map[string]string{error_key: err.Error()}
+	}
+
+	request, err := http.NewRequestWithContext(ctx, "POST", sub.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return map[string]string{error_key: err.Error()}
+	}
+	for k, v := range headers {
+		request.Header[k] = v
+	}
+	request.Header.Set("Authorization", auth)
+
+	response, err := this.httpClient.Do(request)
+	if err != nil {
+		this.getLogger().Error("fcm: web push request failed", "error", redactUrlError(err))
+		return map[string]string{error_key: fcm_unavailable}
+	}
+	defer response.Body.Close()
+	ioutil.ReadAll(response.Body)
+
+	switch {
+	case response.StatusCode >= 200 && response.StatusCode <= 299:
+		return map[string]string{message_id_key: response.Header.Get("Location")}
+	case response.StatusCode == http.StatusNotFound, response.StatusCode == http.StatusGone:
+		return map[string]string{error_key: fcm_not_registered}
+	case response.StatusCode == http.StatusRequestEntityTooLarge:
+		return map[string]string{error_key: fcm_message_too_big}
+	case response.StatusCode == http.StatusTooManyRequests, response.StatusCode >= 500:
+		return map[string]string{error_key: fcm_unavailable}
+	}
+	return map[string]string{error_key: response.Status}
+}
+
+// vapidHeader returns the vapid Authorization of the push service of
+// endpoint, the token of an audience is reused until it expires soon
+func (this *WebPushSender) vapidHeader(endpoint string) (string, error) {
+
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return "", fmt.Errorf("fcm: invalid subscription endpoint %q", redactToken(endpoint))
+	}
+	audience := u.Scheme + "://" + u.Host
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	now := time.Now()
+	token, ok := this.tokens[audience]
+	if !ok || time.Until(token.expires) < token_refresh_margin {
+		jwt, err := this.vapidJwt(audience, now.Add(vapid_token_lifetime))
+		if err != nil {
+			return "", err
+		}
+		token = vapidToken{jwt: jwt, expires: now.Add(vapid_token_lifetime)}
+		this.tokens[audience] = token
+	}
+
+	return "vapid t=" + token.jwt + ", k=" + this.VapidPublicKey(), nil
+}
+
+// vapidJwt signs (ES256) the vapid claims of an audience
+func (this *WebPushSender) vapidJwt(audience string, expires time.Time) (string, error) {
+
+	header, _ := json.Marshal(map[string]string{"typ": "JWT", "alg": "ES256"})
+	claims, _ := json.Marshal(map[string]interface{}{"aud": audience, "exp": expires.Unix(), "sub": this.subject})
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signed))
+
+	r, s, err := ecdsa.Sign(rand.Reader, this.key, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// decodeWebPushSubscription the default resolver, token is the json of
+// the subscription
+func decodeWebPushSubscription(token string) (*WebPushSubscription, error) {
+	sub := new(WebPushSubscription)
+	if err := json.Unmarshal([]byte(token), sub); err != nil {
+		return nil, err
+	}
+	return sub, nil
+}
+
+// encryptWebPush encrypts payload for the subscription with a new
+// ephemeral key and salt
+func encryptWebPush(sub *WebPushSubscription, payload []byte) ([]byte, error) {
+
+	uaPublic, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(sub.Keys.P256dh, "="))
+	if err != nil {
+		return nil, fmt.Errorf("fcm: decoding subscription p256dh: %w", err)
+	}
+	authSecret, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(sub.Keys.Auth, "="))
+	if err != nil {
+		return nil, fmt.Errorf("fcm: decoding subscription auth: %w", err)
+	}
+
+	asPrivate, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	return encryptAes128gcm(payload, uaPublic, authSecret, asPrivate, salt)
+}
+
+// encryptAes128gcm the RFC 8291 encryption of payload in a single record:
+// salt, record size, key id (the public key of asPrivate) and ciphertext
+func encryptAes128gcm(payload []byte, uaPublic []byte, authSecret []byte, asPrivate *ecdh.PrivateKey, salt []byte) ([]byte, error) {
+
+	uaKey, err := ecdh.P256().NewPublicKey(uaPublic)
+	if err != nil {
+		return nil, fmt.Errorf("fcm: invalid subscription p256dh: %w", err)
+	}
+	ecdhSecret, err := asPrivate.ECDH(uaKey)
+	if err != nil {
+		return nil, err
+	}
+	asPublic := asPrivate.PublicKey().Bytes()
+
+	// IKM = HKDF(auth_secret, ecdh_secret, "WebPush: info" || 0x00 || ua_public || as_public, 32)
+	keyInfo := append(append([]byte("WebPush: info\x00"), uaPublic...), asPublic...)
+	ikm := hkdf(authSecret, ecdhSecret, keyInfo, 32)
+
+	cek := hkdf(salt, ikm, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	nonce := hkdf(salt, ikm, []byte("Content-Encoding: nonce\x00"), 12)
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// a single, last record: the padding delimiter is 0x02
+	plaintext := append(append([]byte{}, payload...), 0x02)
+
+	header := make([]byte, 0, 16+4+1+len(asPublic))
+	header = append(header, salt...)
+	header = binary.BigEndian.AppendUint32(header, webpush_record_size)
+	header = append(header, byte(len(asPublic)))
+	header = append(header, asPublic...)
+
+	return gcm.Seal(header, nonce, plaintext, nil), nil
+}
+
+// hkdf the HKDF-SHA256 (RFC 5869) of a single block, length <= 32
+func hkdf(salt []byte, ikm []byte, info []byte, length int) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(ikm)
+	prk := extract.Sum(nil)
+
+	expand := hmac.New(sha256.New, prk)
+	expand.Write(info)
+	expand.Write([]byte{0x01})
+
+	return expand.Sum(nil)[:length]
+}
@@ -0,0 +1,268 @@
+package fcm
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func b64(t *testing.T, s string) []byte {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// RFC 8291 appendix A
+func TestEncryptAes128gcmVector(t *testing.T) {
+	asPrivate, err := ecdh.P256().NewPrivateKey(b64(t, "yfWPiYE-n46HLnH0KqZOF1fJJU3MYrct3AELtAQ-oRw"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := encryptAes128gcm([]byte("When I grow up, I want to be a watermelon"),
+		b64(t, "BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcxaOzi6-AYWXvTBHm4bjyPjs7Vd8pZGH6SRpkNtoIAiw4"),
+		b64(t, "BTBZMqHH6r4Tts7J_aSIgg"), asPrivate, b64(t, "DGv6ra1nlYgDCS1FRnbzlw"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "DGv6ra1nlYgDCS1FRnbzlwAAEABBBP4z9KsN6nGRTbVYI_c7VJSPQTBtkgcy27mlmlMoZIIgDll6e3vCYLocInmYWAmS6TlzAC8wEqKK6PBru3jl7A_yl95bQpu6cVPTpK4Mqgkf1CXztLVBSt2Ks3oZwbuwXPXLWyouBWLVWGNWQexSgSxsj_Qulcy4a-fN"
+	if got := base64.RawURLEncoding.EncodeToString(body); got != expected {
+		t.Fatalf("body =>\n%s\nwant\n%s", got, expected)
+	}
+}
+
+// pushService a push service stub with a single browser, it decrypts the
+// messages, checks the vapid token and answers 410 for the endpoints
+// ending with "gone"
+type pushService struct {
+	sync.Mutex
+	uaPrivate *ecdh.PrivateKey
+	auth      []byte
+	messages  []string
+	headers   []http.Header
+	audiences []string
+}
+
+func (s *pushService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+
+	s.Lock()
+	defer s.Unlock()
+
+	aud, ok := verifyVapid(r.Header.Get("Authorization"))
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if strings.HasSuffix(r.URL.Path, "gone") {
+		w.WriteHeader(http.StatusGone)
+		return
+	}
+	plaintext, err := s.decrypt(body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	s.messages = append(s.messages, string(plaintext))
+	s.headers = append(s.headers, r.Header)
+	s.audiences = append(s.audiences, aud)
+
+	w.Header().Set("Location", "/m/"+r.URL.Path[1:])
+	w.WriteHeader(http.StatusCreated)
+}
+
+// decrypt the RFC 8291 decryption of a single record
+func (s *pushService) decrypt(body []byte) ([]byte, error) {
+	salt, rs, idlen := body[:16], binary.BigEndian.Uint32(body[16:20]), int(body[20])
+	asPublic, ciphertext := body[21:21+idlen], body[21+idlen:]
+	if rs != webpush_record_size {
+		return nil, errBadRecord
+	}
+
+	asKey, err := ecdh.P256().NewPublicKey(asPublic)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := s.uaPrivate.ECDH(asKey)
+	if err != nil {
+		return nil, err
+	}
+
+	uaPublic := s.uaPrivate.PublicKey().Bytes()
+	keyInfo := append(append([]byte("WebPush: info\x00"), uaPublic...), asPublic...)
+	ikm := hkdf(s.auth, secret, keyInfo, 32)
+	cek := hkdf(salt, ikm, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	nonce := hkdf(salt, ikm, []byte("Content-Encoding: nonce\x00"), 12)
+
+	block, _ := aes.NewCipher(cek)
+	gcm, _ := cipher.NewGCM(block)
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, err
+	}
+	if plaintext[len(plaintext)-1] != 0x02 {
+		return nil, errBadRecord
+	}
+	return plaintext[:len(plaintext)-1], nil
+}
+
+var errBadRecord = errors.New("bad record")
+
+// verifyVapid checks the vapid token with the k public key, and returns
+// its audience
+func verifyVapid(header string) (string, bool) {
+	var token, k string
+	for _, part := range strings.Split(strings.TrimPrefix(header, "vapid "), ",") {
+		part = strings.TrimSpace(part)
+		switch {
+		case strings.HasPrefix(part, "t="):
+			token = part[2:]
+		case strings.HasPrefix(part, "k="):
+			k = part[2:]
+		}
+	}
+
+	public, err := base64.RawURLEncoding.DecodeString(k)
+	if err != nil || len(public) != 65 {
+		return "", false
+	}
+	key := &ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(public[1:33]),
+		Y:     new(big.Int).SetBytes(public[33:]),
+	}
+	if !verifyES256(key, token) {
+		return "", false
+	}
+
+	claims := make(map[string]interface{})
+	b, _ := base64.RawURLEncoding.DecodeString(strings.Split(token, ".")[1])
+	json.Unmarshal(b, &claims)
+	if !strings.HasPrefix(claims["sub"].(string), "mailto:") {
+		return "", false
+	}
+	return claims["aud"].(string), true
+}
+
+func newPushService(t *testing.T) (*pushService, *httptest.Server, *WebPushSender) {
+	uaPrivate, _ := ecdh.P256().GenerateKey(rand.Reader)
+	auth := make([]byte, 16)
+	rand.Read(auth)
+
+	s := &pushService{uaPrivate: uaPrivate, auth: auth}
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+
+	vapid, _ := ecdh.P256().GenerateKey(rand.Reader)
+	sender, err := NewWebPushSender(base64.RawURLEncoding.EncodeToString(vapid.Bytes()), "mailto:push@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender.SetHttpClient(ts.Client())
+
+	return s, ts, sender
+}
+
+func (s *pushService) subscription(ts *httptest.Server, id string) string {
+	b, _ := json.Marshal(&WebPushSubscription{
+		Endpoint: ts.URL + "/" + id,
+		Keys: WebPushKeys{
+			P256dh: base64.RawURLEncoding.EncodeToString(s.uaPrivate.PublicKey().Bytes()),
+			Auth:   base64.RawURLEncoding.EncodeToString(s.auth),
+		},
+	})
+	return string(b)
+}
+
+func TestWebPushSender(t *testing.T) {
+	s, ts, sender := newPushService(t)
+
+	store := NewMemoryTokenStore()
+	gone := s.subscription(ts, "sub2gone")
+	store.Put([]TokenRecord{{Token: gone}})
+	sender.SetTokenStore(store)
+
+	msg := &FcmMsg{
+		RegistrationIds: []string{s.subscription(ts, "sub1"), gone},
+		Notification:    NotificationPayload{Title: "Hi", Body: "there"},
+		Data:            map[string]string{"order": "42"},
+		Priority:        Priority_HIGH,
+		CollapseKey:     "orders",
+		TimeToLive:      60,
+	}
+
+	var sd Sender = sender
+	status, err := sd.SendMsg(context.Background(), msg)
+	if err != nil {
+		t.Fatalf("SendMsg => %v", err)
+	}
+	if status.Success != 1 || status.Fail != 1 || status.Results[0][message_id_key] != "/m/sub1" ||
+		status.Results[1][error_key] != fcm_not_registered {
+		t.Fatalf("status => %+v", status)
+	}
+	if _, ok := store.Get(gone); ok {
+		t.Fatal("expired subscription not purged")
+	}
+
+	if len(s.messages) != 1 || s.messages[0] != `{"notification":{"title":"Hi","body":"there"},"data":{"order":"42"}}` {
+		t.Fatalf("messages => %v", s.messages)
+	}
+	h := s.headers[0]
+	if h.Get("TTL") != "60" || h.Get("Urgency") != "high" || h.Get("Topic") != "orders" || h.Get("Content-Encoding") != "aes128gcm" {
+		t.Fatalf("headers => %v", h)
+	}
+	if s.audiences[0] != ts.URL {
+		t.Fatalf("audience => %s", s.audiences[0])
+	}
+}
+
+func TestWebPushSenderInvalidTopic(t *testing.T) {
+	s, ts, sender := newPushService(t)
+
+	msg := &FcmMsg{To: s.subscription(ts, "sub1"), Data: map[string]string{"k": "v"}, CollapseKey: "not a topic!"}
+	if _, err := sender.SendMsg(context.Background(), msg); err == nil {
+		t.Fatal("invalid topic accepted")
+	}
+}
+
+func TestWebPushMaxBody(t *testing.T) {
+	s, ts, sender := newPushService(t)
+
+	sub := new(WebPushSubscription)
+	json.Unmarshal([]byte(s.subscription(ts, "sub1")), sub)
+
+	body, err := encryptWebPush(sub, make([]byte, webpush_max_payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(body) != webpush_max_body {
+		t.Fatalf("body => %d bytes, want %d", len(body), webpush_max_body)
+	}
+
+	msg := &FcmMsg{To: s.subscription(ts, "sub1"), Data: map[string]string{"k": strings.Repeat("v", webpush_max_payload)}}
+	if _, err := sender.SendMsg(context.Background(), msg); err == nil {
+		t.Fatal("oversized payload accepted")
+	}
+	if len(s.messages) != 0 {
+		t.Fatalf("messages => %d", len(s.messages))
+	}
+}
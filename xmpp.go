@@ -0,0 +1,811 @@
+package fcm
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// xmpp_server_addr fcm connection server
+	xmpp_server_addr = "fcm-xmpp.googleapis.com:5235"
+	// xmpp_domain the domain of the fcm connection server
+	xmpp_domain = "fcm.googleapis.com"
+
+	// xmpp namespaces
+	xmpp_ns_stream = "http://etherx.jabber.org/streams"
+	xmpp_ns_sasl   = "urn:ietf:params:xml:ns:xmpp-sasl"
+	xmpp_ns_bind   = "urn:ietf:params:xml:ns:xmpp-bind"
+	xmpp_ns_gcm    = "google:mobile:data"
+
+	// xmpp_sasl_plain the supported sasl mechanism
+	xmpp_sasl_plain = "PLAIN"
+
+	// xmpp_max_pending max number of unacked downstream messages per connection
+	xmpp_max_pending = 100
+
+	// fcm message types of the connection server
+	xmpp_type_ack     = "ack"
+	xmpp_type_nack    = "nack"
+	xmpp_type_control = "control"
+	xmpp_type_receipt = "receipt"
+
+	// xmpp_control_draining control type sent before the server closes the connection
+	xmpp_control_draining = "CONNECTION_DRAINING"
+
+	// xmpp_max_backoff max wait between reconnections
+	xmpp_max_backoff = 30 * time.Second
+)
+
+var (
+	// ErrXmppClosed the client or the connection is closed
+	ErrXmppClosed = errors.New("fcm: xmpp connection closed")
+
+	// errXmppDraining the connection is draining, the message must be sent
+	// on a new connection
+	errXmppDraining = errors.New("fcm: xmpp connection draining")
+
+	// xmppDialTimeout and xmppBackoff, for testing purposes
+	xmppDialTimeout = 30 * time.Second
+	xmppBackoff     = time.Second
+)
+
+// XmppMessage a downstream message sent through the connection server,
+// the target is To (token or topic) or Condition, RegistrationIds is
+// not supported by the connection server
+type XmppMessage struct {
+	FcmMsg
+	// MessageId unique id of the message, generated if empty
+	MessageId string `json:"message_id"`
+	// DeliveryReceiptRequested asks for a delivery receipt
+	DeliveryReceiptRequested bool `json:"delivery_receipt_requested,omitempty"`
+}
+
+// XmppUpstream an upstream message sent by a device
+type XmppUpstream struct {
+	From      string            `json:"from"`
+	Category  string            `json:"category,omitempty"`
+	MessageId string            `json:"message_id"`
+	Data      map[string]string `json:"data,omitempty"`
+}
+
+// XmppReceipt a delivery receipt of a downstream message
+type XmppReceipt struct {
+	MessageId string `json:"message_id"`
+	Category  string `json:"category,omitempty"`
+	Data      struct {
+		MessageStatus        string `json:"message_status"`
+		OriginalMessageId    string `json:"original_message_id"`
+		DeviceRegistrationId string `json:"device_registration_id"`
+		MessageSentTimestamp string `json:"message_sent_timestamp"`
+	} `json:"data"`
+}
+
+// XmppNack a downstream message refused by the connection server
+type XmppNack struct {
+	MessageId        string `json:"message_id"`
+	From             string `json:"from,omitempty"`
+	Code             string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+// XmppHandler receives the upstream messages and delivery receipts,
+// both are acked to the server after the handler returns
+type XmppHandler interface {
+	OnUpstream(msg *XmppUpstream)
+	OnReceipt(receipt *XmppReceipt)
+}
+
+// XmppClient a connection server (xmpp) client, it keeps a connection
+// open, reconnecting when the server drains or drops it
+type XmppClient struct {
+	senderId  string
+	apiKey    string
+	addr      string
+	tlsConfig *tls.Config
+	handler   XmppHandler
+	logger    Logger
+	outcomes  OutcomeStore
+
+	mu      sync.Mutex
+	conn    *xmppConn
+	changed chan struct{}
+	done    chan struct{}
+	closed  bool
+}
+
+// xmppStanza the incoming message stanza
+type xmppStanza struct {
+	XMLName xml.Name
+	Id      string `xml:"id,attr"`
+	Type    string `xml:"type,attr"`
+	Gcm     struct {
+		Text string `xml:",chardata"`
+	} `xml:"gcm"`
+}
+
+// xmppFeatures the stream features
+type xmppFeatures struct {
+	Mechanisms []string  `xml:"mechanisms>mechanism"`
+	Bind       *struct{} `xml:"bind"`
+}
+
+// xmppGcm the json payload of the gcm element of incoming messages
+type xmppGcm struct {
+	MessageType      string `json:"message_type"`
+	MessageId        string `json:"message_id"`
+	From             string `json:"from"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+	ControlType      string `json:"control_type"`
+}
+
+// xmppAck the ack of an upstream message or receipt
+type xmppAck struct {
+	To          string `json:"to"`
+	MessageId   string `json:"message_id"`
+	MessageType string `json:"message_type"`
+}
+
+// xmppConn a single authenticated connection
+type xmppConn struct {
+	client *XmppClient
+	conn   net.Conn
+	dec    *xml.Decoder
+
+	writeMu sync.Mutex
+
+	mu       sync.Mutex
+	pending  map[string]chan error
+	slots    chan struct{}
+	draining chan struct{}
+	closed   chan struct{}
+	isDrain  bool
+	isClosed bool
+}
+
+// NewXmppClient init the connection server client, senderId is the
+// project number and apiKey the server key
+func NewXmppClient(senderId string, apiKey string, handler XmppHandler) *XmppClient {
+	return &XmppClient{
+		senderId: senderId,
+		apiKey:   apiKey,
+		addr:     xmpp_server_addr,
+		handler:  handler,
+		changed:  make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// SetServer sets the host:port of the connection server, e.g. the
+// pre-production fcm-xmpp.googleapis.com:5236
+func (this *XmppClient) SetServer(addr string) *XmppClient {
+
+	this.addr = addr
+
+	return this
+}
+
+// SetTLSConfig sets the tls config of the connections
+func (this *XmppClient) SetTLSConfig(cfg *tls.Config) *XmppClient {
+
+	this.tlsConfig = cfg
+
+	return this
+}
+
+// SetLogger sets the logger of the client, nil disables logging
+func (this *XmppClient) SetLogger(l Logger) *XmppClient {
+
+	this.logger = l
+
+	return this
+}
+
+// SetOutcomeStore sets the store recording the result of every Send,
+// under the message id, and the delivery receipts
+func (this *XmppClient) SetOutcomeStore(store OutcomeStore) *XmppClient {
+
+	this.outcomes = store
+
+	return this
+}
+
+// getLogger returns the client logger or a no-op one
+func (this *XmppClient) getLogger() Logger {
+	if this.logger == nil {
+		return nopLogger{}
+	}
+	return this.logger
+}
+
+// Connect opens the first connection and keeps the client connected
+// until Close
+func (this *XmppClient) Connect() error {
+
+	conn, err := this.dial()
+	if err != nil {
+		return err
+	}
+
+	this.setConn(conn)
+	go this.maintain()
+
+	return nil
+}
+
+// Close stops reconnecting and closes the connection, the messages
+// waiting for an ack fail with ErrXmppClosed
+func (this *XmppClient) Close() error {
+
+	this.mu.Lock()
+	if this.closed {
+		this.mu.Unlock()
+		return nil
+	}
+	this.closed = true
+	close(this.done)
+	conn := this.conn
+	this.mu.Unlock()
+
+	if conn != nil {
+		conn.close()
+	}
+
+	return nil
+}
+
+// Send sends a downstream message and waits for its ack, a refused message
+// returns a *XmppNack. At most 100 messages wait for an ack at the same
+// time, Send blocks until a slot is free or ctx is done
+func (this *XmppClient) Send(ctx context.Context, msg *XmppMessage) error {
+
+	if len(msg.RegistrationIds) > 0 {
+		return errors.New("fcm: registration_ids is not supported by the connection server")
+	}
+
+	if msg.MessageId == "" {
+		msg.MessageId = newXmppMessageId()
+	}
+
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("fcm: encoding xmpp message: %w", err)
+	}
+
+	for {
+		conn, err := this.waitConn(ctx)
+		if err != nil {
+			return err
+		}
+
+		err = conn.send(ctx, msg.MessageId, payload)
+		if err != errXmppDraining {
+			this.recordOutcome(msg, err)
+			return err
+		}
+	}
+}
+
+// recordOutcome records the ack or nack of msg in the outcome store
+func (this *XmppClient) recordOutcome(msg *XmppMessage, err error) {
+
+	if this.outcomes == nil {
+		return
+	}
+
+	result := TokenResult{Token: msg.To, MessageId: msg.MessageId}
+
+	nack := new(XmppNack)
+	if errors.As(err, &nack) {
+		result.Error = nack.Code
+	} else if err != nil {
+		// no ack, the message may or may not have been accepted
+		return
+	}
+
+	attempt := &SendAttempt{NotificationId: msg.MessageId, Time: time.Now(), Results: []TokenResult{result}}
+	if err := this.outcomes.RecordAttempt(attempt); err != nil {
+		this.getLogger().Warn("fcm: recording outcome failed", "notification_id", msg.MessageId, "error", err)
+	}
+}
+
+// recordReceipt records a delivery receipt in the outcome store
+func (this *XmppClient) recordReceipt(receipt *XmppReceipt) {
+
+	if this.outcomes == nil {
+		return
+	}
+
+	r := &DeliveryReceipt{
+		MessageId: receipt.Data.OriginalMessageId,
+		Token:     receipt.Data.DeviceRegistrationId,
+		Status:    receipt.Data.MessageStatus,
+		Time:      time.Now(),
+	}
+	if ms, err := strconv.ParseInt(receipt.Data.MessageSentTimestamp, 10, 64); err == nil {
+		r.Time = time.UnixMilli(ms)
+	}
+
+	if err := this.outcomes.RecordReceipt(r); err != nil {
+		this.getLogger().Warn("fcm: recording receipt failed", "message_id", r.MessageId, "error", err)
+	}
+}
+
+// Error returns the nack error
+func (this *XmppNack) Error() string {
+	return fmt.Sprintf("fcm: xmpp nack %s: %s", this.Code, this.ErrorDescription)
+}
+
+// dial opens and authenticates a new connection
+func (this *XmppClient) dial() (*xmppConn, error) {
+
+	dialer := &net.Dialer{Timeout: xmppDialTimeout}
+
+	netConn, err := tls.DialWithDialer(dialer, "tcp", this.addr, this.tlsConfig)
+	if err != nil {
+		return nil, fmt.Errorf("fcm: xmpp dial: %w", err)
+	}
+
+	conn := &xmppConn{
+		client:   this,
+		conn:     netConn,
+		dec:      xml.NewDecoder(netConn),
+		pending:  make(map[string]chan error),
+		slots:    make(chan struct{}, xmpp_max_pending),
+		draining: make(chan struct{}),
+		closed:   make(chan struct{}),
+	}
+
+	netConn.SetDeadline(time.Now().Add(xmppDialTimeout))
+	if err := conn.handshake(this.senderId, this.apiKey); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	netConn.SetDeadline(time.Time{})
+
+	go conn.readLoop()
+
+	this.getLogger().Info("fcm: xmpp connected", "server", this.addr)
+
+	return conn, nil
+}
+
+// maintain reconnects when the connection is draining or closed
+func (this *XmppClient) maintain() {
+
+	for {
+		this.mu.Lock()
+		conn := this.conn
+		this.mu.Unlock()
+
+		select {
+		case <-this.done:
+			return
+		case <-conn.draining:
+		case <-conn.closed:
+		}
+
+		backoff := xmppBackoff
+		for {
+			newConn, err := this.dial()
+			if err == nil {
+				if !this.setConn(newConn) {
+					newConn.close()
+					return
+				}
+				break
+			}
+
+			this.getLogger().Warn("fcm: xmpp reconnect failed", "error", err, "backoff", backoff)
+
+			select {
+			case <-this.done:
+				return
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > xmpp_max_backoff {
+				backoff = xmpp_max_backoff
+			}
+		}
+	}
+}
+
+// setConn makes conn the current connection, false if the client is closed
+func (this *XmppClient) setConn(conn *xmppConn) bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.closed {
+		return false
+	}
+
+	this.conn = conn
+	close(this.changed)
+	this.changed = make(chan struct{})
+
+	return true
+}
+
+// waitConn returns the current connection, waiting for a new one if it
+// is draining or closed
+func (this *XmppClient) waitConn(ctx context.Context) (*xmppConn, error) {
+	for {
+		this.mu.Lock()
+		conn, changed, closed := this.conn, this.changed, this.closed
+		this.mu.Unlock()
+
+		if closed || conn == nil {
+			return nil, ErrXmppClosed
+		}
+		if conn.usable() {
+			return conn, nil
+		}
+
+		select {
+		case <-changed:
+		case <-this.done:
+			return nil, ErrXmppClosed
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// handshake opens the stream, authenticates with sasl plain and binds
+func (this *xmppConn) handshake(senderId string, apiKey string) error {
+
+	features, err := this.openStream()
+	if err != nil {
+		return err
+	}
+
+	supported := false
+	for _, m := range features.Mechanisms {
+		if m == xmpp_sasl_plain {
+			supported = true
+		}
+	}
+	if !supported {
+		return errors.New("fcm: xmpp server does not support sasl plain")
+	}
+
+	user := senderId + "@" + xmpp_domain
+	auth := base64.StdEncoding.EncodeToString([]byte("\x00" + user + "\x00" + apiKey))
+	if err := this.write(fmt.Sprintf(`<auth mechanism="%s" xmlns="%s">%s</auth>`, xmpp_sasl_plain, xmpp_ns_sasl, auth)); err != nil {
+		return err
+	}
+
+	start, err := this.nextElement()
+	if err != nil {
+		return err
+	}
+	if start.Name.Local != "success" {
+		this.dec.Skip()
+		return fmt.Errorf("fcm: xmpp authentication failed: %s", start.Name.Local)
+	}
+	if err := this.dec.Skip(); err != nil {
+		return fmt.Errorf("fcm: xmpp read: %w", err)
+	}
+
+	features, err = this.openStream()
+	if err != nil {
+		return err
+	}
+	if features.Bind == nil {
+		return errors.New("fcm: xmpp server does not support bind")
+	}
+
+	if err := this.write(fmt.Sprintf(`<iq type="set" id="bind"><bind xmlns="%s"></bind></iq>`, xmpp_ns_bind)); err != nil {
+		return err
+	}
+
+	iq := new(xmppStanza)
+	if err := this.decodeNext(iq); err != nil {
+		return err
+	}
+	if iq.XMLName.Local != "iq" || iq.Type != "result" {
+		return fmt.Errorf("fcm: xmpp bind failed: %s %s", iq.XMLName.Local, iq.Type)
+	}
+
+	return nil
+}
+
+// openStream writes the stream header and reads the server header and features
+func (this *xmppConn) openStream() (*xmppFeatures, error) {
+
+	header := fmt.Sprintf(`<stream:stream to="%s" version="1.0" xmlns="jabber:client" xmlns:stream="%s">`,
+		xmpp_domain, xmpp_ns_stream)
+	if err := this.write(header); err != nil {
+		return nil, err
+	}
+
+	start, err := this.nextElement()
+	if err != nil {
+		return nil, err
+	}
+	if start.Name.Space != xmpp_ns_stream || start.Name.Local != "stream" {
+		return nil, fmt.Errorf("fcm: xmpp unexpected element %s", start.Name.Local)
+	}
+
+	features := new(xmppFeatures)
+	start, err = this.nextElement()
+	if err != nil {
+		return nil, err
+	}
+	if start.Name.Local != "features" {
+		return nil, fmt.Errorf("fcm: xmpp expected features, got %s", start.Name.Local)
+	}
+	if err := this.dec.DecodeElement(features, start); err != nil {
+		return nil, fmt.Errorf("fcm: xmpp read features: %w", err)
+	}
+
+	return features, nil
+}
+
+// nextElement returns the next start element, an end of stream is ErrXmppClosed
+func (this *xmppConn) nextElement() (*xml.StartElement, error) {
+	for {
+		token, err := this.dec.Token()
+		if err != nil {
+			return nil, fmt.Errorf("fcm: xmpp read: %w", err)
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			return &t, nil
+		case xml.EndElement:
+			if t.Name.Local == "stream" {
+				return nil, ErrXmppClosed
+			}
+		}
+	}
+}
+
+// decodeNext decodes the next element into v
+func (this *xmppConn) decodeNext(v interface{}) error {
+	start, err := this.nextElement()
+	if err != nil {
+		return err
+	}
+	if err := this.dec.DecodeElement(v, start); err != nil {
+		return fmt.Errorf("fcm: xmpp read: %w", err)
+	}
+	return nil
+}
+
+// write writes raw xml to the connection
+func (this *xmppConn) write(s string) error {
+	this.writeMu.Lock()
+	defer this.writeMu.Unlock()
+
+	if _, err := this.conn.Write([]byte(s)); err != nil {
+		return fmt.Errorf("fcm: xmpp write: %w", err)
+	}
+	return nil
+}
+
+// writeGcm writes a message stanza with a json payload
+func (this *xmppConn) writeGcm(payload []byte) error {
+	buf := new(bytes.Buffer)
+	buf.WriteString(`<message id=""><gcm xmlns="` + xmpp_ns_gcm + `">`)
+	xml.EscapeText(buf, payload)
+	buf.WriteString(`</gcm></message>`)
+
+	return this.write(buf.String())
+}
+
+// send writes the message and waits for its ack or nack
+func (this *xmppConn) send(ctx context.Context, id string, payload []byte) error {
+
+	select {
+	case this.slots <- struct{}{}:
+	case <-this.closed:
+		return ErrXmppClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	result := make(chan error, 1)
+
+	this.mu.Lock()
+	if this.isDrain || this.isClosed {
+		this.mu.Unlock()
+		<-this.slots
+		return errXmppDraining
+	}
+	this.pending[id] = result
+	this.mu.Unlock()
+
+	if err := this.writeGcm(payload); err != nil {
+		this.resolve(id, err)
+		this.close()
+		return err
+	}
+
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		// the slot is released by the ack or the close of the connection
+		return ctx.Err()
+	}
+}
+
+// resolve hands the ack/nack to the waiting sender and frees its slot
+func (this *xmppConn) resolve(id string, err error) {
+	this.mu.Lock()
+	result, ok := this.pending[id]
+	delete(this.pending, id)
+	drained := this.isDrain && len(this.pending) == 0
+	this.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	result <- err
+	<-this.slots
+
+	if drained {
+		this.close()
+	}
+}
+
+// usable whether new messages can be sent on the connection
+func (this *xmppConn) usable() bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return !this.isDrain && !this.isClosed
+}
+
+// drain stops sending on the connection, it is closed once the pending
+// messages are acked
+func (this *xmppConn) drain() {
+	this.mu.Lock()
+	if this.isDrain {
+		this.mu.Unlock()
+		return
+	}
+	this.isDrain = true
+	empty := len(this.pending) == 0
+	this.mu.Unlock()
+
+	close(this.draining)
+	this.client.getLogger().Info("fcm: xmpp connection draining")
+
+	if empty {
+		this.close()
+	}
+}
+
+// close closes the stream and fails the pending messages
+func (this *xmppConn) close() {
+	this.mu.Lock()
+	if this.isClosed {
+		this.mu.Unlock()
+		return
+	}
+	this.isClosed = true
+	pending := this.pending
+	this.pending = make(map[string]chan error)
+	this.mu.Unlock()
+
+	this.write("</stream:stream>")
+	this.conn.Close()
+	close(this.closed)
+
+	for _, result := range pending {
+		result <- ErrXmppClosed
+		<-this.slots
+	}
+}
+
+// readLoop reads the incoming stanzas until the connection is closed
+func (this *xmppConn) readLoop() {
+	defer this.close()
+
+	logger := this.client.getLogger()
+
+	for {
+		stanza := new(xmppStanza)
+		if err := this.decodeNext(stanza); err != nil {
+			if !errors.Is(err, ErrXmppClosed) {
+				this.mu.Lock()
+				closed := this.isClosed
+				this.mu.Unlock()
+				if !closed {
+					logger.Warn("fcm: xmpp connection lost", "error", err)
+				}
+			}
+			return
+		}
+
+		if stanza.XMLName.Local != "message" || stanza.Gcm.Text == "" {
+			continue
+		}
+
+		if err := this.dispatch([]byte(stanza.Gcm.Text)); err != nil {
+			logger.Error("fcm: xmpp invalid message", "error", err)
+		}
+	}
+}
+
+// dispatch handles a gcm json payload by message type
+func (this *xmppConn) dispatch(raw []byte) error {
+
+	gcm := new(xmppGcm)
+	if err := json.Unmarshal(raw, gcm); err != nil {
+		return err
+	}
+
+	handler := this.client.handler
+
+	switch gcm.MessageType {
+	case xmpp_type_ack:
+		this.resolve(gcm.MessageId, nil)
+
+	case xmpp_type_nack:
+		nack := new(XmppNack)
+		if err := json.Unmarshal(raw, nack); err != nil {
+			return err
+		}
+		this.client.getLogger().Info("fcm: xmpp nack",
+			"message_id", nack.MessageId, "token", redactToken(nack.From), "error", nack.Code)
+		this.resolve(gcm.MessageId, nack)
+
+	case xmpp_type_control:
+		if gcm.ControlType == xmpp_control_draining {
+			this.drain()
+		}
+
+	case xmpp_type_receipt:
+		receipt := new(XmppReceipt)
+		if err := json.Unmarshal(raw, receipt); err != nil {
+			return err
+		}
+		this.client.recordReceipt(receipt)
+		if handler != nil {
+			handler.OnReceipt(receipt)
+		}
+		return this.ack(gcm.From, gcm.MessageId)
+
+	case "":
+		upstream := new(XmppUpstream)
+		if err := json.Unmarshal(raw, upstream); err != nil {
+			return err
+		}
+		if handler != nil {
+			handler.OnUpstream(upstream)
+		}
+		return this.ack(gcm.From, gcm.MessageId)
+	}
+
+	return nil
+}
+
+// ack acknowledges an upstream message or a receipt
+func (this *xmppConn) ack(to string, id string) error {
+	payload, err := json.Marshal(&xmppAck{To: to, MessageId: id, MessageType: xmpp_type_ack})
+	if err != nil {
+		return err
+	}
+	return this.writeGcm(payload)
+}
+
+// newXmppMessageId generates a random message id
+func newXmppMessageId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
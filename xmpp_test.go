@@ -0,0 +1,457 @@
+package fcm
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// xmppStub a local connection server, downstream messages to "bad" are
+// nacked, the others are acked unless hold is set
+type xmppStub struct {
+	ln       net.Listener
+	failAuth bool
+
+	mu       sync.Mutex
+	auths    []string
+	conns    []*stubConn
+	received []string
+	acks     []string
+	held     []*stubConn
+	heldIds  []string
+	hold     bool
+	drainAt  int
+}
+
+type stubConn struct {
+	net.Conn
+	dec *xml.Decoder
+	wmu sync.Mutex
+}
+
+type stubAuth struct {
+	Mechanism string `xml:"mechanism,attr"`
+	Text      string `xml:",chardata"`
+}
+
+func (c *stubConn) writeStr(s string) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.Write([]byte(s))
+}
+
+func (c *stubConn) writeGcm(v interface{}) {
+	b, _ := json.Marshal(v)
+	c.writeStr(`<message><gcm xmlns="google:mobile:data">` + escapeXml(b) + `</gcm></message>`)
+}
+
+func escapeXml(b []byte) string {
+	buf := new(bytes.Buffer)
+	xml.EscapeText(buf, b)
+	return buf.String()
+}
+
+func (c *stubConn) next() (*xml.StartElement, error) {
+	for {
+		token, err := c.dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		if start, ok := token.(xml.StartElement); ok {
+			return &start, nil
+		}
+	}
+}
+
+func (c *stubConn) openStream(features string) error {
+	if _, err := c.next(); err != nil {
+		return err
+	}
+	c.writeStr(`<stream:stream from="fcm.googleapis.com" id="1" version="1.0" xmlns:stream="http://etherx.jabber.org/streams" xmlns="jabber:client">`)
+	c.writeStr(`<stream:features>` + features + `</stream:features>`)
+	return nil
+}
+
+func newXmppStub(t *testing.T) *xmppStub {
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{selfSignedCert(t)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub := &xmppStub{ln: ln}
+	go stub.serve()
+	return stub
+}
+
+func (s *xmppStub) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(&stubConn{Conn: conn, dec: xml.NewDecoder(conn)})
+	}
+}
+
+func (s *xmppStub) handle(c *stubConn) {
+	defer c.Close()
+
+	if err := c.openStream(`<mechanisms xmlns="urn:ietf:params:xml:ns:xmpp-sasl"><mechanism>X-OAUTH2</mechanism><mechanism>PLAIN</mechanism></mechanisms>`); err != nil {
+		return
+	}
+
+	start, err := c.next()
+	if err != nil {
+		return
+	}
+	auth := new(stubAuth)
+	c.dec.DecodeElement(auth, start)
+	s.mu.Lock()
+	s.auths = append(s.auths, auth.Text)
+	s.mu.Unlock()
+
+	if s.failAuth {
+		c.writeStr(`<failure xmlns="urn:ietf:params:xml:ns:xmpp-sasl"><not-authorized/></failure></stream:stream>`)
+		return
+	}
+	c.writeStr(`<success xmlns="urn:ietf:params:xml:ns:xmpp-sasl"/>`)
+
+	if err := c.openStream(`<bind xmlns="urn:ietf:params:xml:ns:xmpp-bind"/><session xmlns="urn:ietf:params:xml:ns:xmpp-session"/>`); err != nil {
+		return
+	}
+	if start, err = c.next(); err != nil {
+		return
+	}
+	c.dec.Skip()
+
+	s.mu.Lock()
+	s.conns = append(s.conns, c)
+	s.mu.Unlock()
+
+	c.writeStr(`<iq type="result" id="bind"><bind xmlns="urn:ietf:params:xml:ns:xmpp-bind"><jid>123@fcm.googleapis.com/ABC</jid></bind></iq>`)
+
+	for {
+		stanza := new(xmppStanza)
+		start, err := c.next()
+		if err != nil {
+			return
+		}
+		if err := c.dec.DecodeElement(stanza, start); err != nil {
+			return
+		}
+
+		msg := make(map[string]interface{})
+		json.Unmarshal([]byte(stanza.Gcm.Text), &msg)
+		id, _ := msg["message_id"].(string)
+
+		s.mu.Lock()
+		if msg["message_type"] == xmpp_type_ack {
+			s.acks = append(s.acks, id)
+			s.mu.Unlock()
+			continue
+		}
+		s.received = append(s.received, id)
+		drain := s.drainAt > 0 && len(s.received) == s.drainAt
+		if s.hold {
+			s.held = append(s.held, c)
+			s.heldIds = append(s.heldIds, id)
+			s.mu.Unlock()
+			continue
+		}
+		s.mu.Unlock()
+
+		if msg["to"] == "bad" {
+			c.writeGcm(map[string]string{"message_type": "nack", "message_id": id, "from": "bad",
+				"error": "BAD_REGISTRATION", "error_description": "Invalid token"})
+		} else {
+			c.writeGcm(map[string]string{"message_type": "ack", "message_id": id, "from": msg["to"].(string)})
+		}
+		if drain {
+			c.writeGcm(map[string]string{"message_type": "control", "control_type": "CONNECTION_DRAINING"})
+		}
+	}
+}
+
+// release acks the held messages and stops holding
+func (s *xmppStub) release() {
+	s.mu.Lock()
+	held, ids := s.held, s.heldIds
+	s.held, s.heldIds, s.hold = nil, nil, false
+	s.mu.Unlock()
+
+	for i, c := range held {
+		c.writeGcm(map[string]string{"message_type": "ack", "message_id": ids[i]})
+	}
+}
+
+func (s *xmppStub) counts() (conns int, received int, held int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns), len(s.received), len(s.held)
+}
+
+func (s *xmppStub) conn(i int) *stubConn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conns[i]
+}
+
+func (s *xmppStub) client(handler XmppHandler) *XmppClient {
+	return NewXmppClient("123", "key", handler).
+		SetServer(s.ln.Addr().String()).
+		SetTLSConfig(&tls.Config{InsecureSkipVerify: true})
+}
+
+func selfSignedCert(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+type recordHandler struct {
+	sync.Mutex
+	upstream []*XmppUpstream
+	receipts []*XmppReceipt
+	done     chan struct{}
+}
+
+func (h *recordHandler) OnUpstream(msg *XmppUpstream) {
+	h.Lock()
+	h.upstream = append(h.upstream, msg)
+	h.Unlock()
+	h.done <- struct{}{}
+}
+
+func (h *recordHandler) OnReceipt(receipt *XmppReceipt) {
+	h.Lock()
+	h.receipts = append(h.receipts, receipt)
+	h.Unlock()
+	h.done <- struct{}{}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestXmppSend(t *testing.T) {
+	stub := newXmppStub(t)
+	defer stub.ln.Close()
+
+	c := stub.client(nil)
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	want := base64.StdEncoding.EncodeToString([]byte("\x00123@fcm.googleapis.com\x00key"))
+	stub.mu.Lock()
+	auth := stub.auths[0]
+	stub.mu.Unlock()
+	if auth != want {
+		t.Fatalf("auth => %s, want %s", auth, want)
+	}
+
+	msg := &XmppMessage{FcmMsg: FcmMsg{To: "token", Data: map[string]string{"msg": "<hi & bye>"}}}
+	if err := c.Send(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.MessageId == "" {
+		t.Fatal("message id not generated")
+	}
+
+	err := c.Send(context.Background(), &XmppMessage{FcmMsg: FcmMsg{To: "bad"}, MessageId: "m-2"})
+	var nack *XmppNack
+	if !errors.As(err, &nack) || nack.Code != "BAD_REGISTRATION" || nack.MessageId != "m-2" {
+		t.Fatalf("err => %v, want a BAD_REGISTRATION nack", err)
+	}
+
+	if err := c.Send(context.Background(), &XmppMessage{FcmMsg: FcmMsg{RegistrationIds: []string{"a"}}}); err == nil {
+		t.Fatal("registration_ids should be refused")
+	}
+}
+
+func TestXmppAuthFailure(t *testing.T) {
+	stub := newXmppStub(t)
+	defer stub.ln.Close()
+	stub.failAuth = true
+
+	if err := stub.client(nil).Connect(); err == nil {
+		t.Fatal("Connect should fail")
+	}
+}
+
+func TestXmppUpstreamAndReceipt(t *testing.T) {
+	stub := newXmppStub(t)
+	defer stub.ln.Close()
+
+	handler := &recordHandler{done: make(chan struct{}, 2)}
+	c := stub.client(handler)
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	conn := stub.conn(0)
+	conn.writeGcm(map[string]interface{}{"from": "device", "category": "com.example", "message_id": "up-1",
+		"data": map[string]string{"hello": "world"}})
+	conn.writeGcm(map[string]interface{}{"from": "gcm.googleapis.com", "message_id": "dr2:m-1", "message_type": "receipt",
+		"data": map[string]string{"message_status": "MESSAGE_SENT_TO_DEVICE", "original_message_id": "m-1",
+			"device_registration_id": "token"}})
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-handler.done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout")
+		}
+	}
+
+	if handler.upstream[0].From != "device" || handler.upstream[0].Data["hello"] != "world" {
+		t.Fatalf("upstream => %+v", handler.upstream[0])
+	}
+	if handler.receipts[0].Data.OriginalMessageId != "m-1" || handler.receipts[0].Data.MessageStatus != "MESSAGE_SENT_TO_DEVICE" {
+		t.Fatalf("receipt => %+v", handler.receipts[0])
+	}
+
+	waitFor(t, func() bool {
+		stub.mu.Lock()
+		defer stub.mu.Unlock()
+		return len(stub.acks) == 2
+	})
+	if stub.acks[0] != "up-1" || stub.acks[1] != "dr2:m-1" {
+		t.Fatalf("acks => %v", stub.acks)
+	}
+}
+
+func TestXmppFlowControl(t *testing.T) {
+	stub := newXmppStub(t)
+	defer stub.ln.Close()
+	stub.hold = true
+
+	c := stub.client(nil)
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	n := xmpp_max_pending + 50
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			errs <- c.Send(context.Background(), &XmppMessage{FcmMsg: FcmMsg{To: "token"}, MessageId: fmt.Sprint("m-", i)})
+		}(i)
+	}
+
+	waitFor(t, func() bool { _, _, held := stub.counts(); return held == xmpp_max_pending })
+	time.Sleep(50 * time.Millisecond)
+	if _, received, _ := stub.counts(); received != xmpp_max_pending {
+		t.Fatalf("received => %d unacked messages, want %d", received, xmpp_max_pending)
+	}
+
+	stub.release()
+
+	for i := 0; i < n; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestXmppSendContext(t *testing.T) {
+	stub := newXmppStub(t)
+	defer stub.ln.Close()
+	stub.hold = true
+
+	c := stub.client(nil)
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	err := c.Send(ctx, &XmppMessage{FcmMsg: FcmMsg{To: "token"}})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err => %v, want deadline exceeded", err)
+	}
+}
+
+func TestXmppDraining(t *testing.T) {
+	stub := newXmppStub(t)
+	defer stub.ln.Close()
+	stub.drainAt = 1
+
+	c := stub.client(nil)
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Send(context.Background(), &XmppMessage{FcmMsg: FcmMsg{To: "token"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, func() bool { conns, _, _ := stub.counts(); return conns == 2 })
+
+	if err := c.Send(context.Background(), &XmppMessage{FcmMsg: FcmMsg{To: "token"}}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestXmppReconnect(t *testing.T) {
+	stub := newXmppStub(t)
+	defer stub.ln.Close()
+
+	defer func(backoff time.Duration) { xmppBackoff = backoff }(xmppBackoff)
+	xmppBackoff = 10 * time.Millisecond
+
+	c := stub.client(nil)
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	stub.conn(0).Close()
+
+	if err := c.Send(context.Background(), &XmppMessage{FcmMsg: FcmMsg{To: "token"}}); err != nil && !errors.Is(err, ErrXmppClosed) {
+		t.Fatal(err)
+	}
+
+	waitFor(t, func() bool { conns, _, _ := stub.counts(); return conns == 2 })
+
+	if err := c.Send(context.Background(), &XmppMessage{FcmMsg: FcmMsg{To: "token"}}); err != nil {
+		t.Fatal(err)
+	}
+}